@@ -147,8 +147,8 @@ func RoutesGet() ([]core.Route, error) {
 }
 
 // RoutesAdd adds en new route
-func RoutesAdd(host, localIp, remoteHost string, remotePort, priority int, user, mailFrom, smtpAuthLogin, smtpAuthPasswd string) error {
-	return core.AddRoute(host, localIp, remoteHost, remotePort, priority, user, mailFrom, smtpAuthLogin, smtpAuthPasswd)
+func RoutesAdd(host, localIp, remoteHost string, remotePort, priority int, user, mailFrom, smtpAuthLogin, smtpAuthPasswd, tlsPolicy, tlsClientCert, tlsClientKey, tlsCaBundle string) error {
+	return core.AddRoute(host, localIp, remoteHost, remotePort, priority, user, mailFrom, smtpAuthLogin, smtpAuthPasswd, tlsPolicy, tlsClientCert, tlsClientKey, tlsCaBundle)
 }
 
 // RoutesDel delete route routeId
@@ -156,6 +156,72 @@ func RoutesDel(routeId int64) error {
 	return core.DelRoute(routeId)
 }
 
+// DELIVERY POLICIES
+
+// DeliveryPolicyGetAll returns all delivery policies
+func DeliveryPolicyGetAll() ([]core.DeliveryPolicy, error) {
+	return core.DeliveryPolicyGetAll()
+}
+
+// DeliveryPolicyAdd adds a delivery policy for domain or MX pattern
+func DeliveryPolicyAdd(pattern string, maxConns, maxMsgsPerMinute, backoff421 int, requireDANE bool) error {
+	return core.DeliveryPolicyAdd(pattern, maxConns, maxMsgsPerMinute, backoff421, requireDANE)
+}
+
+// DeliveryPolicyDel deletes the delivery policy for pattern
+func DeliveryPolicyDel(pattern string) error {
+	return core.DeliveryPolicyDel(pattern)
+}
+
+// REMOTE HOSTS (circuit breaker)
+
+// RemoteHostGetAll returns remote hosts with connection failures
+func RemoteHostGetAll() ([]core.RemoteHost, error) {
+	return core.RemoteHostGetAll()
+}
+
+// RemoteHostReset resets the failures of remote host ip
+func RemoteHostReset(ip string) error {
+	return core.RemoteHostReset(ip)
+}
+
+// RemoteHostResetAll resets the failures of all remote hosts
+func RemoteHostResetAll() error {
+	return core.RemoteHostResetAll()
+}
+
+// GREYLISTING
+
+// GreylistGetAll returns greylisted triplets
+func GreylistGetAll() ([]core.GreylistEntry, error) {
+	return core.GreylistGetAll()
+}
+
+// GreylistWhitelistAdd whitelists an IP, a network or a domain
+func GreylistWhitelistAdd(entry string) error {
+	return core.GreylistWhitelistAdd(entry)
+}
+
+// GreylistWhitelistGetAll returns the greylisting whitelist
+func GreylistWhitelistGetAll() ([]core.GreylistWhitelist, error) {
+	return core.GreylistWhitelistGetAll()
+}
+
+// GreylistWhitelistDel removes an entry of the greylisting whitelist
+func GreylistWhitelistDel(entry string) error {
+	return core.GreylistWhitelistDel(entry)
+}
+
+// DMARCGetPendingReports returns DMARC aggregate reports not sent yet
+func DMARCGetPendingReports() ([]core.DMARCPendingReport, error) {
+	return core.DMARCGetPendingReports()
+}
+
+// DMARCGetReport returns the XML DMARC aggregate report of domain for day
+func DMARCGetReport(day, domain string) ([]byte, error) {
+	return core.DMARCGetReport(day, domain)
+}
+
 // RCPTHOSTS ie locals domains
 
 // RcptHostAdd add a rcpthost
@@ -9,6 +9,10 @@ var CliCommands = []cgCli.Command{
 	alias,
 	Queue,
 	Routes,
+	Policy,
+	RemoteHosts,
+	Greylist,
+	Dmarc,
 	user,
 	Rcpthost,
 	RelayIP,
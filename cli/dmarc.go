@@ -0,0 +1,51 @@
+package cli
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/stunndard/cocosmail/api"
+	cgCli "github.com/urfave/cli"
+)
+
+// Dmarc represents commands for dealing with DMARC aggregate reports
+var Dmarc = cgCli.Command{
+	Name:  "dmarc",
+	Usage: "commands to preview DMARC aggregate reports",
+	Subcommands: []cgCli.Command{
+		// List pending reports
+		{
+			Name:        "reports",
+			Usage:       "List DMARC aggregate reports not sent yet (today's report is sent tomorrow)",
+			Description: "cocosmail dmarc reports",
+			Action: func(c *cgCli.Context) {
+				reports, err := api.DMARCGetPendingReports()
+				cliHandleErr(err)
+				if len(reports) == 0 {
+					println("There is no pending DMARC report.")
+				} else {
+					for _, r := range reports {
+						fmt.Printf("%s %s - %d message(s) - %d record(s) - rua: %s\n", r.Day, r.Domain, r.Messages, r.Records, strings.Join(r.Rua, ", "))
+					}
+				}
+				os.Exit(0)
+			},
+		},
+		// Print a report
+		{
+			Name:        "report",
+			Usage:       "Print the XML DMARC aggregate report of DOMAIN for DAY (YYYY-MM-DD, UTC)",
+			Description: "cocosmail dmarc report DAY DOMAIN",
+			Action: func(c *cgCli.Context) {
+				if len(c.Args()) != 2 {
+					cliDieBadArgs(c, "you must provide a day and a domain")
+				}
+				report, err := api.DMARCGetReport(c.Args()[0], c.Args()[1])
+				cliHandleErr(err)
+				fmt.Print(string(report))
+				os.Exit(0)
+			},
+		},
+	},
+}
@@ -0,0 +1,88 @@
+package cli
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/stunndard/cocosmail/api"
+	cgCli "github.com/urfave/cli"
+)
+
+// Greylist represents commands for dealing with greylisting
+var Greylist = cgCli.Command{
+	Name:  "greylist",
+	Usage: "commands to manage greylisting of incoming mails",
+	Subcommands: []cgCli.Command{
+		// List greylisted triplets
+		{
+			Name:        "list",
+			Usage:       "List greylisted triplets (from the REST server if cocosmail is running)",
+			Description: "cocosmail greylist list",
+			Action: func(c *cgCli.Context) {
+				entries, err := api.GreylistGetAll()
+				cliHandleErr(err)
+				if len(entries) == 0 {
+					println("There is no greylisted triplet.")
+				} else {
+					for _, e := range entries {
+						state := "greylisted"
+						if e.Passed() {
+							state = "passed " + e.PassedAt.Format(time.RFC3339)
+						}
+						fmt.Printf("%s <%s> -> <%s> - %s - first seen: %s - last seen: %s - refused attempts: %d\n", e.Network, e.MailFrom, e.RcptTo, state, e.FirstSeen.Format(time.RFC3339), e.LastSeen.Format(time.RFC3339), e.Attempts)
+					}
+				}
+				os.Exit(0)
+			},
+		},
+		// Whitelist
+		{
+			Name:  "whitelist",
+			Usage: "commands to manage IPs, networks and domains which are not greylisted",
+			Subcommands: []cgCli.Command{
+				{
+					Name:        "add",
+					Usage:       "Whitelist an IP, a network (CIDR) or a domain (recipient or verified client host name, subdomains included)",
+					Description: "cocosmail greylist whitelist add IP|CIDR|DOMAIN",
+					Action: func(c *cgCli.Context) {
+						if len(c.Args()) != 1 {
+							cliDieBadArgs(c, "you must provide an IP, a network or a domain")
+						}
+						cliHandleErr(api.GreylistWhitelistAdd(c.Args().First()))
+						cliDieOk()
+					},
+				},
+				{
+					Name:        "list",
+					Usage:       "List whitelisted IPs, networks and domains",
+					Description: "cocosmail greylist whitelist list",
+					Action: func(c *cgCli.Context) {
+						entries, err := api.GreylistWhitelistGetAll()
+						cliHandleErr(err)
+						if len(entries) == 0 {
+							println("There is no whitelisted IP, network or domain.")
+						} else {
+							for _, e := range entries {
+								fmt.Println(e.Entry)
+							}
+						}
+						os.Exit(0)
+					},
+				},
+				{
+					Name:        "del",
+					Usage:       "Remove an IP, a network or a domain from whitelist",
+					Description: "cocosmail greylist whitelist del IP|CIDR|DOMAIN",
+					Action: func(c *cgCli.Context) {
+						if len(c.Args()) != 1 {
+							cliDieBadArgs(c, "you must provide an IP, a network or a domain")
+						}
+						cliHandleErr(api.GreylistWhitelistDel(c.Args().First()))
+						cliDieOk()
+					},
+				},
+			},
+		},
+	},
+}
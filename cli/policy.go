@@ -0,0 +1,88 @@
+package cli
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/stunndard/cocosmail/api"
+	cgCli "github.com/urfave/cli"
+)
+
+// Policy represents commands for dealing with remote delivery policies
+var Policy = cgCli.Command{
+	Name:  "policy",
+	Usage: "commands to manage remote delivery policies (concurrency and rate limits)",
+	Subcommands: []cgCli.Command{
+		// List policies
+		{
+			Name:        "list",
+			Usage:       "List delivery policies",
+			Description: "cocosmail policy list",
+			Action: func(c *cgCli.Context) {
+				policies, err := api.DeliveryPolicyGetAll()
+				cliHandleErr(err)
+				if len(policies) == 0 {
+					println("There is no delivery policy.")
+				} else {
+					for _, p := range policies {
+						line := fmt.Sprintf("%d %s - max connections: %d - max messages per minute: %d - backoff after 421: %ds", p.Id, p.Pattern, p.MaxConns, p.MaxMsgsPerMinute, p.Backoff421)
+						if p.RequireDANE {
+							line += " - DANE required"
+						}
+						fmt.Println(line)
+					}
+				}
+				os.Exit(0)
+			},
+		},
+		// Add policy
+		{
+			Name:        "add",
+			Usage:       "Add a delivery policy",
+			Description: "cocosmail policy add [-c MAX_CONNECTIONS] [-m MAX_MSGS_PER_MINUTE] [-b BACKOFF_AFTER_421] [--dane] PATTERN\n\nPATTERN is a recipient domain or a MX hostname, * is allowed (eg *.google.com). 0 means unlimited.",
+			Flags: []cgCli.Flag{
+				cgCli.IntFlag{
+					Name:  "maxConns, c",
+					Value: 0,
+					Usage: "max concurrent connections",
+				},
+				cgCli.IntFlag{
+					Name:  "maxMsgsPerMinute, m",
+					Value: 0,
+					Usage: "max messages per minute",
+				},
+				cgCli.IntFlag{
+					Name:  "backoff421, b",
+					Value: 0,
+					Usage: "seconds without delivery after a 421 reply",
+				},
+				cgCli.BoolFlag{
+					Name:  "dane",
+					Usage: "require DANE: defer delivery if remote hosts have no DNSSEC signed TLSA records",
+				},
+			},
+			Action: func(c *cgCli.Context) {
+				if len(c.Args()) != 1 {
+					cliDieBadArgs(c, "you must provide a pattern")
+				}
+				err := api.DeliveryPolicyAdd(c.Args().First(), c.Int("c"), c.Int("m"), c.Int("b"), c.Bool("dane"))
+				cliHandleErr(err)
+				cliDieOk()
+			},
+		},
+		// Delete policy
+		{
+			Name:        "del",
+			Usage:       "Delete a delivery policy",
+			Description: "cocosmail policy del PATTERN",
+			Action: func(c *cgCli.Context) {
+				if len(c.Args()) != 1 {
+					cliDieBadArgs(c, "you must provide a pattern")
+				}
+				err := api.DeliveryPolicyDel(c.Args().First())
+				cliHandleErr(err)
+				cliDieOk()
+			},
+		},
+	},
+}
@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"os"
 	"strconv"
+	"time"
 
 	"github.com/stunndard/cocosmail/api"
 	cgCli "github.com/urfave/cli"
@@ -40,7 +41,10 @@ var Queue = cgCli.Command{
 
 						msg := fmt.Sprintf("%d - From: %s - To: %s - Status: %s - Added: %v ", m.Id, m.MailFrom, m.RcptTo, status, m.AddedAt)
 						if m.Status != 0 {
-							msg += fmt.Sprintf("- Next delivery process scheduled at: %v", m.NextDeliveryScheduledAt)
+							msg += fmt.Sprintf("- Failed attempts: %d - Next delivery process scheduled at: %v", m.DeliveryFailedCount, m.NextDeliveryScheduledAt)
+							if d := time.Until(m.NextDeliveryScheduledAt); d > 0 {
+								msg += fmt.Sprintf(" (in %v)", d.Round(time.Second))
+							}
 						}
 						println(msg)
 					}
@@ -0,0 +1,59 @@
+package cli
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/stunndard/cocosmail/api"
+	cgCli "github.com/urfave/cli"
+)
+
+// RemoteHosts represents commands for dealing with unreachable remote hosts
+var RemoteHosts = cgCli.Command{
+	Name:  "remotehosts",
+	Usage: "commands to manage unreachable remote hosts (circuit breaker)",
+	Subcommands: []cgCli.Command{
+		// List remote hosts
+		{
+			Name:        "list",
+			Usage:       "List remote hosts with connection failures",
+			Description: "cocosmail remotehosts list",
+			Action: func(c *cgCli.Context) {
+				hosts, err := api.RemoteHostGetAll()
+				cliHandleErr(err)
+				if len(hosts) == 0 {
+					println("There is no remote host with connection failures.")
+				} else {
+					for _, h := range hosts {
+						line := fmt.Sprintf("%s (%s) - %s - consecutive failures: %d - last failure: %s %s - %s", h.IP, h.Host, h.State(), h.ConsecutiveFailures, h.LastFailureType, h.LastFailureAt.Format(time.RFC3339), h.LastError)
+						if h.OpenUntil.After(time.Now()) {
+							line += " - not tried until " + h.OpenUntil.Format(time.RFC3339)
+						}
+						fmt.Println(line)
+					}
+				}
+				os.Exit(0)
+			},
+		},
+		// Reset remote hosts
+		{
+			Name:        "reset",
+			Usage:       "Reset connection failures of a remote host, or of all hosts",
+			Description: "cocosmail remotehosts reset IP|all",
+			Action: func(c *cgCli.Context) {
+				if len(c.Args()) != 1 {
+					cliDieBadArgs(c, "you must provide an IP or all")
+				}
+				var err error
+				if c.Args().First() == "all" {
+					err = api.RemoteHostResetAll()
+				} else {
+					err = api.RemoteHostReset(c.Args().First())
+				}
+				cliHandleErr(err)
+				cliDieOk()
+			},
+		},
+	},
+}
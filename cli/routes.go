@@ -71,6 +71,17 @@ var Routes = cgCli.Command{
 							line += ":25"
 						}
 
+						// TLS
+						if route.TlsPolicy.Valid && route.TlsPolicy.String != "" {
+							line += " - TLS: " + route.TlsPolicy.String
+						}
+						if route.TlsClientCert.Valid && route.TlsClientCert.String != "" {
+							line += " - client certificate: " + route.TlsClientCert.String
+						}
+						if route.TlsCaBundle.Valid && route.TlsCaBundle.String != "" {
+							line += " - CA bundle: " + route.TlsCaBundle.String
+						}
+
 						println(line)
 					}
 				}
@@ -80,7 +91,7 @@ var Routes = cgCli.Command{
 		{
 			Name:        "add",
 			Usage:       "Add a route",
-			Description: "cocosmail routes add -d DESTINATION_HOST -rh REMOTE_HOST [-rp REMOTE_PORT] [-p PRORITY] [-l LOCAL_IP] [-u AUTHENTIFIED_USER] [-f MAIL_FROM] [-rl REMOTE_LOGIN] [-rpwd REMOTE_PASSWD]",
+			Description: "cocosmail routes add -d DESTINATION_HOST -rh REMOTE_HOST [-rp REMOTE_PORT] [-p PRORITY] [-l LOCAL_IP] [-u AUTHENTIFIED_USER] [-f MAIL_FROM] [-rl REMOTE_LOGIN] [-rpwd REMOTE_PASSWD] [-tls TLS_POLICY] [-tlscert CLIENT_CERT -tlskey CLIENT_KEY] [-tlsca CA_BUNDLE]",
 			Flags: []cgCli.Flag{
 				cgCli.StringFlag{
 					Name:  "destination, d",
@@ -127,6 +138,26 @@ var Routes = cgCli.Command{
 					Value: "",
 					Usage: "SMTPauth passwd for remote host",
 				},
+				cgCli.StringFlag{
+					Name:  "tlsPolicy, tls",
+					Value: "",
+					Usage: "TLS policy: none, opportunistic (default), require, require-verified or implicit (SMTPS, eg port 465)",
+				},
+				cgCli.StringFlag{
+					Name:  "tlsClientCert, tlscert",
+					Value: "",
+					Usage: "TLS client certificate (PEM file)",
+				},
+				cgCli.StringFlag{
+					Name:  "tlsClientKey, tlskey",
+					Value: "",
+					Usage: "key of the TLS client certificate (PEM file)",
+				},
+				cgCli.StringFlag{
+					Name:  "tlsCaBundle, tlsca",
+					Value: "",
+					Usage: "CA bundle (PEM file) used to verify the remote host certificate instead of system roots, the certificate is then always verified",
+				},
 			},
 			Action: func(c *cgCli.Context) {
 				// si la destination n'est pas renseignée on wildcard
@@ -135,7 +166,7 @@ var Routes = cgCli.Command{
 					host = "*"
 				}
 				// (host, localIp, remoteHost string, remotePort, priority int64, user, mailFrom, smtpAuthLogin, smtpAuthPasswd string)
-				err := api.RoutesAdd(host, c.String("l"), c.String("rh"), c.Int("rp"), c.Int("p"), c.String("u"), c.String("f"), c.String("rl"), c.String("rpwd"))
+				err := api.RoutesAdd(host, c.String("l"), c.String("rh"), c.Int("rp"), c.Int("p"), c.String("u"), c.String("f"), c.String("rl"), c.String("rpwd"), c.String("tls"), c.String("tlscert"), c.String("tlskey"), c.String("tlsca"))
 				cliHandleErr(err)
 			},
 		},
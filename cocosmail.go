@@ -141,7 +141,7 @@ func main() {
 			// maximum requeuing timeout for a message
 			// si le client ne demande pas de requeue dans ce delais alors
 			// le message et considéré comme traité
-			opts.MaxReqTimeout = 1 * time.Hour
+			opts.MaxReqTimeout = core.NSQMaxReqTimeout
 
 			// Number of message in RAM before synching to disk
 			opts.MemQueueSize = 0
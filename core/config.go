@@ -6,6 +6,7 @@ import (
 	"os"
 	"path/filepath"
 	"reflect"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
@@ -28,6 +29,12 @@ type Config struct {
 		DebugEnabled        bool   `name:"debug_enabled" default:"false"`
 		HideServerSignature bool   `name:"hide_server_signature" default:"false"`
 
+		// DNS resolver
+		DNSServers     string `name:"dns_servers" default:"_"`
+		DNSTimeout     int    `name:"dns_timeout" default:"10"`
+		DNSCacheMaxTTL int    `name:"dns_cache_max_ttl" default:"3600"`
+		DNSZoneFile    string `name:"dns_zone_file" default:"_"`
+
 		DbDriver string `name:"db_driver"`
 		DbSource string `name:"db_source"`
 
@@ -53,17 +60,52 @@ type Config struct {
 		SmtpdHideReceivedFromAuth bool   `name:"smtpd_hide_received_from_auth" default:"true"`
 		SmtpdSPFCheck							bool	 `name:"smtpd_spf_check" default:"true"`
 		SmtpdSPFAction						string `name:"smtpd_spf_action" default:"accept:accept:accept:accept:accept:accept"`
+		SmtpdPipelining           bool   `name:"smtpd_pipelining" default:"true"`
+		SmtpdChunking             bool   `name:"smtpd_chunking" default:"true"`
+		SmtpdGreylistEnabled      bool   `name:"smtpd_greylist_enabled" default:"false"`
+		SmtpdGreylistDelay        int    `name:"smtpd_greylist_delay" default:"300"`
+		SmtpdGreylistRetryWindow  int    `name:"smtpd_greylist_retry_window" default:"24"`
+		SmtpdGreylistExpire       int    `name:"smtpd_greylist_expire" default:"36"`
+		SmtpdDNSBLZones           string `name:"smtpd_dnsbl_zones" default:"_"`
+		SmtpdRHSBLZones           string `name:"smtpd_rhsbl_zones" default:"_"`
+		SmtpdDNSBLThreshold       int    `name:"smtpd_dnsbl_threshold" default:"0"`
+		SmtpdDNSBLTimeout         int    `name:"smtpd_dnsbl_timeout" default:"5"`
+		SmtpdDkimVerify           bool   `name:"smtpd_dkim_verify" default:"true"`
+		SmtpdDMARCCheck           bool   `name:"smtpd_dmarc_check" default:"false"`
+		SmtpdDMARCActions         string `name:"smtpd_dmarc_actions" default:"reject:quarantine"`
+		SmtpdDMARCPSLFile         string `name:"smtpd_dmarc_psl_file" default:"_"`
+		SmtpdDMARCReports         bool   `name:"smtpd_dmarc_reports" default:"false"`
 
 		LaunchDeliverd               bool   `name:"deliverd_launch" default:"false"`
 		LocalIps                     string `name:"deliverd_local_ips" default:"_"`
+		LocalIps6                    string `name:"deliverd_local_ips6" default:"_"`
 		DeliverdConcurrencyLocal     int    `name:"deliverd_concurrency_local" default:"50"`
 		DeliverdConcurrencyRemote    int    `name:"deliverd_concurrency_remote" default:"50"`
 		DeliverdQueueLifetime        int    `name:"deliverd_queue_lifetime" default:"10080"`
 		DeliverdQueueBouncesLifetime int    `name:"deliverd_queue_bounces_lifetime" default:"10080"`
+		DeliverdQueueDelayWarnings   string `name:"deliverd_queue_delay_warnings" default:"240;1440"`
+		DeliverdRetryBaseInterval    int    `name:"deliverd_retry_base_interval" default:"60"`
+		DeliverdRetryBackoff         string `name:"deliverd_retry_backoff" default:"2"`
+		DeliverdRetryJitter          int    `name:"deliverd_retry_jitter" default:"20"`
+		DeliverdRetryMaxInterval     int    `name:"deliverd_retry_max_interval" default:"3600"`
+		DeliverdRetryOverrides       string `name:"deliverd_retry_overrides" default:"_"`
+		DeliverdBounceAggregationWindow int `name:"deliverd_bounce_aggregation_window" default:"300"`
 		DeliverdRemoteTimeout        int    `name:"deliverd_remote_timeout" default:"300"`
 		DeliverdRemoteTLSSkipVerify  bool   `name:"deliverd_remote_tls_skipverify" default:"false"`
 		DeliverdRemoteTLSFallback    bool   `name:"deliverd_remote_tls_fallback" default:"false"`
+		DeliverdRemoteMTASTS         bool   `name:"deliverd_remote_mta_sts" default:"true"`
+		DeliverdRemoteDANE           bool   `name:"deliverd_remote_dane" default:"false"`
+		DeliverdRemoteDANEResolver   string `name:"deliverd_remote_dane_resolver" default:"127.0.0.1:53"`
+		DeliverdTLSRpt               bool   `name:"deliverd_tls_rpt" default:"false"`
+		DeliverdBreakerThreshold     int    `name:"deliverd_breaker_threshold" default:"3"`
+		DeliverdBreakerCoolDown      int    `name:"deliverd_breaker_cooldown" default:"60"`
+		DeliverdBreakerMaxCoolDown   int    `name:"deliverd_breaker_max_cooldown" default:"3600"`
+		ReportsFrom                  string `name:"reports_from" default:"_"`
 		DeliverdRemoteUseSameHost    bool   `name:"deliverd_remote_use_same_host" default:"true"`
+		DeliverdRemoteMaxRcptTo      int    `name:"deliverd_remote_max_rcpt" default:"50"`
+		DeliverdRemotePoolIdleTimeout   int `name:"deliverd_remote_pool_idle_timeout" default:"30"`
+		DeliverdRemotePoolMaxPerHost    int `name:"deliverd_remote_pool_max_per_host" default:"5"`
+		DeliverdRemotePoolMaxPerLocalIp int `name:"deliverd_remote_pool_max_per_local_ip" default:"100"`
 		DeliverdDkimSign             bool   `name:"deliverd_dkim_sign" default:"false"`
 
 		// RFC compliance
@@ -262,6 +304,42 @@ func (c *Config) GetHideServerSignature() bool {
 	return c.cfg.HideServerSignature
 }
 
+// GetDNSServers returns the DNS servers to query (comma separated), empty
+// for the system resolver
+func (c *Config) GetDNSServers() string {
+	c.Lock()
+	defer c.Unlock()
+	if c.cfg.DNSServers == "_" {
+		return ""
+	}
+	return c.cfg.DNSServers
+}
+
+// GetDNSTimeout returns the timeout of DNS queries in seconds
+func (c *Config) GetDNSTimeout() int {
+	c.Lock()
+	defer c.Unlock()
+	return c.cfg.DNSTimeout
+}
+
+// GetDNSCacheMaxTTL returns the max time DNS answers are cached in seconds
+func (c *Config) GetDNSCacheMaxTTL() int {
+	c.Lock()
+	defer c.Unlock()
+	return c.cfg.DNSCacheMaxTTL
+}
+
+// GetDNSZoneFile returns the path of the static zone file overriding DNS,
+// empty if there is none
+func (c *Config) GetDNSZoneFile() string {
+	c.Lock()
+	defer c.Unlock()
+	if c.cfg.DNSZoneFile == "_" {
+		return ""
+	}
+	return c.cfg.DNSZoneFile
+}
+
 // GetTempDir return temp directory
 func (c *Config) GetTempDir() string {
 	c.Lock()
@@ -405,6 +483,130 @@ func (c *Config) GetSmtpdSPFAction() string {
 	return c.cfg.SmtpdSPFAction
 }
 
+// GetSmtpdPipelining returns if PIPELINING extension is enabled
+func (c *Config) GetSmtpdPipelining() bool {
+	c.Lock()
+	defer c.Unlock()
+	return c.cfg.SmtpdPipelining
+}
+
+// GetSmtpdChunking returns if CHUNKING extension (BDAT) is enabled
+func (c *Config) GetSmtpdChunking() bool {
+	c.Lock()
+	defer c.Unlock()
+	return c.cfg.SmtpdChunking
+}
+
+// GetSmtpdGreylistEnabled returns true if greylisting is enabled
+func (c *Config) GetSmtpdGreylistEnabled() bool {
+	c.Lock()
+	defer c.Unlock()
+	return c.cfg.SmtpdGreylistEnabled
+}
+
+// GetSmtpdGreylistDelay returns the delay in seconds before a greylisted
+// triplet is accepted
+func (c *Config) GetSmtpdGreylistDelay() int {
+	c.Lock()
+	defer c.Unlock()
+	return c.cfg.SmtpdGreylistDelay
+}
+
+// GetSmtpdGreylistRetryWindow returns the time in hours a greylisted
+// triplet is kept waiting for a retry
+func (c *Config) GetSmtpdGreylistRetryWindow() int {
+	c.Lock()
+	defer c.Unlock()
+	return c.cfg.SmtpdGreylistRetryWindow
+}
+
+// GetSmtpdGreylistExpire returns the time in days a triplet which passed
+// greylisting is kept after it was last seen
+func (c *Config) GetSmtpdGreylistExpire() int {
+	c.Lock()
+	defer c.Unlock()
+	return c.cfg.SmtpdGreylistExpire
+}
+
+// GetSmtpdDNSBLZones returns the DNSBL zones of client IPs
+func (c *Config) GetSmtpdDNSBLZones() string {
+	c.Lock()
+	defer c.Unlock()
+	if c.cfg.SmtpdDNSBLZones == "_" {
+		return ""
+	}
+	return c.cfg.SmtpdDNSBLZones
+}
+
+// GetSmtpdRHSBLZones returns the RHSBL zones of sender domains
+func (c *Config) GetSmtpdRHSBLZones() string {
+	c.Lock()
+	defer c.Unlock()
+	if c.cfg.SmtpdRHSBLZones == "_" {
+		return ""
+	}
+	return c.cfg.SmtpdRHSBLZones
+}
+
+// GetSmtpdDNSBLThreshold returns the DNSBL score from which senders are
+// rejected, 0 if never
+func (c *Config) GetSmtpdDNSBLThreshold() int {
+	c.Lock()
+	defer c.Unlock()
+	return c.cfg.SmtpdDNSBLThreshold
+}
+
+// GetSmtpdDNSBLTimeout returns the timeout in seconds of the lookups of a
+// client IP or a sender domain in DNSBL and RHSBL zones
+func (c *Config) GetSmtpdDNSBLTimeout() int {
+	c.Lock()
+	defer c.Unlock()
+	return c.cfg.SmtpdDNSBLTimeout
+}
+
+// GetSmtpdDkimVerify returns true if DKIM signatures of incoming mails are
+// verified
+func (c *Config) GetSmtpdDkimVerify() bool {
+	c.Lock()
+	defer c.Unlock()
+	return c.cfg.SmtpdDkimVerify
+}
+
+// GetSmtpdDMARCCheck returns true if DMARC policies of incoming mails are
+// evaluated
+func (c *Config) GetSmtpdDMARCCheck() bool {
+	c.Lock()
+	defer c.Unlock()
+	return c.cfg.SmtpdDMARCCheck
+}
+
+// GetSmtpdDMARCActions returns the actions for DMARC policies reject and
+// quarantine: action:action
+func (c *Config) GetSmtpdDMARCActions() string {
+	c.Lock()
+	defer c.Unlock()
+	return c.cfg.SmtpdDMARCActions
+}
+
+// GetSmtpdDMARCPSLFile returns the path of the public suffix list used
+// to find organizational domains, empty for the bundled list
+func (c *Config) GetSmtpdDMARCPSLFile() string {
+	c.Lock()
+	defer c.Unlock()
+	if c.cfg.SmtpdDMARCPSLFile == "_" {
+		return ""
+	}
+	return c.cfg.SmtpdDMARCPSLFile
+}
+
+// GetSmtpdDMARCReports returns true if DMARC aggregate reports (RFC 7489)
+// are sent to the author domains of incoming mails
+func (c *Config) GetSmtpdDMARCReports() bool {
+	c.Lock()
+	defer c.Unlock()
+	return c.cfg.SmtpdDMARCReports
+}
+
 // GetLaunchDeliverd returns true if deliverd have to be launched
 func (c *Config) GetLaunchDeliverd() bool {
 	c.Lock()
@@ -641,6 +843,17 @@ func (c *Config) GetLocalIps() string {
 		return lIps, nil*/
 }
 
+// GetLocalIps6 returns the local IPv6 pool used when sending mail, in
+// addition to deliverd_local_ips
+func (c *Config) GetLocalIps6() string {
+	c.Lock()
+	defer c.Unlock()
+	if c.cfg.LocalIps6 == "_" {
+		return ""
+	}
+	return c.cfg.LocalIps6
+}
+
 // GetDeliverdRemoteTimeout return remote timeout in second
 // time to wait for a response from remote server before closing conn
 func (c *Config) GetDeliverdRemoteTimeout() int {
@@ -663,6 +876,77 @@ func (c *Config) GetDeliverdQueueBouncesLifetime() int {
 	return c.cfg.DeliverdQueueBouncesLifetime
 }
 
+// GetDeliverdRetryBaseInterval returns the delay in seconds before the
+// first retry of a deferred delivery
+func (c *Config) GetDeliverdRetryBaseInterval() int {
+	c.Lock()
+	defer c.Unlock()
+	return c.cfg.DeliverdRetryBaseInterval
+}
+
+// GetDeliverdRetryBackoff returns the exponential base of the retry
+// intervals
+func (c *Config) GetDeliverdRetryBackoff() float64 {
+	c.Lock()
+	defer c.Unlock()
+	backoff, err := strconv.ParseFloat(c.cfg.DeliverdRetryBackoff, 64)
+	if err != nil || backoff < 1 {
+		return 2
+	}
+	return backoff
+}
+
+// GetDeliverdRetryJitter returns the random variation of retry intervals
+// in percent
+func (c *Config) GetDeliverdRetryJitter() int {
+	c.Lock()
+	defer c.Unlock()
+	return c.cfg.DeliverdRetryJitter
+}
+
+// GetDeliverdRetryMaxInterval returns the max interval in seconds between
+// two delivery attempts
+func (c *Config) GetDeliverdRetryMaxInterval() int {
+	c.Lock()
+	defer c.Unlock()
+	return c.cfg.DeliverdRetryMaxInterval
+}
+
+// GetDeliverdRetryOverrides returns the retry policy overrides by domain
+// or reply class
+func (c *Config) GetDeliverdRetryOverrides() string {
+	c.Lock()
+	defer c.Unlock()
+	return c.cfg.DeliverdRetryOverrides
+}
+
+// GetDeliverdQueueDelayWarnings returns the delays in minutes after which
+// a delayed delivery warning is sent to the sender
+func (c *Config) GetDeliverdQueueDelayWarnings() (delays []int) {
+	c.Lock()
+	defer c.Unlock()
+	if c.cfg.DeliverdQueueDelayWarnings == "_" {
+		return
+	}
+	for _, d := range strings.Split(c.cfg.DeliverdQueueDelayWarnings, ";") {
+		delay, err := strconv.Atoi(strings.TrimSpace(d))
+		if err != nil || delay <= 0 {
+			continue
+		}
+		delays = append(delays, delay)
+	}
+	sort.Ints(delays)
+	return
+}
+
+// GetDeliverdBounceAggregationWindow returns the time in seconds during which
+// failed recipients of a message are aggregated in a single bounce
+func (c *Config) GetDeliverdBounceAggregationWindow() int {
+	c.Lock()
+	defer c.Unlock()
+	return c.cfg.DeliverdBounceAggregationWindow
+}
+
 // GetDeliverdRemoteTLSFallback return DeliverdRemoteTLSFallback
 func (c *Config) GetDeliverdRemoteTLSFallback() bool {
 	c.Lock()
@@ -670,6 +954,75 @@ func (c *Config) GetDeliverdRemoteTLSFallback() bool {
 	return c.cfg.DeliverdRemoteTLSFallback
 }
 
+// GetDeliverdRemoteMTASTS returns true if MTA-STS policies of recipient
+// domains are enforced
+func (c *Config) GetDeliverdRemoteMTASTS() bool {
+	c.Lock()
+	defer c.Unlock()
+	return c.cfg.DeliverdRemoteMTASTS
+}
+
+// GetDeliverdRemoteDANE returns true if TLSA records of remote hosts are
+// used to verify their certificate
+func (c *Config) GetDeliverdRemoteDANE() bool {
+	c.Lock()
+	defer c.Unlock()
+	return c.cfg.DeliverdRemoteDANE
+}
+
+// GetDeliverdRemoteDANEResolver returns the DNSSEC validating resolver used
+// for TLSA lookups
+func (c *Config) GetDeliverdRemoteDANEResolver() string {
+	c.Lock()
+	defer c.Unlock()
+	return c.cfg.DeliverdRemoteDANEResolver
+}
+
+// GetDeliverdTLSRpt returns true if TLS reports (RFC 8460) are sent to
+// recipient domains
+func (c *Config) GetDeliverdTLSRpt() bool {
+	c.Lock()
+	defer c.Unlock()
+	return c.cfg.DeliverdTLSRpt
+}
+
+// GetDeliverdBreakerThreshold returns the number of consecutive failures
+// after which a remote host is not tried during a cool-down
+func (c *Config) GetDeliverdBreakerThreshold() int {
+	c.Lock()
+	defer c.Unlock()
+	if c.cfg.DeliverdBreakerThreshold < 1 {
+		return 1
+	}
+	return c.cfg.DeliverdBreakerThreshold
+}
+
+// GetDeliverdBreakerCoolDown returns the first cool-down of an unreachable
+// remote host in seconds
+func (c *Config) GetDeliverdBreakerCoolDown() int {
+	c.Lock()
+	defer c.Unlock()
+	return c.cfg.DeliverdBreakerCoolDown
+}
+
+// GetDeliverdBreakerMaxCoolDown returns the max cool-down of an unreachable
+// remote host in seconds
+func (c *Config) GetDeliverdBreakerMaxCoolDown() int {
+	c.Lock()
+	defer c.Unlock()
+	return c.cfg.DeliverdBreakerMaxCoolDown
+}
+
+// GetReportsFrom returns the sender address of aggregate reports
+func (c *Config) GetReportsFrom() string {
+	c.Lock()
+	defer c.Unlock()
+	if c.cfg.ReportsFrom == "_" {
+		return ""
+	}
+	return c.cfg.ReportsFrom
+}
+
 // GetDeliverdRemoteUseSameHost return DeliverdRemoteUseSameHost
 func (c *Config) GetDeliverdRemoteUseSameHost() bool {
 	c.Lock()
@@ -677,6 +1030,40 @@ func (c *Config) GetDeliverdRemoteUseSameHost() bool {
 	return c.cfg.DeliverdRemoteUseSameHost
 }
 
+// GetDeliverdRemoteMaxRcptTo returns the max number of recipients of the
+// same message delivered in a single SMTP transaction
+func (c *Config) GetDeliverdRemoteMaxRcptTo() int {
+	c.Lock()
+	defer c.Unlock()
+	return c.cfg.DeliverdRemoteMaxRcptTo
+}
+
+// GetDeliverdRemotePoolIdleTimeout returns the time in seconds an idle
+// remote SMTP connection is kept for reuse (0: no pooling)
+func (c *Config) GetDeliverdRemotePoolIdleTimeout() int {
+	c.Lock()
+	defer c.Unlock()
+	return c.cfg.DeliverdRemotePoolIdleTimeout
+}
+
+// GetDeliverdRemotePoolMaxPerHost returns the max number of open
+// connections (busy or idle) to a remote host above which a connection
+// is not kept idle (0: no limit)
+func (c *Config) GetDeliverdRemotePoolMaxPerHost() int {
+	c.Lock()
+	defer c.Unlock()
+	return c.cfg.DeliverdRemotePoolMaxPerHost
+}
+
+// GetDeliverdRemotePoolMaxPerLocalIp returns the max number of open
+// connections (busy or idle) from a local IP above which a connection is
+// not kept idle (0: no limit)
+func (c *Config) GetDeliverdRemotePoolMaxPerLocalIp() int {
+	c.Lock()
+	defer c.Unlock()
+	return c.cfg.DeliverdRemotePoolMaxPerLocalIp
+}
+
 // GetDeliverdRemoteTLSSkipVerify return DeliverdRemoteTLSSkipVerify
 func (c *Config) GetDeliverdRemoteTLSSkipVerify() bool {
 	c.Lock()
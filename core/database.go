@@ -28,12 +28,30 @@ func IsOkDB(DB *gorm.DB) bool {
 	if !DB.HasTable(&QMessage{}) {
 		return false
 	}
+	if !DB.HasTable(&QBounce{}) {
+		return false
+	}
 	if !DB.HasTable(&Route{}) {
 		return false
 	}
+	if !DB.HasTable(&DeliveryPolicy{}) {
+		return false
+	}
+	if !DB.HasTable(&TLSRptResult{}) {
+		return false
+	}
+	if !DB.HasTable(&RemoteHost{}) {
+		return false
+	}
+	if !DB.HasTable(&GreylistWhitelist{}) {
+		return false
+	}
 	if !DB.HasTable(&DkimConfig{}) {
 		return false
 	}
+	if !DB.HasTable(&DMARCResult{}) {
+		return false
+	}
 	return true
 }
 
@@ -92,6 +110,16 @@ func InitDB(DB *gorm.DB) error {
 			return errors.New("Unable to create table queued_messages - " + err.Error())
 		}
 	}
+	// pending bounces
+	if !DB.HasTable(&QBounce{}) {
+		if err = DB.CreateTable(&QBounce{}).Error; err != nil {
+			return errors.New("Unable to create table q_bounces - " + err.Error())
+		}
+		// Index
+		if err = DB.Model(&QBounce{}).AddIndex("idx_q_bounces_uuid", "uuid").Error; err != nil {
+			return errors.New("Unable to add index idx_q_bounces_uuid on table q_bounces - " + err.Error())
+		}
+	}
 	// deliverd.route
 	if !DB.HasTable(&Route{}) {
 		if err = DB.CreateTable(&Route{}).Error; err != nil {
@@ -102,6 +130,34 @@ func InitDB(DB *gorm.DB) error {
 			return errors.New("Unable to add index idx_route_host on table route - " + err.Error())
 		}
 	}
+	// deliverd.delivery_policy
+	if !DB.HasTable(&DeliveryPolicy{}) {
+		if err = DB.CreateTable(&DeliveryPolicy{}).Error; err != nil {
+			return errors.New("Unable to create table delivery_policies - " + err.Error())
+		}
+	}
+	// TLS reports
+	if !DB.HasTable(&TLSRptResult{}) {
+		if err = DB.CreateTable(&TLSRptResult{}).Error; err != nil {
+			return errors.New("Unable to create table tls_rpt_results - " + err.Error())
+		}
+		// Index
+		if err = DB.Model(&TLSRptResult{}).AddIndex("idx_tls_rpt_results_day_domain", "day", "domain").Error; err != nil {
+			return errors.New("Unable to add index idx_tls_rpt_results_day_domain on table tls_rpt_results - " + err.Error())
+		}
+	}
+	// Remote hosts health
+	if !DB.HasTable(&RemoteHost{}) {
+		if err = DB.CreateTable(&RemoteHost{}).Error; err != nil {
+			return errors.New("Unable to create table remote_hosts - " + err.Error())
+		}
+	}
+	// Greylisting whitelist
+	if !DB.HasTable(&GreylistWhitelist{}) {
+		if err = DB.CreateTable(&GreylistWhitelist{}).Error; err != nil {
+			return errors.New("Unable to create table greylist_whitelists - " + err.Error())
+		}
+	}
 
 	if !DB.HasTable(&DkimConfig{}) {
 		if err = DB.CreateTable(&DkimConfig{}).Error; err != nil {
@@ -112,6 +168,16 @@ func InitDB(DB *gorm.DB) error {
 			return errors.New("Unable to add index idx_domain on table dkim_config - " + err.Error())
 		}
 	}
+	// DMARC aggregate reports
+	if !DB.HasTable(&DMARCResult{}) {
+		if err = DB.CreateTable(&DMARCResult{}).Error; err != nil {
+			return errors.New("Unable to create table dmarc_results - " + err.Error())
+		}
+		// Index
+		if err = DB.Model(&DMARCResult{}).AddIndex("idx_dmarc_results_day_domain", "day", "domain").Error; err != nil {
+			return errors.New("Unable to add index idx_dmarc_results_day_domain on table dmarc_results - " + err.Error())
+		}
+	}
 
 	return nil
 }
@@ -119,7 +185,7 @@ func InitDB(DB *gorm.DB) error {
 // AutoMigrateDB will keep tables reflecting structs
 func AutoMigrateDB(DB *gorm.DB) error {
 	// if tables exists check if they reflects struts
-	if err := DB.AutoMigrate(&User{}, &Alias{}, &RcptHost{}, &RelayIpOk{}, &QMessage{}, &Route{}, &DkimConfig{}, &Plugin{}).Error; err != nil {
+	if err := DB.AutoMigrate(&User{}, &Alias{}, &RcptHost{}, &RelayIpOk{}, &QMessage{}, &QBounce{}, &Route{}, &DeliveryPolicy{}, &TLSRptResult{}, &RemoteHost{}, &GreylistWhitelist{}, &DkimConfig{}, &DMARCResult{}, &Plugin{}).Error; err != nil {
 		return errors.New("Unable autoMigrateDB - " + err.Error())
 	}
 	return nil
@@ -41,6 +41,11 @@ func LaunchDeliverd() {
 	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
 	cfg := nsq.NewConfig()
 
+	// check retry policy overrides
+	if _, err := parseRetryOverrides(Cfg.GetDeliverdRetryOverrides()); err != nil {
+		log.Fatalln("bad config COCOSMAIL_DELIVERD_RETRY_OVERRIDES - " + err.Error())
+	}
+
 	cfg.UserAgent = "cocosmail/deliverd"
 	cfg.MaxInFlight = ((Cfg.GetDeliverdConcurrencyLocal() + Cfg.GetDeliverdConcurrencyRemote()) * 200) / 100
 	// MaxAttempts: number of attemps for a message before sending a
@@ -71,6 +76,15 @@ func LaunchDeliverd() {
 		log.Fatalln(err)
 	}
 
+	// aggregated bounces
+	go flushBouncesLoop()
+
+	// close idle remote connections
+	go smtpPool.janitor()
+
+	// TLS reports
+	go tlsRptLoop()
+
 	Logger.Info("deliverd launched")
 
 	for {
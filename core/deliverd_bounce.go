@@ -0,0 +1,149 @@
+package core
+
+import (
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// bounceFlushMu prevents concurrent flushes of the same pending bounces
+var bounceFlushMu sync.Mutex
+
+// QBounce represents a failed recipient waiting to be reported in the
+// aggregated bounce of its message
+type QBounce struct {
+	Id                int64
+	Uuid              string // queued ID of the message
+	MailFrom          string
+	Body              string
+	SMTPUTF8          bool
+	Ret               string
+	EnvId             string
+	MessageAddedAt    time.Time
+	FailedAt          time.Time
+	Rcpt              string
+	OriginalRecipient string
+	FinalRecipient    string
+	Status            string
+	RemoteMTA         string
+	DiagnosticCode    string
+	LastAttemptDate   string
+	ErrMsg            string `sql:"type:text"`
+}
+
+// addBounce records a failed recipient of the message in the pending bounces
+func (d *Delivery) addBounce(r dsnRecipient) error {
+	b := QBounce{
+		Uuid:              d.QMsg.Uuid,
+		MailFrom:          d.QMsg.MailFrom,
+		Body:              d.QMsg.Body,
+		SMTPUTF8:          d.QMsg.SMTPUTF8,
+		Ret:               d.QMsg.Ret,
+		EnvId:             d.QMsg.EnvId,
+		MessageAddedAt:    d.QMsg.AddedAt,
+		FailedAt:          time.Now(),
+		Rcpt:              r.Rcpt,
+		OriginalRecipient: r.OriginalRecipient,
+		FinalRecipient:    r.FinalRecipient,
+		Status:            r.Status,
+		RemoteMTA:         r.RemoteMTA,
+		DiagnosticCode:    r.DiagnosticCode,
+		LastAttemptDate:   r.LastAttemptDate,
+		ErrMsg:            r.ErrMsg,
+	}
+	return DB.Create(&b).Error
+}
+
+// flushBounces sends one bounce listing all the pending failed recipients
+// of message uuid. The bounce is only sent when there is no more recipient
+// in queue for this message or when the oldest failure is older than the
+// aggregation window.
+// Pending bounces are kept in database, so they are sent after a restart.
+func flushBounces(uuid string) (id string, err error) {
+	bounceFlushMu.Lock()
+	defer bounceFlushMu.Unlock()
+
+	bounces := []QBounce{}
+	if err = DB.Where("uuid = ?", uuid).Order("id").Find(&bounces).Error; err != nil || len(bounces) == 0 {
+		return
+	}
+
+	var inQueue uint
+	if err = DB.Model(QMessage{}).Where("`uuid` = ?", uuid).Count(&inQueue).Error; err != nil {
+		return
+	}
+	window := time.Duration(Cfg.GetDeliverdBounceAggregationWindow()) * time.Second
+	if inQueue != 0 && time.Since(bounces[0].FailedAt) < window {
+		return
+	}
+
+	rcpts := []dsnRecipient{}
+	ids := []int64{}
+	for _, b := range bounces {
+		rcpts = append(rcpts, dsnRecipient{
+			Rcpt:              b.Rcpt,
+			OriginalRecipient: b.OriginalRecipient,
+			FinalRecipient:    b.FinalRecipient,
+			Action:            "failed",
+			Status:            b.Status,
+			RemoteMTA:         b.RemoteMTA,
+			DiagnosticCode:    b.DiagnosticCode,
+			LastAttemptDate:   b.LastAttemptDate,
+			ErrMsg:            b.ErrMsg,
+		})
+		ids = append(ids, b.Id)
+	}
+
+	// raw message, if it's not in the store anymore the bounce is sent without it
+	var rawMail *[]byte
+	if r, err := Store.Get(uuid); err == nil {
+		if raw, err := ioutil.ReadAll(r); err == nil {
+			rawMail = &raw
+		}
+	}
+
+	qMsg := &QMessage{
+		Uuid:     uuid,
+		MailFrom: bounces[0].MailFrom,
+		Body:     bounces[0].Body,
+		SMTPUTF8: bounces[0].SMTPUTF8,
+		Ret:      bounces[0].Ret,
+		EnvId:    bounces[0].EnvId,
+		AddedAt:  bounces[0].MessageAddedAt,
+	}
+	if id, err = queueDSN("tpl/bounce.tpl", qMsg, rawMail, rcpts); err != nil {
+		return
+	}
+
+	if err = DB.Where("id IN (?)", ids).Delete(QBounce{}).Error; err != nil {
+		return
+	}
+	// raw message is not needed anymore
+	if inQueue == 0 {
+		if errDel := Store.Del(uuid); errDel != nil && !strings.Contains(errDel.Error(), "no such file") {
+			Logger.Error("deliverd: unable to remove message " + uuid + " from store. " + errDel.Error())
+		}
+	}
+	Logger.Info("deliverd: message queued as " + uuid + " bounce for " + strconv.Itoa(len(rcpts)) + " recipient(s) queued with id " + id)
+	return
+}
+
+// flushBouncesLoop periodically sends the pending bounces whose
+// aggregation window is expired
+func flushBouncesLoop() {
+	for {
+		time.Sleep(30 * time.Second)
+		uuids := []string{}
+		if err := DB.Model(QBounce{}).Pluck("DISTINCT(uuid)", &uuids).Error; err != nil {
+			Logger.Error("deliverd: unable to get pending bounces. " + err.Error())
+			continue
+		}
+		for _, uuid := range uuids {
+			if _, err := flushBounces(uuid); err != nil {
+				Logger.Error("deliverd: unable to send pending bounce for message queued as " + uuid + ". " + err.Error())
+			}
+		}
+	}
+}
@@ -0,0 +1,178 @@
+package core
+
+import (
+	"errors"
+	"net"
+	"net/textproto"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// Circuit breaker states of a remote host
+const (
+	RemoteHostClosed   = "closed"    // healthy or below failure threshold
+	RemoteHostOpen     = "open"      // cooling down, not tried
+	RemoteHostHalfOpen = "half-open" // cool-down is over, next connection is a probe
+)
+
+// Remote host failure types
+const (
+	RemoteHostFailureTimeout  = "timeout"  // connect or greeting timeout
+	RemoteHostFailureConnect  = "connect"  // connection refused, unreachable...
+	RemoteHostFailureGreeting = "greeting" // 4xx greeting
+)
+
+// RemoteHost represents the health of a remote IP which failed to accept
+// connections (circuit breaker)
+// Healthy hosts are not in DB.
+type RemoteHost struct {
+	Id                  int64
+	IP                  string `sql:"unique"`
+	Host                string // MX hostname
+	ConsecutiveFailures int
+	LastFailureType     string
+	LastError           string `sql:"type:text"`
+	LastFailureAt       time.Time
+	OpenUntil           time.Time // end of cool-down
+	ProbeUntil          time.Time // a probe is running until
+}
+
+// State returns the circuit breaker state of the host
+func (h *RemoteHost) State() string {
+	if h.ConsecutiveFailures < Cfg.GetDeliverdBreakerThreshold() {
+		return RemoteHostClosed
+	}
+	if time.Now().Before(h.OpenUntil) {
+		return RemoteHostOpen
+	}
+	return RemoteHostHalfOpen
+}
+
+// RemoteHostGetAll returns all remote hosts with failures
+func RemoteHostGetAll() (hosts []RemoteHost, err error) {
+	hosts = []RemoteHost{}
+	err = DB.Order("ip").Find(&hosts).Error
+	return
+}
+
+// RemoteHostReset resets the failures of remote host ip
+func RemoteHostReset(ip string) error {
+	h := RemoteHost{}
+	if err := DB.Where("ip = ?", ip).First(&h).Error; err != nil {
+		return err
+	}
+	return DB.Delete(&h).Error
+}
+
+// RemoteHostResetAll resets the failures of all remote hosts
+func RemoteHostResetAll() error {
+	return DB.Delete(RemoteHost{}).Error
+}
+
+// remoteHostAllow returns true if a connection to ip can be tried: the
+// circuit is closed, or it is half-open and no other probe is running
+// In the latter case, the caller holds the probe until timeout and must
+// dial ip right away.
+func remoteHostAllow(ip string, timeout time.Duration) bool {
+	h := RemoteHost{}
+	if err := DB.Where("ip = ?", ip).First(&h).Error; err != nil {
+		if err != gorm.ErrRecordNotFound {
+			Logger.Error("deliverd-remote - unable to get health of remote host " + ip + " - " + err.Error())
+		}
+		return true
+	}
+	switch h.State() {
+	case RemoteHostClosed:
+		return true
+	case RemoteHostOpen:
+		return false
+	}
+	// half-open: only one probe at a time
+	now := time.Now()
+	res := DB.Model(RemoteHost{}).Where("id = ? AND probe_until < ?", h.Id, now).Update("probe_until", now.Add(timeout))
+	if res.Error != nil {
+		Logger.Error("deliverd-remote - unable to update health of remote host " + ip + " - " + res.Error.Error())
+		return false
+	}
+	return res.RowsAffected == 1
+}
+
+// remoteHostSuccess closes the circuit of ip
+func remoteHostSuccess(ip string) {
+	if err := DB.Where("ip = ?", ip).Delete(RemoteHost{}).Error; err != nil {
+		Logger.Error("deliverd-remote - unable to update health of remote host " + ip + " - " + err.Error())
+	}
+}
+
+// remoteHostFailure records a failure to connect to ip
+// From Cfg.GetDeliverdBreakerThreshold() consecutive failures, the circuit
+// is open for a cool-down doubled at each new failure.
+// Failures are counted in DB, concurrent deliveries may fail at once.
+func remoteHostFailure(ip, host string, failure error) {
+	now := time.Now()
+	fields := map[string]interface{}{
+		"consecutive_failures": gorm.Expr("consecutive_failures + ?", 1),
+		"host":                 host,
+		"last_failure_type":    remoteHostFailureType(failure),
+		"last_error":           failure.Error(),
+		"last_failure_at":      now,
+		"probe_until":          time.Time{},
+	}
+	res := DB.Model(RemoteHost{}).Where("ip = ?", ip).UpdateColumns(fields)
+	if res.Error == nil && res.RowsAffected == 0 {
+		h := RemoteHost{
+			IP:                  ip,
+			Host:                host,
+			ConsecutiveFailures: 1,
+			LastFailureType:     fields["last_failure_type"].(string),
+			LastError:           failure.Error(),
+			LastFailureAt:       now,
+		}
+		if err := DB.Create(&h).Error; err != nil {
+			// created meanwhile by another delivery
+			res = DB.Model(RemoteHost{}).Where("ip = ?", ip).UpdateColumns(fields)
+		}
+	}
+	if res.Error != nil {
+		Logger.Error("deliverd-remote - unable to update health of remote host " + ip + " - " + res.Error.Error())
+		return
+	}
+
+	h := RemoteHost{}
+	if err := DB.Where("ip = ?", ip).First(&h).Error; err != nil {
+		Logger.Error("deliverd-remote - unable to get health of remote host " + ip + " - " + err.Error())
+		return
+	}
+	over := h.ConsecutiveFailures - Cfg.GetDeliverdBreakerThreshold()
+	if over < 0 {
+		return
+	}
+	coolDown := time.Duration(Cfg.GetDeliverdBreakerCoolDown()) * time.Second
+	maxCoolDown := time.Duration(Cfg.GetDeliverdBreakerMaxCoolDown()) * time.Second
+	for i := 0; i < over && coolDown < maxCoolDown; i++ {
+		coolDown *= 2
+	}
+	if coolDown > maxCoolDown {
+		coolDown = maxCoolDown
+	}
+	openUntil := now.Add(coolDown)
+	if err := DB.Model(&h).UpdateColumn("open_until", openUntil).Error; err != nil {
+		Logger.Error("deliverd-remote - unable to update health of remote host " + ip + " - " + err.Error())
+		return
+	}
+	Logger.Info("deliverd-remote - remote host " + ip + " (" + host + ") is unreachable, not tried until " + openUntil.Format(time.RFC3339))
+}
+
+// remoteHostFailureType returns the type of a connection failure
+func remoteHostFailureType(err error) string {
+	var tpErr *textproto.Error
+	if errors.As(err, &tpErr) {
+		return RemoteHostFailureGreeting
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return RemoteHostFailureTimeout
+	}
+	return RemoteHostFailureConnect
+}
@@ -0,0 +1,47 @@
+package core
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/stunndard/cocosmail/dane"
+)
+
+var (
+	daneResolver     dane.Resolver
+	daneResolverOnce sync.Once
+)
+
+// lookupTLSA sets the DNSSEC signed TLSA records of the remote host of
+// the client, if any.
+// Insecure records are ignored (RFC 7672 2.2).
+func (s *smtpClient) lookupTLSA() error {
+	s.daneRecords = nil
+	host := strings.TrimSuffix(s.route.RemoteHost, ".")
+	if net.ParseIP(host) != nil {
+		return nil
+	}
+	daneResolverOnce.Do(func() {
+		daneResolver = dane.NewResolver(Cfg.GetDeliverdRemoteDANEResolver(), time.Duration(s.timeoutBasePerCmd)*time.Second)
+	})
+	_, port, err := net.SplitHostPort(s.RemoteAddr())
+	if err != nil {
+		return err
+	}
+	records, secure, err := daneResolver.LookupTLSA(fmt.Sprintf("_%s._tcp.%s", port, host))
+	if err != nil {
+		return err
+	}
+	if secure {
+		s.daneRecords = dane.Usable(records)
+	}
+	return nil
+}
+
+// daneRequired returns true if the delivery policy requires DANE
+func (d *Delivery) daneRequired() bool {
+	return d.Policy != nil && d.Policy.RequireDANE
+}
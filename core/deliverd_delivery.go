@@ -1,20 +1,17 @@
 package core
 
 import (
-	"bytes"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
-	"math/rand"
-	"path"
 	"runtime/debug"
 	"sync/atomic"
-	"text/template"
 	"time"
 
 	"github.com/jinzhu/gorm"
 	"github.com/nsqio/go-nsq"
 	"github.com/stunndard/cocosmail/message"
+	"github.com/stunndard/cocosmail/mtasts"
 )
 
 // Delivery is a deliver process
@@ -30,7 +27,11 @@ type Delivery struct {
 	RemoteRoutes           []Route
 	RemoteAddr             string
 	RemoteSMTPresponseCode int
+	RemoteSMTPresponseMsg  string
 	Success                bool
+	DSNAction              string // DSN action on success: delivered, relayed, expanded or empty if next hop notifies
+	MTASTSPolicy           *mtasts.Policy  // MTA-STS policy of the recipient domain
+	Policy                 *DeliveryPolicy // delivery policy of the recipient domain or its MX
 }
 
 // processMsg processes message
@@ -111,9 +112,29 @@ func (d *Delivery) processMsg() {
 		flagBounce = true
 	}
 
+	// Not due yet: the recipient was requeued by the delivery of another
+	// recipient which batched it, nsq message fired on its old schedule
+	if d.QMsg.Status == 2 {
+		if wait := time.Until(d.QMsg.NextDeliveryScheduledAt); wait > time.Second {
+			Logger.Info(fmt.Sprintf("deliverd %s : queued message %s is scheduled at %v, requeued", d.ID, d.QMsg.Uuid, d.QMsg.NextDeliveryScheduledAt))
+			d.NSQMsg.RequeueWithoutBackoff(wait)
+			return
+		}
+	}
+
 	// update status to: delivery in progress
-	d.QMsg.Status = 0
-	d.QMsg.SaveInDb()
+	// (fails if another delivery has batched this recipient in the meantime)
+	claimed, err := d.QMsg.Claim()
+	if err != nil {
+		Logger.Error(fmt.Sprintf("deliverd %s : unable to update status of queued message %s - %s", d.ID, d.QMsg.Uuid, err))
+		d.NSQMsg.RequeueWithoutBackoff(time.Duration(60 * time.Second))
+		return
+	}
+	if !claimed {
+		Logger.Info(fmt.Sprintf("deliverd %s : queued message %s is marked as being in delivery by another process", d.ID, d.QMsg.Uuid))
+		d.NSQMsg.RequeueWithoutBackoff(time.Duration(600 * time.Second))
+		return
+	}
 
 	// {"Id":7,"Key":"7f88b72858ae57c17b6f5e89c1579924615d7876","MailFrom":"cocos@cocosmail.io",
 	// "RcptTo":"cocos@cocosmail.io","Host":"cocosmail.io","AddedAt":"2014-12-02T09:05:59.342268145+01:00",
@@ -176,10 +197,19 @@ func (d *Delivery) processMsg() {
 func (d *Delivery) dieOk() {
 	d.Success = true
 	Logger.Info("deliverd " + d.ID + ": Success")
+	// DSN: success notification requested (RFC 3461 4.1)
+	if d.DSNAction != "" && d.QMsg.MailFrom != "" && message.NotifyHas(d.QMsg.Notify, "SUCCESS") {
+		id, err := d.sendDSN("tpl/success.tpl", []dsnRecipient{d.newDSNRecipient(d.DSNAction, "")})
+		if err != nil {
+			Logger.Error("deliverd " + d.ID + ": unable to send success notification for message queued as " + d.QMsg.Uuid + " " + err.Error())
+		} else {
+			Logger.Info("deliverd " + d.ID + ": success notification queued with id " + id)
+		}
+	}
 	if err := d.QMsg.Delete(); err != nil {
 		Logger.Error("deliverd " + d.ID + ": unable remove queued message " + d.QMsg.Uuid + " from queue." + err.Error())
 	}
-	d.NSQMsg.Finish()
+	d.finish()
 }
 
 // dieTemp die when a 4** error occured
@@ -194,7 +224,10 @@ func (d *Delivery) dieTemp(msg string, logit bool) {
 		return
 	}
 
-	if time.Since(d.QMsg.AddedAt) < time.Duration(Cfg.GetDeliverdQueueLifetime())*time.Minute {
+	policy := getRetryPolicy(d.QMsg.Host, d.RemoteSMTPresponseCode, d.RemoteSMTPresponseMsg)
+	if time.Since(d.QMsg.AddedAt) < time.Duration(policy.Lifetime)*time.Minute {
+		d.QMsg.DeliveryFailedCount++
+		d.warnDelay(msg)
 		d.requeue()
 		return
 	}
@@ -212,6 +245,36 @@ func (d *Delivery) diePerm(msg string, logit bool) {
 	return
 }
 
+// warnDelay sends a delayed delivery warning if the message has been in
+// queue for longer than the next configured delay
+// d.QMsg.DelayWarningsSent is saved by requeue
+func (d *Delivery) warnDelay(errMsg string) {
+	if d.QMsg.MailFrom == "" || d.QMsg.MailFrom == "#@[]" {
+		return
+	}
+	delays := Cfg.GetDeliverdQueueDelayWarnings()
+	passed := 0
+	for _, delay := range delays {
+		if time.Since(d.QMsg.AddedAt) >= time.Duration(delay)*time.Minute {
+			passed++
+		}
+	}
+	if passed <= d.QMsg.DelayWarningsSent {
+		return
+	}
+	// only one warning even if several delays are passed
+	d.QMsg.DelayWarningsSent = passed
+	if !message.NotifyHas(d.QMsg.Notify, "DELAY") {
+		return
+	}
+	id, err := d.sendDSN("tpl/delayed.tpl", []dsnRecipient{d.newDSNRecipient("delayed", errMsg)})
+	if err != nil {
+		Logger.Error("deliverd " + d.ID + ": unable to send delayed delivery warning for message queued as " + d.QMsg.Uuid + " " + err.Error())
+		return
+	}
+	Logger.Info("deliverd " + d.ID + ": message from: " + d.QMsg.MailFrom + " to: " + d.QMsg.RcptTo + " delayed delivery warning queued with id " + id)
+}
+
 // discard remove a message from queue
 func (d *Delivery) discard() {
 	Logger.Info("deliverd " + d.ID + " discard message queued as " + d.QMsg.Uuid)
@@ -219,7 +282,7 @@ func (d *Delivery) discard() {
 		Logger.Error("deliverd " + d.ID + ": unable remove message queued as " + d.QMsg.Uuid + " from queue. " + err.Error())
 		d.requeue(1)
 	} else {
-		d.NSQMsg.Finish()
+		d.finish()
 	}
 	return
 }
@@ -233,7 +296,7 @@ func (d *Delivery) bounce(errMsg string) {
 			Logger.Error("deliverd " + d.ID + ": unable remove message queued as " + d.QMsg.Uuid + " from queue. " + err.Error())
 			d.requeue(1)
 		} else {
-			d.NSQMsg.Finish()
+			d.finish()
 		}
 		return
 	}
@@ -245,68 +308,45 @@ func (d *Delivery) bounce(errMsg string) {
 			Logger.Error("deliverd " + d.ID + ": unable remove message " + d.QMsg.Uuid + " from queue. " + err.Error())
 			d.requeue(1)
 		} else {
-			d.NSQMsg.Finish()
+			d.finish()
 		}
 		return
 	}
 
-	type templateData struct {
-		Date        string
-		Me          string
-		RcptTo      string
-		OriRcptTo   string
-		ErrMsg      string
-		BouncedMail string
-	}
-
-	// Si ça bounce car le mail a disparu de la queue:
-	if d.RawData == nil {
-		t := []byte("Raw mail was not found in the store")
-		d.RawData = &t
-	}
-
-	// check if Received header needs redaction before bouncing
-	*d.RawData = []byte(message.RedactHeadersRemove(string(*d.RawData)))
-
-	tData := templateData{Format822Date(), Cfg.GetMe(), d.QMsg.MailFrom, d.QMsg.RcptTo, errMsg, string(*d.RawData)}
-	t, err := template.ParseFiles(path.Join(Cfg.GetBasePath(), "tpl/bounce.tpl"))
-	if err != nil {
-		Logger.Error("deliverd " + d.ID + ": unable to bounce message queued as " + d.QMsg.Uuid + " " + err.Error())
-		d.requeue(3)
-		return
-	}
-
-	bouncedMailBuf := new(bytes.Buffer)
-	err = t.Execute(bouncedMailBuf, tData)
-	if err != nil {
-		Logger.Error("deliverd " + d.ID + ": unable to bounce message queued as " + d.QMsg.Uuid + " " + err.Error())
-		d.requeue(3)
-		return
-	}
-	b, err := ioutil.ReadAll(bouncedMailBuf)
-	if err != nil {
-		Logger.Error("deliverd " + d.ID + ": unable to bounce message queued as " + d.QMsg.Uuid + " " + err.Error())
-		d.requeue(3)
+	// DSN: no failure notification requested (RFC 3461 4.1)
+	if !message.NotifyHas(d.QMsg.Notify, "FAILURE") {
+		Logger.Info("deliverd " + d.ID + ": message from: " + d.QMsg.MailFrom + " to: " + d.QMsg.RcptTo + " bounce not requested (NOTIFY=" + d.QMsg.Notify + "): discarding")
+		if err := d.QMsg.Delete(); err != nil {
+			Logger.Error("deliverd " + d.ID + ": unable remove message " + d.QMsg.Uuid + " from queue. " + err.Error())
+			d.requeue(1)
+		} else {
+			d.finish()
+		}
 		return
 	}
 
-	// unix2dos it
-	err = Unix2dos(&b)
-	if err != nil {
-		Logger.Error("deliverd " + d.ID + ": unable to convert bounce from unix to dos. " + err.Error())
-		d.requeue(3)
+	// aggregated bounce: the failure is recorded and will be reported with
+	// the other failed recipients of this message
+	if Cfg.GetDeliverdBounceAggregationWindow() > 0 {
+		if err := d.addBounce(d.newDSNRecipient("failed", errMsg)); err != nil {
+			Logger.Error("deliverd " + d.ID + ": unable to bounce message queued as " + d.QMsg.Uuid + " " + err.Error())
+			d.requeue(3)
+			return
+		}
+		if err := d.QMsg.Delete(); err != nil {
+			Logger.Error("deliverd " + d.ID + ": unable remove bounced message queued as " + d.QMsg.Uuid + " from queue. " + err.Error())
+			d.requeue(1)
+		} else {
+			d.finish()
+		}
+		Logger.Info("deliverd " + d.ID + ": message from: " + d.QMsg.MailFrom + " to: " + d.QMsg.RcptTo + " queued as " + d.QMsg.Uuid + " added to pending bounce.")
+		if _, err := flushBounces(d.QMsg.Uuid); err != nil {
+			Logger.Error("deliverd " + d.ID + ": unable to send pending bounce for message queued as " + d.QMsg.Uuid + " " + err.Error())
+		}
 		return
 	}
 
-	// enqueue
-	envelope := message.Envelope{MailFrom: "", RcptTo: []string{d.QMsg.MailFrom}}
-	/*message, err := message.New(&b)
-	if err != nil {
-		Logger.Error("deliverd " + d.ID + ": unable to bounce message " + d.QMsg.Key + " " + err.Error())
-		d.requeue(3)
-		return
-	}*/
-	id, err := QueueAddMessage(&b, envelope, "")
+	id, err := d.sendDSN("tpl/bounce.tpl", []dsnRecipient{d.newDSNRecipient("failed", errMsg)})
 	if err != nil {
 		Logger.Error("deliverd " + d.ID + ": unable to bounce message queued as " + d.QMsg.Uuid + " " + err.Error())
 		d.requeue(3)
@@ -317,7 +357,7 @@ func (d *Delivery) bounce(errMsg string) {
 		Logger.Error("deliverd " + d.ID + ": unable remove bounced message queued as " + d.QMsg.Uuid + " from queue. " + err.Error())
 		d.requeue(1)
 	} else {
-		d.NSQMsg.Finish()
+		d.finish()
 	}
 
 	Logger.Info("deliverd " + d.ID + ": message from: " + d.QMsg.MailFrom + " to: " + d.QMsg.RcptTo + " queued with id " + id + " for being bounced.")
@@ -338,21 +378,25 @@ func (d *Delivery) requeue(newStatus ...uint32) {
 	//if d.QMsg.Status == 1 || d.QMsg.Status == 3 {
 	//	return
 	//}
-	// Calcul du delais, pour le moment on accroit betement de 60 secondes a chaque tentative
-	// + random
-	rand.Seed(rand.Int63())
-	delay := time.Duration(d.NSQMsg.Attempts*uint16(rand.Intn(180)+60)) * time.Second
-	if delay >= time.Hour {
-		delay = time.Duration(rand.Intn(2000)+1599) * time.Second
-	}
-	// Todo update next delivery en DB
+	// delay from the retry policy
+	delay := getRetryPolicy(d.QMsg.Host, d.RemoteSMTPresponseCode, d.RemoteSMTPresponseMsg).nextInterval(d.QMsg.DeliveryFailedCount)
 	d.QMsg.NextDeliveryScheduledAt = time.Now().Add(delay)
 	d.QMsg.Status = status
 	d.QMsg.SaveInDb() // Todo: check error
-	d.NSQMsg.RequeueWithoutBackoff(delay)
+	if d.NSQMsg != nil {
+		d.NSQMsg.RequeueWithoutBackoff(delay)
+	}
 	return
 }
 
+// finish tells nsq that the message has been processed
+// recipients batched in the delivery of another recipient have no nsq message
+func (d *Delivery) finish() {
+	if d.NSQMsg != nil {
+		d.NSQMsg.Finish()
+	}
+}
+
 // handleSmtpError handles SMTP error response
 func (d *Delivery) handleSMTPError(code int, message string) {
 	if code > 499 {
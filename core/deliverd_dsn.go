@@ -0,0 +1,238 @@
+package core
+
+import (
+	"bytes"
+	"fmt"
+	"mime/multipart"
+	"net"
+	"net/textproto"
+	"path"
+	"regexp"
+	"strings"
+	"text/template"
+
+	"github.com/stunndard/cocosmail/message"
+)
+
+// enhanced status code (RFC 3463) at the beginning of a SMTP reply
+var enhancedStatusCodeRe = regexp.MustCompile(`^[245]\.[0-9]{1,3}\.[0-9]{1,3}\b`)
+
+// dsnRecipient represents the per-recipient fields of a delivery
+// status notification (RFC 3464 2.3)
+type dsnRecipient struct {
+	Rcpt              string
+	OriginalRecipient string
+	FinalRecipient    string
+	Action            string // failed, delayed, delivered, relayed or expanded
+	Status            string
+	RemoteMTA         string
+	DiagnosticCode    string
+	LastAttemptDate   string
+	ErrMsg            string // human readable
+}
+
+// newDSNRecipient returns DSN fields for the current recipient
+func (d *Delivery) newDSNRecipient(action, errMsg string) dsnRecipient {
+	r := dsnRecipient{
+		Rcpt:            d.QMsg.RcptTo,
+		FinalRecipient:  "rfc822; " + d.QMsg.RcptTo,
+		Action:          action,
+		LastAttemptDate: Format822Date(),
+		ErrMsg:          errMsg,
+	}
+
+	// ORCPT: addr-type;xtext
+	if p := strings.Index(d.QMsg.ORcpt, ";"); p != -1 {
+		r.OriginalRecipient = d.QMsg.ORcpt[:p] + "; " + message.XtextDecode(d.QMsg.ORcpt[p+1:])
+	}
+
+	if d.RemoteAddr != "" {
+		host, _, err := net.SplitHostPort(d.RemoteAddr)
+		if err != nil {
+			host = d.RemoteAddr
+		}
+		r.RemoteMTA = "dns; " + host
+	}
+
+	// remote server reply
+	reply := strings.Join(strings.Fields(d.RemoteSMTPresponseMsg), " ")
+	if d.RemoteSMTPresponseCode > 399 {
+		r.DiagnosticCode = fmt.Sprintf("smtp; %d %s", d.RemoteSMTPresponseCode, reply)
+	}
+
+	switch action {
+	case "failed", "delayed":
+		// class must match the action (RFC 3464 2.3.3): a temporary
+		// failure reported as failed when the message expired is 5.x.x
+		class := "5"
+		if action == "delayed" {
+			class = "4"
+		}
+		r.Status = class + ".0.0"
+		if r.DiagnosticCode != "" {
+			if code := enhancedStatusCodeRe.FindString(reply); code != "" {
+				r.Status = class + code[1:]
+			}
+		}
+	default:
+		r.Status = "2.0.0"
+	}
+	return r
+}
+
+// newDSN returns a delivery status notification (RFC 3464) for qMsg
+// tpl is the template of the headers and the human readable part
+func newDSN(tpl string, qMsg *QMessage, rawMail *[]byte, rcpts []dsnRecipient) ([]byte, error) {
+	type templateData struct {
+		Date       string
+		Me         string
+		RcptTo     string
+		EnvId      string
+		Recipients []dsnRecipient
+		// fields of the first recipient, for templates written before
+		// multipart DSNs
+		OriRcptTo   string
+		ORcpt       string
+		ErrMsg      string
+		BouncedMail string
+	}
+	tData := templateData{
+		Date:       Format822Date(),
+		Me:         Cfg.GetMe(),
+		RcptTo:     qMsg.MailFrom,
+		EnvId:      message.XtextDecode(qMsg.EnvId),
+		Recipients: rcpts,
+	}
+	if len(rcpts) != 0 {
+		tData.OriRcptTo = rcpts[0].Rcpt
+		tData.ErrMsg = rcpts[0].ErrMsg
+		if p := strings.Index(rcpts[0].OriginalRecipient, ";"); p != -1 {
+			tData.ORcpt = strings.TrimSpace(rcpts[0].OriginalRecipient[p+1:])
+		}
+	}
+	if rawMail != nil {
+		tData.BouncedMail = string(*rawMail)
+		if qMsg.Ret == "HDRS" {
+			tData.BouncedMail = string(message.RawGetHeaders(rawMail))
+		}
+	}
+
+	t, err := template.ParseFiles(path.Join(Cfg.GetBasePath(), tpl))
+	if err != nil {
+		return nil, err
+	}
+	tplBuf := new(bytes.Buffer)
+	if err = t.Execute(tplBuf, tData); err != nil {
+		return nil, err
+	}
+	rendered := tplBuf.Bytes()
+	if err = Unix2dos(&rendered); err != nil {
+		return nil, err
+	}
+
+	// template: headers, blank line, human readable part
+	headers := rendered
+	humanPart := []byte{}
+	if p := bytes.Index(rendered, []byte{13, 10, 13, 10}); p != -1 {
+		headers = rendered[:p+2]
+		humanPart = rendered[p+4:]
+	}
+
+	body := new(bytes.Buffer)
+	mw := multipart.NewWriter(body)
+
+	// human readable part
+	w, err := mw.CreatePart(textproto.MIMEHeader{"Content-Type": {"text/plain; charset=utf-8"}})
+	if err != nil {
+		return nil, err
+	}
+	if _, err = w.Write(humanPart); err != nil {
+		return nil, err
+	}
+
+	// delivery status
+	w, err = mw.CreatePart(textproto.MIMEHeader{"Content-Type": {"message/delivery-status"}})
+	if err != nil {
+		return nil, err
+	}
+	status := "Reporting-MTA: dns; " + Cfg.GetMe() + "\r\n"
+	if qMsg.EnvId != "" {
+		status += "Original-Envelope-Id: " + qMsg.EnvId + "\r\n"
+	}
+	status += "Arrival-Date: " + qMsg.AddedAt.Format(Time822) + "\r\n"
+	for _, r := range rcpts {
+		status += "\r\n"
+		if r.OriginalRecipient != "" {
+			status += "Original-Recipient: " + r.OriginalRecipient + "\r\n"
+		}
+		status += "Final-Recipient: " + r.FinalRecipient + "\r\n"
+		status += "Action: " + r.Action + "\r\n"
+		status += "Status: " + r.Status + "\r\n"
+		if r.RemoteMTA != "" {
+			status += "Remote-MTA: " + r.RemoteMTA + "\r\n"
+		}
+		if r.DiagnosticCode != "" {
+			status += "Diagnostic-Code: " + r.DiagnosticCode + "\r\n"
+		}
+		status += "Last-Attempt-Date: " + r.LastAttemptDate + "\r\n"
+	}
+	if _, err = w.Write([]byte(status)); err != nil {
+		return nil, err
+	}
+
+	// original message or headers only if RET=HDRS
+	if rawMail != nil {
+		if qMsg.Ret == "HDRS" {
+			w, err = mw.CreatePart(textproto.MIMEHeader{"Content-Type": {"text/rfc822-headers"}})
+			if err == nil {
+				_, err = w.Write(append(message.RawGetHeaders(rawMail), 13, 10))
+			}
+		} else {
+			w, err = mw.CreatePart(textproto.MIMEHeader{"Content-Type": {"message/rfc822"}})
+			if err == nil {
+				_, err = w.Write(*rawMail)
+			}
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	if err = mw.Close(); err != nil {
+		return nil, err
+	}
+
+	dsn := append([]byte{}, headers...)
+	dsn = append(dsn, []byte("MIME-Version: 1.0\r\n")...)
+	dsn = append(dsn, []byte("Content-Type: multipart/report; report-type=delivery-status;\r\n\tboundary=\""+mw.Boundary()+"\"\r\n")...)
+	dsn = append(dsn, []byte("Auto-Submitted: auto-replied\r\n\r\n")...)
+	dsn = append(dsn, body.Bytes()...)
+	return dsn, nil
+}
+
+// sendDSN creates a delivery status notification for the sender of the
+// message from template tpl and enqueues it
+func (d *Delivery) sendDSN(tpl string, rcpts []dsnRecipient) (id string, err error) {
+	return queueDSN(tpl, d.QMsg, d.RawData, rcpts)
+}
+
+// queueDSN enqueues a delivery status notification for the sender of qMsg
+func queueDSN(tpl string, qMsg *QMessage, rawMail *[]byte, rcpts []dsnRecipient) (id string, err error) {
+	// check if Received header needs redaction before bouncing
+	if rawMail != nil {
+		*rawMail = []byte(message.RedactHeadersRemove(string(*rawMail)))
+	}
+
+	b, err := newDSN(tpl, qMsg, rawMail, rcpts)
+	if err != nil {
+		return
+	}
+
+	// enqueue
+	envelope := message.Envelope{
+		MailFrom: "",
+		RcptTo:   []string{qMsg.MailFrom},
+		Body:     qMsg.Body,
+		SMTPUTF8: !message.Is7Bit([]byte(qMsg.MailFrom)),
+	}
+	return QueueAddMessage(&b, envelope, "")
+}
@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"os"
 
+	"github.com/stunndard/cocosmail/message"
 	"github.com/stunndard/go-maildir"
 )
 
@@ -34,6 +35,11 @@ func (d *DeliveryMaildir) Deliver(id, deliverTo string, rawMsg *bytes.Buffer) (p
 		return false, fmt.Errorf("cannot get user: %s", err)
 	}
 	mdPath := usr.Home
+	// quarantined messages go to the Junk folder (Maildir++)
+	raw := rawMsg.Bytes()
+	if message.RawHaveHeader(&raw, quarantineHeader) {
+		mdPath += "/.Junk"
+	}
 
 	err = os.MkdirAll(mdPath, 0700)
 	if err != nil {
@@ -27,6 +27,7 @@ func deliverLocal(d *Delivery) {
 
 	Logger.Info(fmt.Sprintf("delivery-local %s: starting new delivery from %s to %s - Message-Id: %s - Queue-Id: %s", d.ID, d.QMsg.MailFrom, d.QMsg.RcptTo, d.QMsg.MessageId, d.QMsg.Uuid))
 	deliverTo := d.QMsg.RcptTo
+	d.DSNAction = "delivered"
 
 	// if it's not a local user checks for alias
 	user, err := UserGetByLogin(d.QMsg.RcptTo)
@@ -119,6 +120,21 @@ func deliverLocal(d *Delivery) {
 				enveloppe := message.Envelope{
 					MailFrom: d.QMsg.MailFrom,
 					RcptTo:   localRcpt,
+					Body:     d.QMsg.Body,
+					SMTPUTF8: d.QMsg.SMTPUTF8,
+					Ret:      d.QMsg.Ret,
+					EnvId:    d.QMsg.EnvId,
+				}
+				// RFC 3461 6.2.7.3: no further notifications for expanded recipients
+				if len(localRcpt) > 1 {
+					d.DSNAction = "expanded"
+					enveloppe.DSN = make(map[string]message.RcptDSN)
+					for _, rcpt := range localRcpt {
+						enveloppe.DSN[rcpt] = message.RcptDSN{Notify: "NEVER"}
+					}
+				} else {
+					d.DSNAction = ""
+					enveloppe.DSN = map[string]message.RcptDSN{localRcpt[0]: {Notify: d.QMsg.Notify, ORcpt: d.QMsg.ORcpt}}
 				}
 				// rem: no minilist for domainAlias
 				if enveloppe.MailFrom != "" && alias.IsMiniList && !alias.IsDomAlias {
@@ -0,0 +1,100 @@
+package core
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/stunndard/cocosmail/mtasts"
+)
+
+var (
+	mtastsFetcher     *mtasts.Fetcher
+	mtastsFetcherOnce sync.Once
+)
+
+// boltMTASTSCache stores MTA-STS policies in Bolt bucket mtasts
+type boltMTASTSCache struct{}
+
+// Get returns the cached policy of domain
+func (boltMTASTSCache) Get(domain string) (p *mtasts.Policy, err error) {
+	err = Bolt.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket([]byte("mtasts")).Get([]byte(domain))
+		if v == nil {
+			return nil
+		}
+		p = &mtasts.Policy{}
+		return json.Unmarshal(v, p)
+	})
+	return
+}
+
+// Put caches the policy of domain
+func (boltMTASTSCache) Put(domain string, p *mtasts.Policy) error {
+	v, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+	return Bolt.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte("mtasts")).Put([]byte(domain), v)
+	})
+}
+
+// getMTASTSPolicy returns the MTA-STS policy of domain, nil if there is none
+func getMTASTSPolicy(domain string) (*mtasts.Policy, error) {
+	mtastsFetcherOnce.Do(func() {
+		mtastsFetcher = mtasts.NewFetcher(boltMTASTSCache{}, 60*time.Second)
+		mtastsFetcher.LookupTXT = func(name string) ([]string, error) {
+			return DNS.LookupTXT(context.Background(), name)
+		}
+	})
+	return mtastsFetcher.Get(domain)
+}
+
+// applyMTASTS gets the MTA-STS policy of the recipient domain and removes
+// the routes to MX which are not allowed by the policy in enforce mode.
+// Only routes from MX lookup are concerned.
+// If it returns false, the delivery has been handled.
+func applyMTASTS(d *Delivery) bool {
+	if !Cfg.GetDeliverdRemoteMTASTS() || len(d.RemoteRoutes) == 0 || !d.RemoteRoutes[0].FromMX {
+		return true
+	}
+	policy, err := getMTASTSPolicy(d.QMsg.Host)
+	if err != nil {
+		Logger.Info(fmt.Sprintf("deliverd-remote %s - MTA-STS policy discovery for %s failed - %s", d.ID, d.QMsg.Host, err))
+		return true
+	}
+	if policy == nil || policy.Mode == mtasts.ModeNone {
+		return true
+	}
+	d.MTASTSPolicy = policy
+
+	routes := []Route{}
+	for _, r := range d.RemoteRoutes {
+		if policy.MatchMX(r.RemoteHost) {
+			routes = append(routes, r)
+			continue
+		}
+		Logger.Info(fmt.Sprintf("deliverd-remote %s - MX %s of %s doesn't match its MTA-STS policy (mode %s)", d.ID, r.RemoteHost, d.QMsg.Host, policy.Mode))
+		d.recordTLSResult(nil, r.RemoteHost, tlsRptValidationFailure)
+	}
+	if policy.Mode != mtasts.ModeEnforce {
+		return true
+	}
+	if len(routes) == 0 {
+		d.dieTemp(fmt.Sprintf("deliverd-remote %s - no MX of %s matches its MTA-STS policy (mx: %s)", d.ID, d.QMsg.Host, strings.Join(policy.MX, ", ")), true)
+		return false
+	}
+	d.RemoteRoutes = routes
+	return true
+}
+
+// mtastsEnforced returns true if verified TLS is required by the MTA-STS
+// policy of the recipient domain
+func (d *Delivery) mtastsEnforced() bool {
+	return d.MTASTSPolicy != nil && d.MTASTSPolicy.Mode == mtasts.ModeEnforce
+}
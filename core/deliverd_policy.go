@@ -0,0 +1,173 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DeliveryPolicy represents limits and requirements applied to remote deliveries to
+// a recipient domain or to the MX hosts matching Pattern
+type DeliveryPolicy struct {
+	Id               int64
+	Pattern          string `sql:"unique"` // domain or MX hostname, * wildcard allowed (eg *.google.com)
+	MaxConns         int    // max concurrent connections, 0 for unlimited
+	MaxMsgsPerMinute int    // max messages per minute, 0 for unlimited
+	Backoff421       int    // seconds without delivery after a 421 reply
+	RequireDANE      bool   // defer delivery if remote hosts have no DNSSEC signed TLSA records
+}
+
+// policyState represents the current usage of a policy
+type policyState struct {
+	conns        int
+	windowStart  time.Time
+	msgs         int
+	backoffUntil time.Time
+}
+
+// policyLimiter enforces delivery policies
+type policyLimiter struct {
+	sync.Mutex
+	states map[int64]*policyState
+}
+
+// deliveryPolicies keeps track of the usage of delivery policies
+var deliveryPolicies = &policyLimiter{states: make(map[int64]*policyState)}
+
+// DeliveryPolicyGetAll returns all delivery policies
+func DeliveryPolicyGetAll() (policies []DeliveryPolicy, err error) {
+	policies = []DeliveryPolicy{}
+	err = DB.Order("pattern").Find(&policies).Error
+	return
+}
+
+// DeliveryPolicyAdd adds a delivery policy
+func DeliveryPolicyAdd(pattern string, maxConns, maxMsgsPerMinute, backoff421 int, requireDANE bool) error {
+	pattern = strings.ToLower(strings.TrimSpace(pattern))
+	if pattern == "" {
+		return errors.New("pattern must not be empty")
+	}
+	if _, err := path.Match(pattern, ""); err != nil {
+		return errors.New("bad pattern " + pattern + " - " + err.Error())
+	}
+	if maxConns < 0 || maxMsgsPerMinute < 0 || backoff421 < 0 {
+		return errors.New("limits must be positive or 0")
+	}
+	var count int
+	if err := DB.Model(DeliveryPolicy{}).Where("pattern = ?", pattern).Count(&count).Error; err != nil {
+		return err
+	}
+	if count != 0 {
+		return errors.New("a policy already exists for " + pattern)
+	}
+	p := DeliveryPolicy{
+		Pattern:          pattern,
+		MaxConns:         maxConns,
+		MaxMsgsPerMinute: maxMsgsPerMinute,
+		Backoff421:       backoff421,
+		RequireDANE:      requireDANE,
+	}
+	return DB.Save(&p).Error
+}
+
+// DeliveryPolicyDel deletes a delivery policy
+func DeliveryPolicyDel(pattern string) error {
+	pattern = strings.ToLower(strings.TrimSpace(pattern))
+	p := DeliveryPolicy{}
+	if err := DB.Where("pattern = ?", pattern).First(&p).Error; err != nil {
+		return err
+	}
+	if err := DB.Delete(&p).Error; err != nil {
+		return err
+	}
+	deliveryPolicies.Lock()
+	delete(deliveryPolicies.states, p.Id)
+	deliveryPolicies.Unlock()
+	return nil
+}
+
+// getDeliveryPolicy returns the policy to apply to a delivery to host
+// using routes, or nil if there is none.
+// A policy matching the recipient domain wins over a policy matching
+// the MX hosts.
+func getDeliveryPolicy(host string, routes []Route) (*DeliveryPolicy, error) {
+	policies, err := DeliveryPolicyGetAll()
+	if err != nil || len(policies) == 0 {
+		return nil, err
+	}
+	host = strings.ToLower(host)
+
+	// recipient domain
+	for i := range policies {
+		if policies[i].Pattern == host {
+			return &policies[i], nil
+		}
+	}
+	for i := range policies {
+		if ok, _ := path.Match(policies[i].Pattern, host); ok {
+			return &policies[i], nil
+		}
+	}
+	// MX
+	for _, r := range routes {
+		remoteHost := strings.ToLower(strings.TrimSuffix(r.RemoteHost, "."))
+		for i := range policies {
+			if ok, _ := path.Match(policies[i].Pattern, remoteHost); ok {
+				return &policies[i], nil
+			}
+		}
+	}
+	return nil, nil
+}
+
+// acquire reserves a connection and a message slot for policy p
+// Idle pooled connections count as connections of the policy; if reused is
+// true, the delivery uses one of them and no new connection is opened.
+// If it fails, it returns the reason.
+func (l *policyLimiter) acquire(p *DeliveryPolicy, reused bool) (ok bool, reason string) {
+	l.Lock()
+	defer l.Unlock()
+	s, found := l.states[p.Id]
+	if !found {
+		s = &policyState{}
+		l.states[p.Id] = s
+	}
+	now := time.Now()
+	if now.Before(s.backoffUntil) {
+		return false, fmt.Sprintf("backing off after a 421 reply until %s", s.backoffUntil.Format(time.RFC3339))
+	}
+	if p.MaxConns > 0 && !reused && s.conns+smtpPool.idleCount(p.Id) >= p.MaxConns {
+		return false, fmt.Sprintf("max concurrent connections (%d) reached", p.MaxConns)
+	}
+	if now.Sub(s.windowStart) >= time.Minute {
+		s.windowStart = now
+		s.msgs = 0
+	}
+	if p.MaxMsgsPerMinute > 0 && s.msgs >= p.MaxMsgsPerMinute {
+		return false, fmt.Sprintf("max messages per minute (%d) reached", p.MaxMsgsPerMinute)
+	}
+	s.conns++
+	s.msgs++
+	return true, ""
+}
+
+// release releases the connection reserved by acquire
+// If the remote server replied 421, deliveries for policy p are suspended
+// for p.Backoff421 seconds.
+func (l *policyLimiter) release(p *DeliveryPolicy, got421 bool) {
+	l.Lock()
+	defer l.Unlock()
+	s, found := l.states[p.Id]
+	if !found {
+		return
+	}
+	if s.conns > 0 {
+		s.conns--
+	}
+	if got421 && p.Backoff421 > 0 {
+		s.backoffUntil = time.Now().Add(time.Duration(p.Backoff421) * time.Second)
+	}
+}
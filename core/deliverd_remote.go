@@ -2,9 +2,10 @@ package core
 
 import (
 	"bytes"
-	"crypto/tls"
 	"fmt"
 	"io"
+	"net/textproto"
+	"strconv"
 	"strings"
 	"time"
 
@@ -12,6 +13,51 @@ import (
 	"github.com/toorop/go-dkim"
 )
 
+// remoteBatch is a set of deliveries of the same message to recipients on
+// the same host, made in a single SMTP transaction
+type remoteBatch []*Delivery
+
+// setRemoteResponse sets the last remote SMTP response for all deliveries
+func (b remoteBatch) setRemoteResponse(code int, msg string) {
+	for _, d := range b {
+		d.RemoteSMTPresponseCode = code
+		d.RemoteSMTPresponseMsg = msg
+	}
+}
+
+// rcptTo returns the recipients of the batch
+func (b remoteBatch) rcptTo() string {
+	rcpts := []string{}
+	for _, d := range b {
+		rcpts = append(rcpts, d.QMsg.RcptTo)
+	}
+	return strings.Join(rcpts, " ")
+}
+
+func (b remoteBatch) dieOk() {
+	for _, d := range b {
+		d.dieOk()
+	}
+}
+
+func (b remoteBatch) dieTemp(msg string, logit bool) {
+	for _, d := range b {
+		d.dieTemp(msg, logit)
+	}
+}
+
+func (b remoteBatch) diePerm(msg string, logit bool) {
+	for _, d := range b {
+		d.diePerm(msg, logit)
+	}
+}
+
+func (b remoteBatch) handleSMTPError(code int, msg string) {
+	for _, d := range b {
+		d.handleSMTPError(code, msg)
+	}
+}
+
 func deliverRemote(d *Delivery) {
 	var err error
 
@@ -44,7 +90,11 @@ func deliverRemote(d *Delivery) {
 	if len(d.RemoteRoutes) == 0 {
 		d.RemoteRoutes, err = getRoutes(d.QMsg.MailFrom, d.QMsg.Host, d.QMsg.AuthUser)
 		if err != nil {
-			d.dieTemp("unable to get route to host "+d.QMsg.Host+". "+err.Error(), true)
+			if IsPermanentRouteError(err) {
+				d.diePerm("unable to get route to host "+d.QMsg.Host+". "+err.Error(), true)
+			} else {
+				d.dieTemp("unable to get route to host "+d.QMsg.Host+". "+err.Error(), true)
+			}
 			return
 		}
 	}
@@ -55,132 +105,149 @@ func deliverRemote(d *Delivery) {
 		return
 	}
 
-	// Get client
-	client, err := newSMTPClient(d, d.RemoteRoutes, Cfg.GetDeliverdRemoteTimeout())
-	if err != nil {
-		Logger.Error(fmt.Sprintf("deliverd-remote %s - %s", d.ID, err.Error()))
-		d.dieTemp(fmt.Sprintf("delverd-remote %s - %s", d.ID, err.Error()), false)
+	// MTA-STS
+	if !applyMTASTS(d) {
 		return
 	}
-	defer func() { _ = client.close() }()
-
-	d.RemoteAddr = client.RemoteAddr()
-	d.LocalAddr = client.LocalAddr()
 
-	// EHLO
-	code, msg, err := client.Hello()
-	d.RemoteSMTPresponseCode = code
+	// Delivery policy of the domain or its MX
+	policy, err := getDeliveryPolicy(d.QMsg.Host, d.RemoteRoutes)
 	if err != nil {
-		switch {
-		case code > 399 && code < 500:
-			d.dieTemp(fmt.Sprintf("deliverd-remote %s - %s - HELO failed %v - remote server reply %d %s ", d.ID, client.RemoteAddr(), err.Error(), code, msg), true)
-			return
-		case code > 499:
-			d.diePerm(fmt.Sprintf("deliverd-remote %s - %s - HELO failed %v - remote server reply %d %s ", d.ID, client.RemoteAddr(), err.Error(), code, msg), true)
+		d.dieTemp("unable to get delivery policy for host "+d.QMsg.Host+". "+err.Error(), true)
+		return
+	}
+	d.Policy = policy
+
+	// an idle client from the pool if possible, it's already counted in
+	// the connections of the policy
+	client := smtpPool.get(d)
+	reused := client != nil
+	if policy != nil {
+		if ok, reason := deliveryPolicies.acquire(policy, reused); !ok {
+			Logger.Info(fmt.Sprintf("deliverd-remote %s - delivery to %s delayed by policy %s - %s", d.ID, d.QMsg.Host, policy.Pattern, reason))
+			if reused && !smtpPool.put(client, d.QMsg.Host) {
+				_, _, _ = client.Quit()
+			}
+			d.requeue()
 			return
-		default:
-			Logger.Info(fmt.Sprintf("deliverd-remote %s - %s - HELO unexpected code, remote server reply %d %s ", d.ID, client.RemoteAddr(), code, msg))
 		}
 	}
 
-	// STARTTLS ?
-	// 2013-06-22 14:19:30.670252500 delivery 196893: deferral: Sorry_but_i_don't_understand_SMTP_response_:_local_error:_unexpected_message_/
-	// 2013-06-18 10:08:29.273083500 delivery 856840: deferral: Sorry_but_i_don't_understand_SMTP_response_:_failed_to_parse_certificate_from_server:_negative_serial_number_/
-	// https://code.google.com/p/go/issues/detail?id=3930data
-	if ok, _ := client.Extension("STARTTLS"); ok {
-		var config tls.Config
-		config.InsecureSkipVerify = Cfg.GetDeliverdRemoteTLSSkipVerify()
-		//config.ServerName = Cfg.GetMe()
-		code, msg, err = client.StartTLS(&config)
-		d.RemoteSMTPresponseCode = code
-		// Warning debug
-		//err := fmt.Errorf("fake tls error")
+	// recipients of the same message on the same host are delivered
+	// in a single transaction
+	b := remoteBatch{d}
+	if max := Cfg.GetDeliverdRemoteMaxRcptTo(); max > 1 {
+		qmsgs, err := d.QMsg.ClaimBatch(max - 1)
 		if err != nil {
-			Logger.Info(fmt.Sprintf("deliverd-remote %s - %s - TLS negociation failed %d - %s - %v .", d.ID, client.conn.RemoteAddr().String(), code, msg, err))
-			if Cfg.GetDeliverdRemoteTLSFallback() {
-				// fall back to noTLS
-				Logger.Info(fmt.Sprintf("deliverd-remote %s - %s - fallback to no TLS.", d.ID, client.conn.RemoteAddr().String()))
-				_ = client.close()
-				client, err = newSMTPClient(d, d.RemoteRoutes, Cfg.GetDeliverdRemoteTimeout())
-				if err != nil {
-					Logger.Error(fmt.Sprintf("deliverd-remote %s - fallback to no TLS failed - %s", d.ID, err.Error()))
-					d.dieTemp("unable to get client", false)
-					return
-				}
-				defer func() { _ = client.close() }()
-				code, msg, err = client.Hello()
-				if err != nil {
-					switch {
-					case code > 399 && code < 500:
-						d.dieTemp(fmt.Sprintf("deliverd-remote %s - %s - HELO failed %v - remote server reply %d %s ", d.ID, client.RemoteAddr(), err.Error(), code, msg), true)
-						return
-					case code > 499:
-						d.diePerm(fmt.Sprintf("deliverd-remote %s - %s - HELO failed %v - remote server reply %d %s ", d.ID, client.RemoteAddr(), err.Error(), code, msg), true)
-						return
-					default:
-						d.dieTemp(fmt.Sprintf("deliverd-remote %s - %s - HELO unexpected code, remote server reply %d %s ", d.ID, client.RemoteAddr(), code, msg), true)
-						return
-						//Logger.Info(fmt.Sprintf("deliverd-remote %s - %s - HELO unexpected code, remote server reply %d %s ", d.ID, client.RemoteAddr(), code, msg))
-					}
-				}
-			} else {
-				d.dieTemp(fmt.Sprintf("deliverd-remote %s - %s - TLS negociation failed %d - %s - %v .", d.ID, client.conn.RemoteAddr().String(), code, msg, err), true)
-				return
+			Logger.Error(fmt.Sprintf("deliverd-remote %s - unable to batch recipients of message queued as %s - %s", d.ID, d.QMsg.Uuid, err))
+		}
+		for i, qm := range qmsgs {
+			b = append(b, &Delivery{
+				ID:           fmt.Sprintf("%s-%d", d.ID, i+1),
+				QMsg:         qm,
+				RawData:      d.RawData,
+				QStore:       d.QStore,
+				StartAt:      d.StartAt,
+				RemoteRoutes: d.RemoteRoutes,
+				MTASTSPolicy: d.MTASTSPolicy,
+				Policy:       d.Policy,
+			})
+			Logger.Info(fmt.Sprintf("delivery-remote %s: batched recipient %s - Queue-Id: %s", d.ID, qm.RcptTo, qm.Uuid))
+		}
+	}
+
+	if policy != nil {
+		all := b
+		defer func() {
+			got421 := false
+			for _, bd := range all {
+				got421 = got421 || bd.RemoteSMTPresponseCode == 421
 			}
-		} else {
-			Logger.Info(fmt.Sprintf("deliverd-remote %s - %s - TLS negociation succeed - %s %s", d.ID, client.RemoteAddr(), client.TLSGetVersion(), client.TLSGetCipherSuite()))
+			deliveryPolicies.release(policy, got421)
+		}()
+	}
+
+	// Get client
+	var ok bool
+	if reused {
+		Logger.Info(fmt.Sprintf("deliverd-remote %s - %s - reusing pooled connection", d.ID, client.RemoteAddr()))
+	} else {
+		client, err = newSMTPClient(d, d.RemoteRoutes, Cfg.GetDeliverdRemoteTimeout())
+		if err != nil {
+			// 421 greeting
+			if tpErr, ok := err.(*textproto.Error); ok {
+				b.setRemoteResponse(tpErr.Code, tpErr.Msg)
+			}
+			Logger.Error(fmt.Sprintf("deliverd-remote %s - %s", d.ID, err.Error()))
+			b.dieTemp(fmt.Sprintf("delverd-remote %s - %s", d.ID, err.Error()), false)
+			return
 		}
 	}
+	// client is closed unless it's back in the pool
+	pooled := false
+	defer func() {
+		if !pooled && client != nil {
+			_ = client.close()
+		}
+	}()
 
-	// SMTP AUTH
-	if client.route.SmtpAuthLogin.Valid && client.route.SmtpAuthPasswd.Valid && len(client.route.SmtpAuthLogin.String) != 0 && len(client.route.SmtpAuthLogin.String) != 0 {
-		var auth DeliverdAuth
-		_, auths := client.Extension("AUTH")
-		if strings.Contains(auths, "CRAM-MD5") {
-			auth = CRAMMD5Auth(client.route.SmtpAuthLogin.String, client.route.SmtpAuthPasswd.String)
-		} else { // PLAIN
-			auth = PlainAuth("", client.route.SmtpAuthLogin.String, client.route.SmtpAuthPasswd.String, client.route.RemoteHost)
+	for _, bd := range b {
+		bd.RemoteAddr = client.RemoteAddr()
+		bd.LocalAddr = client.LocalAddr()
+	}
+
+	if !reused {
+		if client, ok = initRemoteClient(d, b, client); !ok {
+			return
 		}
-		if auth != nil {
-			_, msg, err := client.Auth(auth)
-			if err != nil {
-				errMsg := fmt.Sprintf("deliverd-remote %s - %s - AUTH failed - %s - %s", d.ID, client.RemoteAddr(), msg, err)
-				Logger.Error(errMsg)
-				d.diePerm(errMsg, false)
+	}
+
+	// SMTPUTF8 & 8BITMIME
+	var mailParams []string
+	if d.QMsg.SMTPUTF8 {
+		if ok, _ := client.Extension("SMTPUTF8"); ok {
+			mailParams = append(mailParams, "SMTPUTF8")
+		} else if !message.Is7Bit([]byte(d.QMsg.MailFrom+b.rcptTo())) || !message.Is7Bit(message.RawGetHeaders(d.RawData)) {
+			// RFC 6531 3.2: no downgrade for internationalized addresses & headers
+			errMsg := fmt.Sprintf("deliverd-remote %s - %s - message requires SMTPUTF8 which is not supported by remote server", d.ID, client.RemoteAddr())
+			Logger.Info(errMsg)
+			b.diePerm(errMsg, false)
+			return
+		}
+	}
+	if d.QMsg.Body == "8BITMIME" {
+		if ok, _ := client.Extension("8BITMIME"); ok {
+			mailParams = append(mailParams, "BODY=8BITMIME")
+		} else if !message.Is7Bit(*d.RawData) {
+			if err = message.RawDowngrade8Bit(d.RawData); err != nil {
+				errMsg := fmt.Sprintf("deliverd-remote %s - %s - remote server does not support 8BITMIME and message can't be downgraded - %s", d.ID, client.RemoteAddr(), err)
+				Logger.Info(errMsg)
+				b.diePerm(errMsg, false)
 				return
 			}
+			Logger.Info(fmt.Sprintf("deliverd-remote %s - %s - remote server does not support 8BITMIME, message downgraded to 7bit", d.ID, client.RemoteAddr()))
 		}
 	}
 
-	// MAIL FROM
-	code, msg, err = client.Mail(d.QMsg.MailFrom)
-	d.RemoteSMTPresponseCode = code
-	if err != nil {
-		errMsg := fmt.Sprintf("deliverd-remote %s - %s - MAIL FROM %s failed %s - %s", d.ID, client.RemoteAddr(), d.QMsg.MailFrom, msg, err)
-		Logger.Error(errMsg)
-		d.handleSMTPError(code, errMsg)
-		return
+	// 7BIT is the default but RFC 6152 allows to state it
+	if d.QMsg.Body == "7BIT" {
+		if ok, _ := client.Extension("8BITMIME"); ok {
+			mailParams = append(mailParams, "BODY=7BIT")
+		}
 	}
 
-	// RCPT TO
-	code, msg, err = client.Rcpt(d.QMsg.RcptTo)
-	d.RemoteSMTPresponseCode = code
-	if err != nil {
-		errMsg := fmt.Sprintf("deliverd-remote %s - %s - RCPT TO %s failed - %s - %s", d.ID, client.RemoteAddr(), d.QMsg.RcptTo, msg, err)
-		Logger.Error(errMsg)
-		d.handleSMTPError(code, errMsg)
-		return
+	// DSN: relay parameters to next hop, else we are in charge of success notification
+	remoteDSN, _ := client.Extension("DSN")
+	if remoteDSN {
+		if d.QMsg.Ret != "" {
+			mailParams = append(mailParams, "RET="+d.QMsg.Ret)
+		}
+		if d.QMsg.EnvId != "" {
+			mailParams = append(mailParams, "ENVID="+d.QMsg.EnvId)
+		}
 	}
 
-	// DATA
-	dataPipe, code, msg, err := client.Data()
-	d.RemoteSMTPresponseCode = code
-	if err != nil {
-		errMsg := fmt.Sprintf("deliverd-remote %s - %s - DATA command failed - %s - %s", d.ID, client.RemoteAddr(), msg, err)
-		Logger.Error(errMsg)
-		d.handleSMTPError(code, errMsg)
-		return
-	}
+	// message is ready before MAIL FROM so its size is known
 
 	// check if Received header needs redaction before remote delivery
 	*d.RawData = []byte(message.RedactHeaders(string(*d.RawData)))
@@ -198,7 +265,7 @@ func deliverRemote(d *Delivery) {
 			if err != nil {
 				errMsg := "deliverd-remote " + d.ID + " - unable to get DKIM config for domain " + userDomain[1] + " - " + err.Error()
 				Logger.Error(errMsg)
-				d.dieTemp(errMsg, false)
+				b.dieTemp(errMsg, false)
 				return
 			}
 			if dkc != nil {
@@ -215,34 +282,312 @@ func deliverRemote(d *Delivery) {
 		}
 	}
 
+	// SIZE (RFC 1870): don't send a message the remote server will refuse
+	if ok, param := client.Extension("SIZE"); ok {
+		size := len(*d.RawData)
+		if max, err := strconv.Atoi(strings.TrimSpace(param)); err == nil && max > 0 && size > max {
+			errMsg := fmt.Sprintf("deliverd-remote %s - %s - message size %d exceeds fixed maximum message size %d of remote server", d.ID, client.RemoteAddr(), size, max)
+			Logger.Info(errMsg)
+			b.setRemoteResponse(552, "5.3.4 message size exceeds fixed maximum message size")
+			b.diePerm(errMsg, false)
+			if pooled = smtpPool.put(client, d.QMsg.Host); !pooled {
+				_, _, _ = client.Quit()
+			}
+			return
+		}
+		mailParams = append(mailParams, "SIZE="+strconv.Itoa(size))
+	}
+
+	// RCPT TO parameters
+	rcpts := make([]rcptCmd, len(b))
+	for i, bd := range b {
+		rcpts[i].to = bd.QMsg.RcptTo
+		bd.DSNAction = "relayed"
+		if remoteDSN {
+			bd.DSNAction = ""
+			if bd.QMsg.Notify != "" {
+				rcpts[i].params = append(rcpts[i].params, "NOTIFY="+bd.QMsg.Notify)
+			}
+			if bd.QMsg.ORcpt != "" {
+				rcpts[i].params = append(rcpts[i].params, "ORCPT="+bd.QMsg.ORcpt)
+			}
+		}
+	}
+
+	// PIPELINING: MAIL FROM, RCPT TO & DATA are sent in a single group and
+	// replies are handled below as if commands were sent one by one
+	var replies []smtpReply
+	if ok, _ := client.Extension("PIPELINING"); ok {
+		if replies, err = client.Pipeline(d.QMsg.MailFrom, mailParams, rcpts); err != nil {
+			errMsg := fmt.Sprintf("deliverd-remote %s - %s - pipelined transaction failed - %s", d.ID, client.RemoteAddr(), err)
+			Logger.Error(errMsg)
+			b.dieTemp(errMsg, false)
+			return
+		}
+	}
+
+	// MAIL FROM
+	var code int
+	var msg string
+	if replies != nil {
+		code, msg, err = replies[0].result(250)
+	} else {
+		code, msg, err = client.Mail(d.QMsg.MailFrom, mailParams...)
+	}
+	b.setRemoteResponse(code, msg)
+	if err != nil {
+		errMsg := fmt.Sprintf("deliverd-remote %s - %s - MAIL FROM %s failed %s - %s", d.ID, client.RemoteAddr(), d.QMsg.MailFrom, msg, err)
+		Logger.Error(errMsg)
+		b.handleSMTPError(code, errMsg)
+		return
+	}
+
+	// RCPT TO
+	// failures are handled per recipient
+	accepted := remoteBatch{}
+	for i, bd := range b {
+		if replies != nil {
+			code, msg, err = replies[i+1].result(250, 251)
+		} else {
+			code, msg, err = client.Rcpt(rcpts[i].to, rcpts[i].params...)
+		}
+		bd.RemoteSMTPresponseCode = code
+		bd.RemoteSMTPresponseMsg = msg
+		if err != nil {
+			errMsg := fmt.Sprintf("deliverd-remote %s - %s - RCPT TO %s failed - %s - %s", bd.ID, client.RemoteAddr(), bd.QMsg.RcptTo, msg, err)
+			Logger.Error(errMsg)
+			bd.handleSMTPError(code, errMsg)
+			continue
+		}
+		accepted = append(accepted, bd)
+	}
+	if len(accepted) == 0 {
+		// a pipelined DATA must have been refused, else the connection
+		// is waiting for data and can't be reused
+		if replies != nil && replies[len(replies)-1].code == 354 {
+			return
+		}
+		if pooled = smtpPool.put(client, d.QMsg.Host); !pooled {
+			_, _, _ = client.Quit()
+		}
+		return
+	}
+	b = accepted
+
+	// DATA
+	var dataPipe *dataCloser
+	if replies != nil {
+		code, msg, err = replies[len(replies)-1].result(354)
+		if err == nil {
+			dataPipe = client.DataWriter()
+		}
+	} else {
+		dataPipe, code, msg, err = client.Data()
+	}
+	b.setRemoteResponse(code, msg)
+	if err != nil {
+		errMsg := fmt.Sprintf("deliverd-remote %s - %s - DATA command failed - %s - %s", d.ID, client.RemoteAddr(), msg, err)
+		Logger.Error(errMsg)
+		b.handleSMTPError(code, errMsg)
+		return
+	}
+
 	dataBuf := bytes.NewBuffer(*d.RawData)
 	_, err = io.Copy(dataPipe, dataBuf)
 	if err != nil {
 		errMsg := "deliverd-remote " + d.ID + " - " + client.RemoteAddr() + " - unable to copy dataBuf to dataPipe DKIM config for domain " + " - " + err.Error()
 		Logger.Error(errMsg)
-		d.dieTemp(errMsg, false)
+		b.dieTemp(errMsg, false)
 		return
 	}
 
 	_ = dataPipe.WriteCloser.Close()
 	code, msg, err = dataPipe.s.text.ReadResponse(-1)
-	d.RemoteSMTPresponseCode = code
+	b.setRemoteResponse(code, msg)
 	Logger.Info(fmt.Sprintf("deliverd-remote %s - %s - reply to DATA cmd: %d - %s - %v", d.ID, client.RemoteAddr(), code, msg, err))
 	if err != nil {
 		errMsg := fmt.Sprintf("deliverd-remote %s - %s - DATA command failed - %s - %s", d.ID, client.RemoteAddr(), msg, err)
 		Logger.Error(errMsg)
-		d.dieTemp(errMsg, false)
+		b.dieTemp(errMsg, false)
 		return
 	}
 
 	if code != 250 {
 		errMsg := fmt.Sprintf("deliverd-remote %s - %s - DATA command failed - %d - %s", d.ID, client.RemoteAddr(), code, msg)
 		Logger.Error(errMsg)
-		d.handleSMTPError(code, errMsg)
+		b.handleSMTPError(code, errMsg)
 		return
 	}
 
-	// Bye
-	_, _, _ = client.Quit()
-	d.dieOk()
+	// Keep connection for next message or bye
+	if pooled = smtpPool.put(client, d.QMsg.Host); !pooled {
+		_, _, _ = client.Quit()
+	}
+	b.dieOk()
+}
+
+// initRemoteClient sends EHLO, STARTTLS and AUTH commands to a new
+// remote client. On TLS failure with fallback enabled, a new client is
+// returned. If it returns false, deliveries of batch b have been handled.
+func initRemoteClient(d *Delivery, b remoteBatch, client *smtpClient) (*smtpClient, bool) {
+	// EHLO
+	code, msg, err := client.Hello()
+	b.setRemoteResponse(code, msg)
+	if err != nil {
+		switch {
+		case code > 399 && code < 500:
+			b.dieTemp(fmt.Sprintf("deliverd-remote %s - %s - HELO failed %v - remote server reply %d %s ", d.ID, client.RemoteAddr(), err.Error(), code, msg), true)
+			return client, false
+		case code > 499:
+			b.diePerm(fmt.Sprintf("deliverd-remote %s - %s - HELO failed %v - remote server reply %d %s ", d.ID, client.RemoteAddr(), err.Error(), code, msg), true)
+			return client, false
+		default:
+			Logger.Info(fmt.Sprintf("deliverd-remote %s - %s - HELO unexpected code, remote server reply %d %s ", d.ID, client.RemoteAddr(), code, msg))
+		}
+	}
+
+	// DANE
+	if Cfg.GetDeliverdRemoteDANE() || d.daneRequired() {
+		// NXDOMAIN and NODATA are not errors, other failures could hide
+		// TLSA records (RFC 7672 2.2)
+		if err = client.lookupTLSA(); err != nil {
+			b.dieTemp(fmt.Sprintf("deliverd-remote %s - %s - TLSA lookup for %s failed - %s", d.ID, client.RemoteAddr(), client.route.RemoteHost, err), true)
+			return client, false
+		}
+		if d.daneRequired() && len(client.daneRecords) == 0 {
+			b.dieTemp(fmt.Sprintf("deliverd-remote %s - %s - DANE required but %s has no DNSSEC signed TLSA records", d.ID, client.RemoteAddr(), client.route.RemoteHost), true)
+			return client, false
+		}
+	}
+
+	// MTA-STS, DANE or route TLS policy: TLS required, without fallback
+	mtastsEnforced := d.mtastsEnforced()
+	routeTLSPolicy := client.route.tlsPolicy()
+	verifyRequired := mtastsEnforced || client.route.tlsVerifyRequired()
+	tlsRequired := mtastsEnforced || len(client.daneRecords) != 0 || client.route.tlsRequired()
+	serverName := strings.TrimSuffix(client.route.RemoteHost, ".")
+	roots, err := client.route.tlsRootCAs()
+	if err != nil {
+		b.dieTemp(fmt.Sprintf("deliverd-remote %s - %s - %s", d.ID, client.RemoteAddr(), err), true)
+		return client, false
+	}
+	startTLS, _ := client.Extension("STARTTLS")
+
+	// STARTTLS ?
+	// 2013-06-22 14:19:30.670252500 delivery 196893: deferral: Sorry_but_i_don't_understand_SMTP_response_:_local_error:_unexpected_message_/
+	// 2013-06-18 10:08:29.273083500 delivery 856840: deferral: Sorry_but_i_don't_understand_SMTP_response_:_failed_to_parse_certificate_from_server:_negative_serial_number_/
+	// https://code.google.com/p/go/issues/detail?id=3930data
+	if client.tls {
+		// implicit TLS
+		Logger.Info(fmt.Sprintf("deliverd-remote %s - %s - implicit TLS - %s %s", d.ID, client.RemoteAddr(), client.TLSGetVersion(), client.TLSGetCipherSuite()))
+		err = client.verifyTLS(serverName, roots)
+		client.tlsVerified = err == nil
+		if verifyRequired && !client.tlsVerified {
+			b.dieTemp(fmt.Sprintf("deliverd-remote %s - %s - certificate of %s can't be verified but route requires it - %v", d.ID, client.RemoteAddr(), serverName, err), true)
+			return client, false
+		}
+	} else if routeTLSPolicy == RouteTLSNone && !tlsRequired {
+		Logger.Info(fmt.Sprintf("deliverd-remote %s - %s - TLS disabled by route policy", d.ID, client.RemoteAddr()))
+	} else if startTLS {
+		config, err := client.route.tlsConfig(Cfg.GetDeliverdRemoteTLSSkipVerify() && !verifyRequired)
+		if err != nil {
+			b.dieTemp(fmt.Sprintf("deliverd-remote %s - %s - %s", d.ID, client.RemoteAddr(), err), true)
+			return client, false
+		}
+		code, msg, err = client.StartTLS(config)
+		b.setRemoteResponse(code, msg)
+		// Warning debug
+		//err := fmt.Errorf("fake tls error")
+		if err != nil {
+			Logger.Info(fmt.Sprintf("deliverd-remote %s - %s - TLS negociation failed %d - %s - %v .", d.ID, client.conn.RemoteAddr().String(), code, msg, err))
+			if code == 220 || code == 0 {
+				d.recordTLSResult(client, serverName, tlsRptResultType(err))
+			} else {
+				d.recordTLSResult(client, serverName, tlsRptStarttlsNotSupported)
+			}
+			if Cfg.GetDeliverdRemoteTLSFallback() && !tlsRequired {
+				// fall back to noTLS
+				Logger.Info(fmt.Sprintf("deliverd-remote %s - %s - fallback to no TLS.", d.ID, client.conn.RemoteAddr().String()))
+				_ = client.close()
+				client, err = newSMTPClient(d, d.RemoteRoutes, Cfg.GetDeliverdRemoteTimeout())
+				if err != nil {
+					Logger.Error(fmt.Sprintf("deliverd-remote %s - fallback to no TLS failed - %s", d.ID, err.Error()))
+					b.dieTemp("unable to get client", false)
+					return client, false
+				}
+				code, msg, err = client.Hello()
+				if err != nil {
+					switch {
+					case code > 399 && code < 500:
+						b.dieTemp(fmt.Sprintf("deliverd-remote %s - %s - HELO failed %v - remote server reply %d %s ", d.ID, client.RemoteAddr(), err.Error(), code, msg), true)
+						return client, false
+					case code > 499:
+						b.diePerm(fmt.Sprintf("deliverd-remote %s - %s - HELO failed %v - remote server reply %d %s ", d.ID, client.RemoteAddr(), err.Error(), code, msg), true)
+						return client, false
+					default:
+						b.dieTemp(fmt.Sprintf("deliverd-remote %s - %s - HELO unexpected code, remote server reply %d %s ", d.ID, client.RemoteAddr(), code, msg), true)
+						return client, false
+						//Logger.Info(fmt.Sprintf("deliverd-remote %s - %s - HELO unexpected code, remote server reply %d %s ", d.ID, client.RemoteAddr(), code, msg))
+					}
+				}
+			} else {
+				b.dieTemp(fmt.Sprintf("deliverd-remote %s - %s - TLS negociation failed %d - %s - %v .", d.ID, client.conn.RemoteAddr().String(), code, msg, err), true)
+				return client, false
+			}
+		} else {
+			Logger.Info(fmt.Sprintf("deliverd-remote %s - %s - TLS negociation succeed - %s %s", d.ID, client.RemoteAddr(), client.TLSGetVersion(), client.TLSGetCipherSuite()))
+			if client.daneVerified {
+				Logger.Info(fmt.Sprintf("deliverd-remote %s - %s - certificate verified with DANE TLSA records", d.ID, client.RemoteAddr()))
+				client.tlsVerified = true
+				d.recordTLSResult(client, serverName, tlsRptSuccess)
+			} else if err = client.verifyTLS(serverName, roots); err == nil {
+				client.tlsVerified = true
+				d.recordTLSResult(client, serverName, tlsRptSuccess)
+			} else if d.MTASTSPolicy != nil {
+				Logger.Info(fmt.Sprintf("deliverd-remote %s - %s - certificate of %s doesn't satisfy MTA-STS policy of %s (mode %s) - %s", d.ID, client.RemoteAddr(), serverName, d.QMsg.Host, d.MTASTSPolicy.Mode, err))
+				d.recordTLSResult(client, serverName, tlsRptResultType(err))
+			} else {
+				d.recordTLSResult(client, serverName, tlsRptSuccess)
+			}
+			if client.route.tlsVerifyRequired() && !client.tlsVerified {
+				b.dieTemp(fmt.Sprintf("deliverd-remote %s - %s - certificate of %s can't be verified but route requires it - %v", d.ID, client.RemoteAddr(), serverName, err), true)
+				return client, false
+			}
+		}
+	} else if len(client.daneRecords) != 0 {
+		d.recordTLSResult(client, serverName, tlsRptStarttlsNotSupported)
+		b.dieTemp(fmt.Sprintf("deliverd-remote %s - %s - STARTTLS not offered but %s has TLSA records", d.ID, client.RemoteAddr(), client.route.RemoteHost), true)
+		return client, false
+	} else if d.MTASTSPolicy != nil {
+		Logger.Info(fmt.Sprintf("deliverd-remote %s - %s - STARTTLS not offered but required by MTA-STS policy of %s (mode %s)", d.ID, client.RemoteAddr(), d.QMsg.Host, d.MTASTSPolicy.Mode))
+		d.recordTLSResult(client, serverName, tlsRptStarttlsNotSupported)
+		if mtastsEnforced {
+			b.dieTemp(fmt.Sprintf("deliverd-remote %s - %s - STARTTLS not offered but required by MTA-STS policy of %s", d.ID, client.RemoteAddr(), d.QMsg.Host), false)
+			return client, false
+		}
+	} else if client.route.tlsRequired() {
+		b.dieTemp(fmt.Sprintf("deliverd-remote %s - %s - STARTTLS not offered but required by route TLS policy (%s)", d.ID, client.RemoteAddr(), routeTLSPolicy), true)
+		return client, false
+	}
+
+	// SMTP AUTH
+	if client.route.SmtpAuthLogin.Valid && client.route.SmtpAuthPasswd.Valid && len(client.route.SmtpAuthLogin.String) != 0 && len(client.route.SmtpAuthLogin.String) != 0 {
+		var auth DeliverdAuth
+		_, auths := client.Extension("AUTH")
+		if strings.Contains(auths, "CRAM-MD5") {
+			auth = CRAMMD5Auth(client.route.SmtpAuthLogin.String, client.route.SmtpAuthPasswd.String)
+		} else { // PLAIN
+			auth = PlainAuth("", client.route.SmtpAuthLogin.String, client.route.SmtpAuthPasswd.String, client.route.RemoteHost)
+		}
+		if auth != nil {
+			_, msg, err := client.Auth(auth)
+			if err != nil {
+				errMsg := fmt.Sprintf("deliverd-remote %s - %s - AUTH failed - %s - %s", d.ID, client.RemoteAddr(), msg, err)
+				Logger.Error(errMsg)
+				b.diePerm(errMsg, false)
+				return client, false
+			}
+		}
+	}
+	return client, true
 }
@@ -0,0 +1,187 @@
+package core
+
+import (
+	"errors"
+	"math"
+	"math/rand"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// NSQMaxReqTimeout is the max requeue delay of nsqd, longer delays are
+// shortened to it by nsqd
+const NSQMaxReqTimeout = time.Hour
+
+// retryPolicy represents the retry schedule of deferred deliveries
+type retryPolicy struct {
+	BaseInterval int     // seconds before the first retry
+	Backoff      float64 // exponential base
+	Jitter       int     // random variation of the interval in percent
+	MaxInterval  int     // max seconds between two retries
+	Lifetime     int     // minutes in queue before giving up
+}
+
+// retryOverride overrides some parameters of the retry policy for
+// a recipient domain or a reply class
+type retryOverride struct {
+	selector string
+	isReply  bool
+	params   map[string]string
+}
+
+// isReplySelector returns true if s is a SMTP reply code (eg 421) or
+// an enhanced status code class (eg 4.2.2 or 4.7)
+func isReplySelector(s string) bool {
+	if _, err := strconv.Atoi(s); err == nil && len(s) == 3 {
+		return true
+	}
+	return enhancedStatusCodeRe.MatchString(s + ".0")
+}
+
+// parseRetryOverrides parses deliverd_retry_overrides
+// SELECTOR:key=value,key=value;SELECTOR:...
+func parseRetryOverrides(raw string) (overrides []retryOverride, err error) {
+	if raw == "" || raw == "_" {
+		return
+	}
+	for _, o := range strings.Split(raw, ";") {
+		o = strings.TrimSpace(o)
+		if o == "" {
+			continue
+		}
+		p := strings.Index(o, ":")
+		if p < 1 {
+			return nil, errors.New("bad retry override " + o + ", SELECTOR:key=value,... expected")
+		}
+		override := retryOverride{
+			selector: strings.ToLower(o[:p]),
+			params:   make(map[string]string),
+		}
+		override.isReply = isReplySelector(override.selector)
+		if _, err = path.Match(override.selector, ""); err != nil {
+			return nil, errors.New("bad retry override selector " + override.selector + " - " + err.Error())
+		}
+		for _, kv := range strings.Split(o[p+1:], ",") {
+			parts := strings.SplitN(strings.TrimSpace(kv), "=", 2)
+			if len(parts) != 2 {
+				return nil, errors.New("bad retry override parameter " + kv)
+			}
+			key, value := strings.ToLower(parts[0]), parts[1]
+			switch key {
+			case "base", "jitter", "max", "lifetime":
+				if v, err := strconv.Atoi(value); err != nil || v < 0 {
+					return nil, errors.New("bad value " + value + " for retry override parameter " + key)
+				} else if key == "max" && v > int(NSQMaxReqTimeout.Seconds()) {
+					return nil, errors.New("bad value " + value + " for retry override parameter max, must be at most " + strconv.Itoa(int(NSQMaxReqTimeout.Seconds())))
+				}
+			case "backoff":
+				if v, err := strconv.ParseFloat(value, 64); err != nil || v < 1 {
+					return nil, errors.New("bad value " + value + " for retry override parameter " + key)
+				}
+			default:
+				return nil, errors.New("unknown retry override parameter " + key)
+			}
+			override.params[key] = value
+		}
+		overrides = append(overrides, override)
+	}
+	return
+}
+
+// apply sets the parameters of override o on policy p
+// values have been checked by parseRetryOverrides
+func (o retryOverride) apply(p *retryPolicy) {
+	for key, value := range o.params {
+		switch key {
+		case "base":
+			p.BaseInterval, _ = strconv.Atoi(value)
+		case "backoff":
+			p.Backoff, _ = strconv.ParseFloat(value, 64)
+		case "jitter":
+			p.Jitter, _ = strconv.Atoi(value)
+		case "max":
+			p.MaxInterval, _ = strconv.Atoi(value)
+		case "lifetime":
+			p.Lifetime, _ = strconv.Atoi(value)
+		}
+	}
+}
+
+// matchReply returns true if the reply code or its enhanced status
+// code belongs to the class of override o
+func (o retryOverride) matchReply(code int, msg string) bool {
+	if code == 0 {
+		return false
+	}
+	if !strings.Contains(o.selector, ".") {
+		return o.selector == strconv.Itoa(code)
+	}
+	status := enhancedStatusCodeRe.FindString(strings.TrimSpace(msg))
+	return status != "" && (status == o.selector || strings.HasPrefix(status, o.selector+"."))
+}
+
+// getRetryPolicy returns the retry policy for a delivery to host whose
+// last remote reply was code msg.
+// Domain overrides are applied first, then reply class overrides.
+func getRetryPolicy(host string, code int, msg string) retryPolicy {
+	p := retryPolicy{
+		BaseInterval: Cfg.GetDeliverdRetryBaseInterval(),
+		Backoff:      Cfg.GetDeliverdRetryBackoff(),
+		Jitter:       Cfg.GetDeliverdRetryJitter(),
+		MaxInterval:  Cfg.GetDeliverdRetryMaxInterval(),
+		Lifetime:     Cfg.GetDeliverdQueueLifetime(),
+	}
+	overrides, err := parseRetryOverrides(Cfg.GetDeliverdRetryOverrides())
+	if err != nil {
+		Logger.Error("deliverd: bad retry overrides - " + err.Error())
+		return p
+	}
+	host = strings.ToLower(host)
+	for _, o := range overrides {
+		if o.isReply {
+			continue
+		}
+		if ok, _ := path.Match(o.selector, host); ok {
+			o.apply(&p)
+			break
+		}
+	}
+	for _, o := range overrides {
+		if o.isReply && o.matchReply(code, msg) {
+			o.apply(&p)
+			break
+		}
+	}
+	return p
+}
+
+// nextInterval returns the delay before the next attempt after failures
+// consecutive failed attempts
+// The delay, jitter included, is shorter than NSQMaxReqTimeout.
+func (p retryPolicy) nextInterval(failures uint32) time.Duration {
+	exp := 0.0
+	if failures > 0 {
+		exp = float64(failures - 1)
+	}
+	interval := float64(p.BaseInterval) * math.Pow(p.Backoff, exp)
+	if p.MaxInterval > 0 && interval > float64(p.MaxInterval) {
+		interval = float64(p.MaxInterval)
+	}
+	limit := NSQMaxReqTimeout.Seconds() - 1
+	if p.Jitter > 0 {
+		limit /= 1 + float64(p.Jitter)/100
+	}
+	if interval > limit {
+		interval = limit
+	}
+	if p.Jitter > 0 {
+		jitter := interval * float64(p.Jitter) / 100
+		interval += jitter * (2*rand.Float64() - 1)
+	}
+	if interval < 1 {
+		interval = 1
+	}
+	return time.Duration(interval * float64(time.Second))
+}
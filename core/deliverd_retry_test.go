@@ -0,0 +1,104 @@
+package core
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_parseRetryOverrides(t *testing.T) {
+	tests := []struct {
+		s         string
+		overrides int
+		valid     bool
+	}{
+		{"", 0, true},
+		{"_", 0, true},
+		{"gmail.com:base=300,max=3600", 1, true},
+		{"*.example.com:backoff=1.5; 421:jitter=0 ;4.7.1:lifetime=60", 3, true},
+		{"example.com:max=3601", 0, false},
+		{"example.com:max=-1", 0, false},
+		{"example.com:backoff=0.5", 0, false},
+		{"example.com:base=x", 0, false},
+		{"example.com:delay=10", 0, false},
+		{"example.com:base", 0, false},
+		{"example.com", 0, false},
+		{":base=10", 0, false},
+		{"[example.com:base=10", 0, false},
+	}
+	for _, test := range tests {
+		overrides, err := parseRetryOverrides(test.s)
+		if !test.valid {
+			assert.Error(t, err, test.s)
+			continue
+		}
+		assert.NoError(t, err, test.s)
+		assert.Equal(t, test.overrides, len(overrides), test.s)
+	}
+}
+
+func Test_nextInterval(t *testing.T) {
+	tests := []struct {
+		policy   retryPolicy
+		failures uint32
+		min, max time.Duration
+	}{
+		{retryPolicy{BaseInterval: 60, Backoff: 2}, 0, 60 * time.Second, 60 * time.Second},
+		{retryPolicy{BaseInterval: 60, Backoff: 2}, 1, 60 * time.Second, 60 * time.Second},
+		{retryPolicy{BaseInterval: 60, Backoff: 2}, 3, 240 * time.Second, 240 * time.Second},
+		{retryPolicy{BaseInterval: 60, Backoff: 2, MaxInterval: 300}, 10, 300 * time.Second, 300 * time.Second},
+		{retryPolicy{BaseInterval: 60, Backoff: 2, Jitter: 20}, 2, 96 * time.Second, 144 * time.Second},
+		// capped under the nsqd max requeue timeout, jitter included
+		{retryPolicy{BaseInterval: 60, Backoff: 2}, 20, NSQMaxReqTimeout - time.Second, NSQMaxReqTimeout - time.Second},
+		{retryPolicy{BaseInterval: 60, Backoff: 2, MaxInterval: 3600, Jitter: 20}, 20, 2399 * time.Second, NSQMaxReqTimeout - time.Second},
+		{retryPolicy{BaseInterval: 60, Backoff: 2, Jitter: 100}, 20, 1 * time.Second, NSQMaxReqTimeout - time.Second},
+		{retryPolicy{BaseInterval: 0, Backoff: 2}, 1, time.Second, time.Second},
+	}
+	for i, test := range tests {
+		// jitter is random
+		for n := 0; n < 100; n++ {
+			d := test.policy.nextInterval(test.failures)
+			assert.True(t, d >= test.min && d <= test.max, i, d)
+		}
+	}
+}
+
+func Test_getRetryPolicy(t *testing.T) {
+	Cfg = &Config{}
+	Cfg.cfg.DeliverdRetryBaseInterval = 60
+	Cfg.cfg.DeliverdRetryBackoff = "2"
+	Cfg.cfg.DeliverdRetryJitter = 20
+	Cfg.cfg.DeliverdRetryMaxInterval = 3600
+	Cfg.cfg.DeliverdQueueLifetime = 10080
+	Cfg.cfg.DeliverdRetryOverrides = "*.example.com:base=10;example.com:base=20,lifetime=5;4.7:base=30,jitter=0;421:base=40"
+
+	tests := []struct {
+		host     string
+		code     int
+		msg      string
+		base     int
+		jitter   int
+		lifetime int
+	}{
+		{"example.org", 0, "", 60, 20, 10080},
+		{"mx.Example.com", 0, "", 10, 20, 10080},
+		// first matching domain only
+		{"example.com", 0, "", 20, 20, 5},
+		// reply class after domain
+		{"example.com", 451, "4.7.1 greylisted", 30, 0, 5},
+		{"example.org", 451, "4.7.1 greylisted", 30, 0, 10080},
+		// not an enhanced status code
+		{"example.org", 451, "4.7 greylisted", 60, 20, 10080},
+		{"example.org", 451, "4.2.1 mailbox busy", 60, 20, 10080},
+		{"example.com", 421, "4.4.2 too many connections", 40, 20, 5},
+		{"example.org", 0, "4.7.1 no reply code", 60, 20, 10080},
+	}
+	for i, test := range tests {
+		p := getRetryPolicy(test.host, test.code, test.msg)
+		assert.Equal(t, test.base, p.BaseInterval, i)
+		assert.Equal(t, test.jitter, p.Jitter, i)
+		assert.Equal(t, test.lifetime, p.Lifetime, i)
+		assert.Equal(t, 3600, p.MaxInterval, i)
+	}
+}
@@ -2,6 +2,7 @@ package core
 
 import (
 	//"errors"
+	"context"
 	"database/sql"
 	"errors"
 	"math/rand"
@@ -22,6 +23,11 @@ type Route struct {
 	SmtpAuthPasswd sql.NullString
 	MailFrom       sql.NullString
 	User           sql.NullString
+	TlsPolicy      sql.NullString // none, opportunistic (default), require, require-verified, implicit
+	TlsClientCert  sql.NullString // client certificate (PEM file)
+	TlsClientKey   sql.NullString // key of the client certificate (PEM file)
+	TlsCaBundle    sql.NullString // CA bundle (PEM file) trusted instead of system roots
+	FromMX         bool           `sql:"-"` // route from the MX of the destination, not from DB
 }
 
 // routes represents all the routes allowed to access remote MX
@@ -42,7 +48,7 @@ func GetAllRoutes() (routes []Route, err error) {
 }
 
 // AddRoute add a new route
-func AddRoute(host, localIp, remoteHost string, remotePort, priority int, user, mailFrom, smtpAuthLogin, smtpAuthPasswd string) error {
+func AddRoute(host, localIp, remoteHost string, remotePort, priority int, user, mailFrom, smtpAuthLogin, smtpAuthPasswd, tlsPolicy, tlsClientCert, tlsClientKey, tlsCaBundle string) error {
 	var err error
 	route := new(Route)
 
@@ -56,6 +62,13 @@ func AddRoute(host, localIp, remoteHost string, remotePort, priority int, user,
 	if strings.Index(localIp, "&") != -1 && strings.Index(localIp, "|") != -1 {
 		return errors.New("mixed & and | are not allowed in routes")
 	}
+	if strings.TrimSpace(localIp) != "" {
+		for _, ipStr := range strings.FieldsFunc(localIp, func(r rune) bool { return r == '&' || r == '|' }) {
+			if _, _, err = parseLocalIP(ipStr); err != nil {
+				return err
+			}
+		}
+	}
 	if err = route.LocalIp.Scan(strings.TrimSpace(localIp)); err != nil {
 		return err
 	}
@@ -112,6 +125,45 @@ func AddRoute(host, localIp, remoteHost string, remotePort, priority int, user,
 		}
 	}
 
+	// TLS policy
+	tlsPolicy = strings.ToLower(strings.TrimSpace(tlsPolicy))
+	if err = checkRouteTLSPolicy(tlsPolicy); err != nil {
+		return err
+	}
+	if tlsPolicy != "" {
+		if err = route.TlsPolicy.Scan(tlsPolicy); err != nil {
+			return err
+		}
+	}
+
+	// TLS client certificate
+	tlsClientCert = strings.TrimSpace(tlsClientCert)
+	tlsClientKey = strings.TrimSpace(tlsClientKey)
+	if (tlsClientCert == "") != (tlsClientKey == "") {
+		return errors.New("TLS client certificate and key must be both set")
+	}
+	if tlsClientCert != "" {
+		if err = route.TlsClientCert.Scan(tlsClientCert); err != nil {
+			return err
+		}
+		if err = route.TlsClientKey.Scan(tlsClientKey); err != nil {
+			return err
+		}
+	}
+
+	// TLS CA bundle
+	tlsCaBundle = strings.TrimSpace(tlsCaBundle)
+	if tlsCaBundle != "" {
+		if err = route.TlsCaBundle.Scan(tlsCaBundle); err != nil {
+			return err
+		}
+	}
+
+	// check certificate files
+	if _, err = route.tlsConfig(false); err != nil {
+		return err
+	}
+
 	return DB.Create(route).Error
 }
 
@@ -123,6 +175,69 @@ func DelRoute(id int64) error {
 	return DB.Delete(&r).Error
 }
 
+// ErrNullMX is returned when the destination domain publishes a null MX
+// and doesn't accept mail (RFC 7505)
+var ErrNullMX = errors.New("domain does not accept mail (null MX)")
+
+// routePermError represents a permanent route resolution failure: the
+// message must be bounced instead of being retried
+type routePermError struct {
+	error
+}
+
+// IsPermanentRouteError returns true if err is a permanent route
+// resolution failure (null MX, non existent domain)
+func IsPermanentRouteError(err error) bool {
+	_, ok := err.(routePermError)
+	return ok
+}
+
+// getMXRoutes returns the routes to the MX of host
+// If host has no MX, host itself is used (implicit MX, RFC 5321 5.1).
+func getMXRoutes(host string) (routes []Route, err error) {
+	mxs, err := DNS.LookupMX(context.Background(), host)
+	if err != nil {
+		// no MX records or NXDOMAIN, a SERVFAIL or a timeout is temporary
+		if dnsErr, ok := err.(*net.DNSError); !ok || !dnsErr.IsNotFound {
+			return nil, err
+		}
+		mxs = nil
+	}
+
+	// null MX
+	if len(mxs) == 1 && mxs[0].Host == "." {
+		return nil, routePermError{ErrNullMX}
+	}
+	for _, mx := range mxs {
+		if mx.Host == "." {
+			continue
+		}
+		routes = append(routes, Route{
+			RemoteHost: mx.Host,
+			RemotePort: sql.NullInt64{25, true},
+			Priority:   sql.NullInt64{int64(mx.Pref), true},
+			FromMX:     true,
+		})
+	}
+	if len(routes) != 0 {
+		return routes, nil
+	}
+
+	// implicit MX
+	if _, err = DNS.LookupIPAddr(context.Background(), host); err != nil {
+		if dnsErr, ok := err.(*net.DNSError); ok && dnsErr.IsNotFound {
+			return nil, routePermError{errors.New("no MX nor A/AAAA record found for " + host)}
+		}
+		return nil, err
+	}
+	return []Route{{
+		RemoteHost: host,
+		RemotePort: sql.NullInt64{25, true},
+		Priority:   sql.NullInt64{0, true},
+		FromMX:     true,
+	}}, nil
+}
+
 // getRoutes returns matchingRoutes for the specified destination host
 func getRoutes(mailFrom, host, authUser string) (routes []Route, err error) {
 	// Get mail from domain
@@ -215,16 +330,8 @@ func getRoutes(mailFrom, host, authUser string) (routes []Route, err error) {
 
 	// Sinon on prends les MX
 	if len(routes) == 0 {
-		mxs, err := net.LookupMX(host)
-		if err != nil {
-			return routes, err
-		}
-		for _, mx := range mxs {
-			routes = append(routes, Route{
-				RemoteHost: mx.Host,
-				RemotePort: sql.NullInt64{25, true},
-				Priority:   sql.NullInt64{int64(mx.Pref), true},
-			})
+		if routes, err = getMXRoutes(host); err != nil {
+			return
 		}
 	}
 
@@ -232,7 +339,7 @@ func getRoutes(mailFrom, host, authUser string) (routes []Route, err error) {
 	for i, route := range routes {
 		//Log.Debug(route)
 		if !route.LocalIp.Valid || route.LocalIp.String == "" {
-			routes[i].LocalIp.String = Cfg.GetLocalIps()
+			routes[i].LocalIp.String = defaultLocalIps()
 		}
 
 		// Si il n'y a pas de port pour le remote host
@@ -0,0 +1,86 @@
+package core
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+	"strings"
+)
+
+// TLS policies of routes
+const (
+	RouteTLSNone            = "none"             // no STARTTLS
+	RouteTLSOpportunistic   = "opportunistic"    // STARTTLS if offered (default)
+	RouteTLSRequire         = "require"          // STARTTLS required, certificate not verified
+	RouteTLSRequireVerified = "require-verified" // STARTTLS required, certificate verified
+	RouteTLSImplicit        = "implicit"         // TLS from connection (SMTPS, port 465)
+)
+
+// checkRouteTLSPolicy returns an error if policy is not a TLS policy
+func checkRouteTLSPolicy(policy string) error {
+	switch policy {
+	case "", RouteTLSNone, RouteTLSOpportunistic, RouteTLSRequire, RouteTLSRequireVerified, RouteTLSImplicit:
+		return nil
+	}
+	return errors.New("bad TLS policy " + policy + ", must be one of none, opportunistic, require, require-verified or implicit")
+}
+
+// tlsPolicy returns the TLS policy of the route
+func (r *Route) tlsPolicy() string {
+	if !r.TlsPolicy.Valid || r.TlsPolicy.String == "" {
+		return RouteTLSOpportunistic
+	}
+	return r.TlsPolicy.String
+}
+
+// tlsRequired returns true if the route requires STARTTLS
+func (r *Route) tlsRequired() bool {
+	policy := r.tlsPolicy()
+	return policy == RouteTLSRequire || policy == RouteTLSRequireVerified
+}
+
+// tlsVerifyRequired returns true if the certificate of the remote host
+// must be verified: the policy is require-verified or a CA bundle is pinned
+func (r *Route) tlsVerifyRequired() bool {
+	return r.tlsPolicy() == RouteTLSRequireVerified || (r.TlsCaBundle.Valid && r.TlsCaBundle.String != "")
+}
+
+// tlsConfig returns the TLS config of connections to the remote host of
+// the route, with its client certificate and its CA bundle if any
+func (r *Route) tlsConfig(skipVerify bool) (*tls.Config, error) {
+	config := &tls.Config{
+		ServerName:         strings.TrimSuffix(r.RemoteHost, "."),
+		InsecureSkipVerify: skipVerify,
+	}
+	if r.TlsClientCert.Valid && r.TlsClientCert.String != "" {
+		cert, err := tls.LoadX509KeyPair(r.TlsClientCert.String, r.TlsClientKey.String)
+		if err != nil {
+			return nil, errors.New("unable to load client certificate of route - " + err.Error())
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	roots, err := r.tlsRootCAs()
+	if err != nil {
+		return nil, err
+	}
+	config.RootCAs = roots
+	return config, nil
+}
+
+// tlsRootCAs returns the pinned CA bundle of the route, nil if the
+// system roots are used
+func (r *Route) tlsRootCAs() (*x509.CertPool, error) {
+	if !r.TlsCaBundle.Valid || r.TlsCaBundle.String == "" {
+		return nil, nil
+	}
+	pem, err := ioutil.ReadFile(r.TlsCaBundle.String)
+	if err != nil {
+		return nil, errors.New("unable to read CA bundle of route - " + err.Error())
+	}
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM(pem) {
+		return nil, errors.New("no certificate found in CA bundle " + r.TlsCaBundle.String)
+	}
+	return roots, nil
+}
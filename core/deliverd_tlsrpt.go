@@ -0,0 +1,347 @@
+package core
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha1"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// TLS-RPT result types (RFC 8460 4.3)
+const (
+	tlsRptSuccess                 = ""
+	tlsRptStarttlsNotSupported    = "starttls-not-supported"
+	tlsRptCertificateHostMismatch = "certificate-host-mismatch"
+	tlsRptCertificateExpired      = "certificate-expired"
+	tlsRptCertificateNotTrusted   = "certificate-not-trusted"
+	tlsRptValidationFailure       = "validation-failure"
+)
+
+// TLSRptResult counts outgoing TLS sessions of a day for the TLS reports
+// of the recipient domains (RFC 8460)
+type TLSRptResult struct {
+	Id             int64
+	AggregationKey string `sql:"type:char(40);unique_index"` // hash of the other fields but Count
+	Day            string // 2006-01-02 UTC
+	Domain         string // policy domain
+	PolicyType     string // sts, tlsa or no-policy-found
+	PolicyString   string `sql:"type:text"` // policy lines separated by \n
+	MXHost         string
+	ResultType     string // empty for success
+	SendingIP      string
+	ReceivingIP    string
+	Count          int64
+}
+
+// recordTLSResult counts a TLS session (or a failure before the session)
+// to the MX mxHost of the recipient domain of d
+func (d *Delivery) recordTLSResult(client *smtpClient, mxHost, resultType string) {
+	if !Cfg.GetDeliverdTLSRpt() {
+		return
+	}
+	r := TLSRptResult{
+		Day:        time.Now().UTC().Format("2006-01-02"),
+		Domain:     strings.ToLower(d.QMsg.Host),
+		PolicyType: "no-policy-found",
+		MXHost:     strings.TrimSuffix(mxHost, "."),
+		ResultType: resultType,
+	}
+	if client != nil {
+		if len(client.daneRecords) != 0 {
+			r.PolicyType = "tlsa"
+			lines := []string{}
+			for _, t := range client.daneRecords {
+				lines = append(lines, t.String())
+			}
+			r.PolicyString = strings.Join(lines, "\n")
+		}
+		if resultType != tlsRptSuccess {
+			r.SendingIP, _, _ = net.SplitHostPort(client.LocalAddr())
+			r.ReceivingIP, _, _ = net.SplitHostPort(client.RemoteAddr())
+		}
+	}
+	if r.PolicyType == "no-policy-found" && d.MTASTSPolicy != nil {
+		r.PolicyType = "sts"
+		lines := []string{"version: STSv1", "mode: " + d.MTASTSPolicy.Mode}
+		for _, mx := range d.MTASTSPolicy.MX {
+			lines = append(lines, "mx: "+mx)
+		}
+		lines = append(lines, fmt.Sprintf("max_age: %d", d.MTASTSPolicy.MaxAge))
+		r.PolicyString = strings.Join(lines, "\n")
+	}
+	if resultType == tlsRptSuccess {
+		r.MXHost = ""
+	}
+
+	r.AggregationKey = aggregationKey(r.Day, r.Domain, r.PolicyType, r.PolicyString, r.MXHost, r.ResultType, r.SendingIP, r.ReceivingIP)
+	r.Count = 1
+	if err := countResult(TLSRptResult{}, r.AggregationKey, &r); err != nil {
+		Logger.Error("deliverd-remote " + d.ID + " - unable to record TLS result for TLS-RPT - " + err.Error())
+	}
+}
+
+// aggregationKey returns the key of a report result from its fields
+func aggregationKey(fields ...string) string {
+	return fmt.Sprintf("%x", sha1.Sum([]byte(strings.Join(fields, "\n"))))
+}
+
+// countResult increments the count of the report result of table model
+// with aggregation key, or creates row (count 1) if there is none
+// Results are counted by concurrent deliveries or sessions: the unique
+// index on aggregation_key makes the creation of the same row fail, it's
+// then counted.
+func countResult(model interface{}, key string, row interface{}) error {
+	for try := 0; ; try++ {
+		res := DB.Model(model).Where("aggregation_key = ?", key).UpdateColumn("count", gorm.Expr("count + ?", 1))
+		if res.Error != nil {
+			return res.Error
+		}
+		if res.RowsAffected != 0 {
+			return nil
+		}
+		err := DB.Create(row).Error
+		if err == nil || try == 1 {
+			return err
+		}
+	}
+}
+
+// tlsRptResultType returns the TLS-RPT result type of a certificate
+// verification error
+func tlsRptResultType(err error) string {
+	var hostErr x509.HostnameError
+	var invalidErr x509.CertificateInvalidError
+	var authErr x509.UnknownAuthorityError
+	switch {
+	case errors.As(err, &hostErr):
+		return tlsRptCertificateHostMismatch
+	case errors.As(err, &invalidErr) && invalidErr.Reason == x509.Expired:
+		return tlsRptCertificateExpired
+	case errors.As(err, &authErr):
+		return tlsRptCertificateNotTrusted
+	}
+	return tlsRptValidationFailure
+}
+
+// tlsRptRua returns the mailto: reporting addresses of domain from its
+// _smtp._tls TXT record
+func tlsRptRua(domain string) (rua []string, err error) {
+	records, err := DNS.LookupTXT(context.Background(), "_smtp._tls."+domain)
+	if err != nil {
+		if dnsErr, ok := err.(*net.DNSError); ok && dnsErr.IsNotFound {
+			return nil, nil
+		}
+		return nil, err
+	}
+	for _, record := range records {
+		if !strings.HasPrefix(record, "v=TLSRPTv1") {
+			continue
+		}
+		for _, field := range strings.Split(record, ";") {
+			kv := strings.SplitN(strings.TrimSpace(field), "=", 2)
+			if len(kv) != 2 || kv[0] != "rua" {
+				continue
+			}
+			for _, uri := range strings.Split(kv[1], ",") {
+				uri = strings.TrimSpace(uri)
+				// https reporting is not supported
+				if strings.HasPrefix(strings.ToLower(uri), "mailto:") {
+					rua = append(rua, uri[7:])
+				}
+			}
+		}
+	}
+	return
+}
+
+// tlsRpt represents a TLS-RPT aggregate report (RFC 8460 4)
+type tlsRpt struct {
+	OrganizationName string `json:"organization-name"`
+	DateRange        struct {
+		StartDatetime string `json:"start-datetime"`
+		EndDatetime   string `json:"end-datetime"`
+	} `json:"date-range"`
+	ContactInfo string         `json:"contact-info"`
+	ReportId    string         `json:"report-id"`
+	Policies    []tlsRptPolicy `json:"policies"`
+}
+
+type tlsRptPolicy struct {
+	Policy struct {
+		PolicyType   string   `json:"policy-type"`
+		PolicyString []string `json:"policy-string,omitempty"`
+		PolicyDomain string   `json:"policy-domain"`
+		MXHost       []string `json:"mx-host,omitempty"`
+	} `json:"policy"`
+	Summary struct {
+		TotalSuccessfulSessionCount int64 `json:"total-successful-session-count"`
+		TotalFailureSessionCount    int64 `json:"total-failure-session-count"`
+	} `json:"summary"`
+	FailureDetails []tlsRptFailure `json:"failure-details,omitempty"`
+}
+
+type tlsRptFailure struct {
+	ResultType          string `json:"result-type"`
+	SendingMtaIp        string `json:"sending-mta-ip,omitempty"`
+	ReceivingMxHostname string `json:"receiving-mx-hostname,omitempty"`
+	ReceivingIp         string `json:"receiving-ip,omitempty"`
+	FailedSessionCount  int64  `json:"failed-session-count"`
+}
+
+// newTLSRpt returns the report of domain for day from its results
+func newTLSRpt(day, domain string, results []TLSRptResult) tlsRpt {
+	report := tlsRpt{
+		OrganizationName: Cfg.GetMe(),
+		ContactInfo:      getReportsFrom(),
+		ReportId:         day + "_" + domain + "@" + Cfg.GetMe(),
+	}
+	report.DateRange.StartDatetime = day + "T00:00:00Z"
+	report.DateRange.EndDatetime = day + "T23:59:59Z"
+
+	policies := map[string]*tlsRptPolicy{}
+	keys := []string{}
+	for _, r := range results {
+		key := r.PolicyType + "\n" + r.PolicyString
+		p, ok := policies[key]
+		if !ok {
+			p = &tlsRptPolicy{}
+			p.Policy.PolicyType = r.PolicyType
+			p.Policy.PolicyDomain = domain
+			if r.PolicyString != "" {
+				p.Policy.PolicyString = strings.Split(r.PolicyString, "\n")
+			}
+			if r.PolicyType == "sts" {
+				for _, line := range p.Policy.PolicyString {
+					if strings.HasPrefix(line, "mx: ") {
+						p.Policy.MXHost = append(p.Policy.MXHost, line[4:])
+					}
+				}
+			}
+			policies[key] = p
+			keys = append(keys, key)
+		}
+		if r.ResultType == tlsRptSuccess {
+			p.Summary.TotalSuccessfulSessionCount += r.Count
+			continue
+		}
+		p.Summary.TotalFailureSessionCount += r.Count
+		p.FailureDetails = append(p.FailureDetails, tlsRptFailure{
+			ResultType:          r.ResultType,
+			SendingMtaIp:        r.SendingIP,
+			ReceivingMxHostname: r.MXHost,
+			ReceivingIp:         r.ReceivingIP,
+			FailedSessionCount:  r.Count,
+		})
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		report.Policies = append(report.Policies, *policies[key])
+	}
+	return report
+}
+
+// sendTLSRpts sends the reports of the days before today and removes
+// their results
+func sendTLSRpts() error {
+	today := time.Now().UTC().Format("2006-01-02")
+	results := []TLSRptResult{}
+	if err := DB.Where("day < ?", today).Order("day, domain, id").Find(&results).Error; err != nil {
+		return err
+	}
+
+	// by day and domain
+	byDayDomain := map[string][]TLSRptResult{}
+	keys := []string{}
+	for _, r := range results {
+		key := r.Day + " " + r.Domain
+		if _, ok := byDayDomain[key]; !ok {
+			keys = append(keys, key)
+		}
+		byDayDomain[key] = append(byDayDomain[key], r)
+	}
+
+	for _, key := range keys {
+		parts := strings.SplitN(key, " ", 2)
+		day, domain := parts[0], parts[1]
+		rua, err := tlsRptRua(domain)
+		if err != nil {
+			// temporary DNS failure, retry later
+			Logger.Info("deliverd: unable to get TLS-RPT rua of " + domain + " - " + err.Error())
+			continue
+		}
+		if len(rua) != 0 {
+			if err = sendTLSRpt(day, domain, rua, byDayDomain[key]); err != nil {
+				Logger.Error("deliverd: unable to send TLS report of " + day + " for " + domain + " - " + err.Error())
+				continue
+			}
+		}
+		if err = DB.Where("day = ? AND domain = ?", day, domain).Delete(TLSRptResult{}).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sendTLSRpt queues the report of domain for day to each rua address
+func sendTLSRpt(day, domain string, rua []string, results []TLSRptResult) error {
+	js, err := json.Marshal(newTLSRpt(day, domain, results))
+	if err != nil {
+		return err
+	}
+	gz := new(bytes.Buffer)
+	zw := gzip.NewWriter(gz)
+	if _, err = zw.Write(js); err != nil {
+		return err
+	}
+	if err = zw.Close(); err != nil {
+		return err
+	}
+
+	start, _ := time.Parse("2006-01-02", day)
+	end := start.Add(24*time.Hour - time.Second)
+	for _, to := range rua {
+		report := reportMail{
+			From:    getReportsFrom(),
+			To:      to,
+			Subject: "Report Domain: " + domain + " Submitter: " + Cfg.GetMe() + " Report-ID: <" + day + "_" + domain + "@" + Cfg.GetMe() + ">",
+			Headers: []string{
+				"TLS-Report-Domain: " + domain,
+				"TLS-Report-Submitter: " + Cfg.GetMe(),
+			},
+			Text:       "This is an aggregate TLS report from " + Cfg.GetMe() + " for " + domain + " (" + day + ").\n",
+			ReportType: "tlsrpt",
+			FileType:   "application/tlsrpt+gzip",
+			FileName:   fmt.Sprintf("%s!%s!%d!%d.json.gz", Cfg.GetMe(), domain, start.Unix(), end.Unix()),
+			File:       gz.Bytes(),
+		}
+		id, err := report.queue()
+		if err != nil {
+			return err
+		}
+		Logger.Info("deliverd: TLS report of " + day + " for " + domain + " to " + to + " queued with id " + id)
+	}
+	return nil
+}
+
+// tlsRptLoop sends the TLS reports once a day
+func tlsRptLoop() {
+	for {
+		time.Sleep(time.Hour)
+		if !Cfg.GetDeliverdTLSRpt() {
+			continue
+		}
+		if err := sendTLSRpts(); err != nil {
+			Logger.Error("deliverd: unable to send TLS reports - " + err.Error())
+		}
+	}
+}
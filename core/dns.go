@@ -0,0 +1,40 @@
+package core
+
+import (
+	"net"
+	"strings"
+	"time"
+
+	"github.com/stunndard/cocosmail/resolver"
+)
+
+// systemDNSTTL is the cache TTL of answers of the system resolver, which
+// doesn't provide TTLs
+const systemDNSTTL = 60
+
+// DNS is the resolver used for DNS lookups
+var DNS resolver.Resolver = net.DefaultResolver
+
+// initDNS initializes DNS from config
+func initDNS() error {
+	var zone *resolver.Zone
+	if path := Cfg.GetDNSZoneFile(); path != "" {
+		var err error
+		if zone, err = resolver.LoadZone(path); err != nil {
+			return err
+		}
+	}
+
+	timeout := time.Duration(Cfg.GetDNSTimeout()) * time.Second
+	var upstream resolver.Querier
+	switch servers := Cfg.GetDNSServers(); servers {
+	case "":
+		upstream = &resolver.System{Resolver: net.DefaultResolver, Timeout: timeout, TTL: systemDNSTTL}
+	case "none":
+	default:
+		upstream = resolver.NewClient(strings.Split(servers, ","), timeout)
+	}
+
+	DNS = resolver.New(zone, upstream, time.Duration(Cfg.GetDNSCacheMaxTTL())*time.Second)
+	return nil
+}
@@ -26,6 +26,13 @@ type QMessage struct {
 	NextDeliveryScheduledAt time.Time
 	Status                  uint32 // 0 delivery in progress, 1 to be discarded, 2 scheduled, 3 to be bounced
 	DeliveryFailedCount     uint32
+	Body                    string // BODY parameter of MAIL FROM: 7BIT, 8BITMIME or empty
+	SMTPUTF8                bool   // message was received with SMTPUTF8
+	Ret                     string // DSN RET parameter: FULL, HDRS or empty
+	EnvId                   string // DSN ENVID parameter
+	Notify                  string // DSN NOTIFY parameter of this recipient
+	ORcpt                   string // DSN ORCPT parameter of this recipient
+	DelayWarningsSent       int    // number of delayed delivery warnings already sent
 }
 
 // Delete delete message from queue
@@ -45,6 +52,13 @@ func (q *QMessage) Delete() error {
 	if c != 0 {
 		return nil
 	}
+	// raw message is needed by pending bounces
+	if err = DB.Model(QBounce{}).Where("`uuid` = ?", q.Uuid).Count(&c).Error; err != nil {
+		return err
+	}
+	if c != 0 {
+		return nil
+	}
 	/*qStore, err := NewStore(Cfg.GetStoreDriver(), Cfg.GetStoreSource())
 	if err != nil {
 		return err
@@ -72,6 +86,46 @@ func (q *QMessage) SaveInDb() error {
 	return DB.Save(q).Error
 }
 
+// Claim marks message as being in delivery
+// It returns false if its status has been changed by another process since
+// it was loaded from DB
+func (q *QMessage) Claim() (bool, error) {
+	q.Lock()
+	defer q.Unlock()
+	now := time.Now()
+	r := DB.Model(QMessage{}).Where("id = ? AND status = ?", q.Id, q.Status).Updates(map[string]interface{}{"status": 0, "last_update": now})
+	if r.Error != nil {
+		return false, r.Error
+	}
+	if r.RowsAffected != 1 {
+		return false, nil
+	}
+	q.Status = 0
+	q.LastUpdate = now
+	return true, nil
+}
+
+// ClaimBatch claims up to max scheduled recipients of the same message on
+// the same host as q, to deliver them in the same SMTP transaction
+// Recipients whose next delivery is not due yet are left to their retry
+// schedule.
+func (q *QMessage) ClaimBatch(max int) (batch []*QMessage, err error) {
+	candidates := []QMessage{}
+	if err = DB.Where("`uuid` = ? AND host = ? AND id <> ? AND status = ? AND next_delivery_scheduled_at <= ?", q.Uuid, q.Host, q.Id, 2, time.Now()).Limit(max).Find(&candidates).Error; err != nil {
+		return
+	}
+	for i := range candidates {
+		claimed, err := candidates[i].Claim()
+		if err != nil {
+			return batch, err
+		}
+		if claimed {
+			batch = append(batch, &candidates[i])
+		}
+	}
+	return
+}
+
 // Discard mark message as being discarded on next delivery attemp
 func (q *QMessage) Discard() error {
 	if q.Status == 0 {
@@ -145,6 +199,12 @@ func QueueAddMessage(rawMess *[]byte, envelope message.Envelope, authUser string
 			NextDeliveryScheduledAt: time.Now(),
 			Status:                  2,
 			DeliveryFailedCount:     0,
+			Body:                    envelope.Body,
+			SMTPUTF8:                envelope.SMTPUTF8,
+			Ret:                     envelope.Ret,
+			EnvId:                   envelope.EnvId,
+			Notify:                  envelope.DSN[rcptTo].Notify,
+			ORcpt:                   envelope.DSN[rcptTo].ORcpt,
 		}
 
 		// create record in db
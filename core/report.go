@@ -0,0 +1,101 @@
+package core
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"mime/multipart"
+	"net/textproto"
+	"strings"
+	"time"
+
+	"github.com/stunndard/cocosmail/message"
+)
+
+// reportMail represents an aggregate report (TLS-RPT, DMARC) sent by mail
+type reportMail struct {
+	From       string
+	To         string
+	Subject    string
+	Headers    []string // extra headers
+	Text       string   // human readable part
+	ReportType string   // report-type of multipart/report, empty for multipart/mixed
+	FileType   string   // content type of the report file
+	FileName   string
+	File       []byte
+}
+
+// getReportsFrom returns the sender address of reports
+func getReportsFrom() string {
+	if from := Cfg.GetReportsFrom(); from != "" {
+		return from
+	}
+	return "postmaster@" + Cfg.GetMe()
+}
+
+// queue builds the report mail and adds it to the queue
+func (r *reportMail) queue() (id string, err error) {
+	body := new(bytes.Buffer)
+	mw := multipart.NewWriter(body)
+
+	w, err := mw.CreatePart(textproto.MIMEHeader{"Content-Type": {"text/plain; charset=utf-8"}})
+	if err != nil {
+		return
+	}
+	if _, err = w.Write([]byte(strings.Replace(r.Text, "\n", "\r\n", -1))); err != nil {
+		return
+	}
+
+	w, err = mw.CreatePart(textproto.MIMEHeader{
+		"Content-Type":              {r.FileType},
+		"Content-Transfer-Encoding": {"base64"},
+		"Content-Disposition":       {"attachment; filename=\"" + r.FileName + "\""},
+	})
+	if err != nil {
+		return
+	}
+	encoded := base64.StdEncoding.EncodeToString(r.File)
+	for len(encoded) > 76 {
+		if _, err = w.Write([]byte(encoded[:76] + "\r\n")); err != nil {
+			return
+		}
+		encoded = encoded[76:]
+	}
+	if _, err = w.Write([]byte(encoded + "\r\n")); err != nil {
+		return
+	}
+	if err = mw.Close(); err != nil {
+		return
+	}
+
+	atDomain := Cfg.GetMe()
+	if p := strings.LastIndex(r.From, "@"); p != -1 {
+		atDomain = r.From[p+1:]
+	}
+	uuid, err := NewUUID()
+	if err != nil {
+		return
+	}
+	headers := "Date: " + Format822Date() + "\r\n"
+	headers += "From: " + r.From + "\r\n"
+	headers += "To: " + r.To + "\r\n"
+	headers += "Subject: " + r.Subject + "\r\n"
+	headers += fmt.Sprintf("Message-ID: <%d.%s@%s>\r\n", time.Now().Unix(), uuid, atDomain)
+	for _, h := range r.Headers {
+		headers += h + "\r\n"
+	}
+	headers += "MIME-Version: 1.0\r\n"
+	if r.ReportType != "" {
+		headers += "Content-Type: multipart/report; report-type=\"" + r.ReportType + "\";\r\n\tboundary=\"" + mw.Boundary() + "\"\r\n"
+	} else {
+		headers += "Content-Type: multipart/mixed;\r\n\tboundary=\"" + mw.Boundary() + "\"\r\n"
+	}
+	headers += "Auto-Submitted: auto-generated\r\n\r\n"
+
+	raw := append([]byte(headers), body.Bytes()...)
+	envelope := message.Envelope{
+		MailFrom: r.From,
+		RcptTo:   []string{r.To},
+	}
+	return QueueAddMessage(&raw, envelope, "")
+}
@@ -93,6 +93,11 @@ func Bootstrap() (err error) {
 	Logger.Out = out
 	Logger.Debug("Logger initialized")
 
+	// DNS resolver
+	if err = initDNS(); err != nil {
+		return errors.New("unable to init DNS resolver - " + err.Error())
+	}
+
 	// Init DB
 	DB, err = gorm.Open(Cfg.GetDbDriver(), Cfg.GetDbSource())
 	if err != nil {
@@ -152,7 +157,14 @@ func InitBolt() error {
 	}
 	// create buckets if not exists
 	return Bolt.Update(func(tx *bolt.Tx) error {
-		if _, err = tx.CreateBucketIfNotExists([]byte("koip")); err != nil {
+		// remote hosts health is now in DB (RemoteHost)
+		if err = tx.DeleteBucket([]byte("koip")); err != nil && err != bolt.ErrBucketNotFound {
+			return err
+		}
+		if _, err = tx.CreateBucketIfNotExists([]byte("mtasts")); err != nil {
+			return err
+		}
+		if _, err = tx.CreateBucketIfNotExists(greylistBucket); err != nil {
 			return err
 		}
 		return nil
@@ -3,7 +3,9 @@
 package core
 
 import (
+	"context"
 	"crypto/tls"
+	"crypto/x509"
 	"database/sql"
 	"encoding/base64"
 	"errors"
@@ -13,11 +15,11 @@ import (
 	"net"
 	"net/textproto"
 	"regexp"
-	"strconv"
 	"strings"
 	"time"
 
 	"github.com/boltdb/bolt"
+	"github.com/stunndard/cocosmail/dane"
 	"github.com/stunndard/cocosmail/message"
 )
 
@@ -32,26 +34,31 @@ type smtpClient struct {
 	ext map[string]string
 	// whether the Client is using TLS
 	tls bool
+	// whether the server certificate has been verified
+	tlsVerified bool
+	// DNSSEC signed TLSA records of the server, if any
+	daneRecords []dane.TLSA
+	// whether the server certificate has been verified with TLSA records
+	daneVerified bool
 	// supported auth mechanisms
 	auth []string
 	// timeout per command
 	timeoutBasePerCmd int
+	// when the client was put in the pool
+	idleSince time.Time
+	// delivery policy whose connections include this client, 0 if none
+	policyID int64
 }
 
 // newSMTPClient return a connected SMTP client
+// Remote addresses of a route are tried in parallel, IPv6 and IPv4
+// interleaved (Happy Eyeballs, RFC 8305).
 func newSMTPClient(d *Delivery, routes []Route, timeoutBasePerCmd int) (client *smtpClient, err error) {
-	lastErr := err
+	var lastErr error
 	for _, route := range routes {
-		var localIPs []struct {
-			ip         net.IP
-			systemName string
-		}
-
-		var remoteAddresses []net.TCPAddr
-
 		// If there is no local IP get default (as defined in config)
 		if route.LocalIp.String == "" {
-			route.LocalIp = sql.NullString{String: Cfg.GetLocalIps(), Valid: true}
+			route.LocalIp = sql.NullString{String: defaultLocalIps(), Valid: true}
 		}
 
 		// there should be no mix beetween failover and round robin for local IP
@@ -76,71 +83,37 @@ func newSMTPClient(d *Delivery, routes []Route, timeoutBasePerCmd int) (client *
 			}
 			sIps = strings.Split(route.LocalIp.String, sep)
 
-			// if roundRobin we need to shuffle IPs
-			rSIps := make([]string, len(sIps))
-			perm := rand.Perm(len(sIps))
-			for i, v := range perm {
-				rSIps[v] = sIps[i]
+			// if roundRobin we need to shuffle IPs, failover keeps the order
+			if roundRobin {
+				rSIps := make([]string, len(sIps))
+				perm := rand.Perm(len(sIps))
+				for i, v := range perm {
+					rSIps[v] = sIps[i]
+				}
+				sIps = rSIps
+				rSIps = nil
 			}
-			sIps = rSIps
-			rSIps = nil
 		}
 
 		// IP:systemname string to net.IP and systemname
+		var localIPs []localIP
 		for _, ipStr := range sIps {
-			ipAndName := strings.Split(ipStr, ":")
-			if len(ipAndName) == 0 {
-				return nil, errors.New(fmt.Sprintf("invalid IP:name %s found in localIp routes: %s", ipStr, route.LocalIp.String))
-			}
-			ip := net.ParseIP(ipAndName[0])
-			if ip == nil {
-				return nil, errors.New("invalid IP " + ipStr + " found in localIp routes: " + route.LocalIp.String)
+			ip, sysName, err := parseLocalIP(ipStr)
+			if err != nil {
+				return nil, errors.New(err.Error() + " found in localIp routes: " + route.LocalIp.String)
 			}
-			sysName := Cfg.GetMe()
-			if len(ipAndName) > 1 {
-				sysName = ipAndName[1]
+			if sysName == "" {
+				sysName = Cfg.GetMe()
 			}
-			localIPs = append(localIPs, struct {
-				ip         net.IP
-				systemName string
-			}{
-				ip:         ip,
-				systemName: sysName,
-			})
+			localIPs = append(localIPs, localIP{ip: ip, systemName: sysName})
 		}
 
 		if Cfg.GetDeliverdRemoteUseSameHost() {
-			var localIPz []struct {
-				ip         net.IP
-				systemName string
-			}
+			var localIPz []localIP
 
-			msg, err := message.New(d.RawData)
+			receivedBy, err := getReceivedBy(d.RawData)
 			if err != nil {
-				return nil, errors.New("cannot parse message: " + err.Error())
-			}
-
-			receivedBy := ""
-			recvs := msg.GetHeaders("received")
-			re := regexp.MustCompile(`by +([^ ]+) +with .*cocosmail `)
-			for _, recv := range recvs {
-				match := re.FindStringSubmatch(recv)
-				if len(match) != 2 {
-					Logger.Debugf("skipping received header: %s", recv)
-					continue
-				}
-
-				dsns, _ := GetDsnsFromString(Cfg.GetSmtpdDsns())
-				for _, dsn := range dsns {
-					if match[1] == dsn.SystemName || match[1] == Cfg.GetMe() {
-						receivedBy = match[1]
-						break
-					}
-				}
-			}
-
-			if receivedBy == "" {
-				return nil, errors.New(fmt.Sprintf("cannot get received hostname from Received header(s): %s", recvs))
+				return nil, err
 			}
 
 			for _, ip := range localIPs {
@@ -154,8 +127,9 @@ func newSMTPClient(d *Delivery, routes []Route, timeoutBasePerCmd int) (client *
 
 		// remoteAdresses
 		// Hostname or IP
+		var remoteAddresses []net.TCPAddr
 		// IP ?
-		ip := net.ParseIP(route.RemoteHost)
+		ip := net.ParseIP(strings.Trim(route.RemoteHost, "[]"))
 		if ip != nil { // ip
 			remoteAddresses = append(remoteAddresses, net.TCPAddr{
 				IP:   ip,
@@ -163,83 +137,29 @@ func newSMTPClient(d *Delivery, routes []Route, timeoutBasePerCmd int) (client *
 			})
 			// hostname
 		} else {
-			ips, err := net.LookupIP(route.RemoteHost)
+			ips, err := DNS.LookupIPAddr(context.Background(), route.RemoteHost)
 			// TODO: no such host -> perm failure
 			if err != nil {
 				return nil, err
 			}
 			for _, i := range ips {
 				remoteAddresses = append(remoteAddresses, net.TCPAddr{
-					IP:   i,
+					IP:   i.IP,
 					Port: int(route.RemotePort.Int64),
 				})
 			}
 		}
 
-		// try routes & returns first OK
-		for _, localIP := range localIPs {
-			for _, remoteAddr := range remoteAddresses {
-				// IPv4 <-> IPv4 or IPv6 <-> IPv6
-				if IsIPV4(localIP.ip.String()) != IsIPV4(remoteAddr.IP.String()) {
-					continue
-				}
-
-				// If during the last 15 minutes we have fail to connect to this host don't try again
-				if !isRemoteIPOK(remoteAddr.IP.String()) {
-					Logger.Info("smtp getclient " + remoteAddr.IP.String() + " is marked as KO. I'll dot not try to reach it.")
-					continue
-				}
-
-				localAddr, err := net.ResolveTCPAddr("tcp", localIP.ip.String()+":0")
-				if err != nil {
-					return nil, errors.New("bad local IP: " + localIP.ip.String() + ". " + err.Error())
-				}
-
-				Logger.Debugf("Dialing remote host: %s from local host: %s using hostname %s",
-					remoteAddr.IP.String(), localAddr.IP.String(), localIP.systemName)
-
-				// Dial timeout
-				connectTimer := time.NewTimer(time.Duration(timeoutBasePerCmd) * time.Second)
-				done := make(chan error, 1)
-				var conn net.Conn
-				var client *smtpClient
-				go func() {
-					conn, err = net.DialTCP("tcp", localAddr, &remoteAddr)
-					if err != nil {
-						done <- err
-						return
-					}
-					client = &smtpClient{
-						conn:              conn,
-						timeoutBasePerCmd: timeoutBasePerCmd,
-						systemName:        localIP.systemName,
-						route:             &route,
-						text:              textproto.NewConn(conn),
-					}
-					_, _, err = client.text.ReadResponse(220)
-					done <- err
-				}()
-
-				select {
-				case err = <-done:
-					if err == nil {
-						return client, nil
-					}
-					lastErr = err
-				// Timeout
-				case <-connectTimer.C:
-					err = errors.New(fmt.Sprintf("deliverd-remote %s - timeout connecting %s->%s:%d",
-						d.ID, localAddr.IP.String(), remoteAddr.IP.String(), remoteAddr.Port))
-					// todo si c'est un timeout pas la peine d'essayer les autres IP locales
-					if errBolt := setIPKO(remoteAddr.IP.String()); errBolt != nil {
-						Logger.Error("Bolt - ", errBolt)
-					}
-					lastErr = err
-				}
-				Logger.Info(fmt.Sprintf("deliverd-remote %s - unable to get a SMTP client for %s->%s:%d - %s ",
-					d.ID, localAddr.IP.String(), remoteAddr.IP.String(), remoteAddr.Port, err.Error()))
+		r := route
+		client, err = dialHappyEyeballs(d, &r, dialCandidates(localIPs, remoteAddresses), timeoutBasePerCmd)
+		if err == nil {
+			if d.Policy != nil {
+				client.policyID = d.Policy.Id
 			}
+			smtpPool.opened(client)
+			return client, nil
 		}
+		lastErr = err
 	}
 	if lastErr == nil {
 		// All routes have been tested -> Fail !
@@ -250,8 +170,42 @@ func newSMTPClient(d *Delivery, routes []Route, timeoutBasePerCmd int) (client *
 	}
 }
 
+// getReceivedBy returns the local hostname which received the message
+// from its Received headers
+func getReceivedBy(rawData *[]byte) (string, error) {
+	msg, err := message.New(rawData)
+	if err != nil {
+		return "", errors.New("cannot parse message: " + err.Error())
+	}
+
+	receivedBy := ""
+	recvs := msg.GetHeaders("received")
+	re := regexp.MustCompile(`by +([^ ]+) +with .*cocosmail `)
+	for _, recv := range recvs {
+		match := re.FindStringSubmatch(recv)
+		if len(match) != 2 {
+			Logger.Debugf("skipping received header: %s", recv)
+			continue
+		}
+
+		dsns, _ := GetDsnsFromString(Cfg.GetSmtpdDsns())
+		for _, dsn := range dsns {
+			if match[1] == dsn.SystemName || match[1] == Cfg.GetMe() {
+				receivedBy = match[1]
+				break
+			}
+		}
+	}
+
+	if receivedBy == "" {
+		return "", errors.New(fmt.Sprintf("cannot get received hostname from Received header(s): %s", recvs))
+	}
+	return receivedBy, nil
+}
+
 // CloseConn close connection
 func (s *smtpClient) close() error {
+	smtpPool.closed(s)
 	return s.text.Close()
 }
 
@@ -321,6 +275,27 @@ func (s *smtpClient) TLSGetCipherSuite() string {
 	return tlsGetCipherSuite(s.connTLS.ConnectionState().CipherSuite)
 }
 
+// verifyTLS verifies the server certificate chain and host name
+func (s *smtpClient) verifyTLS(serverName string, roots *x509.CertPool) error {
+	if !s.tls {
+		return errors.New("no TLS")
+	}
+	certs := s.connTLS.ConnectionState().PeerCertificates
+	if len(certs) == 0 {
+		return errors.New("no server certificate")
+	}
+	opts := x509.VerifyOptions{
+		DNSName:       serverName,
+		Roots:         roots,
+		Intermediates: x509.NewCertPool(),
+	}
+	for _, cert := range certs[1:] {
+		opts.Intermediates.AddCert(cert)
+	}
+	_, err := certs[0].Verify(opts)
+	return err
+}
+
 // RemoteAddr return remote address (IP:PORT)
 func (s *smtpClient) RemoteAddr() string {
 	if s.tls {
@@ -393,6 +368,15 @@ func (s *smtpClient) StartTLS(config *tls.Config) (code int, msg string, err err
 	if err != nil {
 		return
 	}
+	// DANE: certificate is verified against TLSA records (RFC 7672)
+	if len(s.daneRecords) != 0 {
+		config = config.Clone()
+		serverName := config.ServerName
+		config.InsecureSkipVerify = true
+		config.VerifyConnection = func(cs tls.ConnectionState) error {
+			return dane.Verify(cs.PeerCertificates, s.daneRecords, serverName)
+		}
+	}
 	s.connTLS = tls.Client(s.conn, config)
 	s.text = textproto.NewConn(s.connTLS)
 	code, msg, err = s.Ehlo()
@@ -400,6 +384,7 @@ func (s *smtpClient) StartTLS(config *tls.Config) (code int, msg string, err err
 		return
 	}
 	s.tls = true
+	s.daneVerified = len(s.daneRecords) != 0
 	return
 }
 
@@ -445,19 +430,103 @@ func (s *smtpClient) Auth(a DeliverdAuth) (code int, msg string, err error) {
 }
 
 // MAIL
-func (s *smtpClient) Mail(from string) (code int, msg string, err error) {
-	return s.cmd(s.timeoutBasePerCmd, 250, "MAIL FROM:<%s>", from)
+// params are ESMTP parameters, eg BODY=8BITMIME
+func (s *smtpClient) Mail(from string, params ...string) (code int, msg string, err error) {
+	return s.cmd(s.timeoutBasePerCmd, 250, "MAIL FROM:<%s>%s", from, joinParams(params))
 }
 
 // RCPT
-func (s *smtpClient) Rcpt(to string) (code int, msg string, err error) {
-	code, msg, err = s.cmd(s.timeoutBasePerCmd, -1, "RCPT TO:<%s>", to)
+// params are ESMTP parameters, eg NOTIFY=SUCCESS
+func (s *smtpClient) Rcpt(to string, params ...string) (code int, msg string, err error) {
+	code, msg, err = s.cmd(s.timeoutBasePerCmd, -1, "RCPT TO:<%s>%s", to, joinParams(params))
 	if code != 250 && code != 251 {
 		err = errors.New(msg)
 	}
 	return
 }
 
+// smtpReply is the reply to a pipelined command
+type smtpReply struct {
+	code int
+	msg  string
+}
+
+// result returns the reply, with an error if its code is not one of
+// expectedCodes
+func (r smtpReply) result(expectedCodes ...int) (int, string, error) {
+	for _, c := range expectedCodes {
+		if r.code == c {
+			return r.code, r.msg, nil
+		}
+	}
+	return r.code, r.msg, &textproto.Error{Code: r.code, Msg: r.msg}
+}
+
+// rcptCmd is a RCPT TO command of a pipelined transaction
+type rcptCmd struct {
+	to     string
+	params []string
+}
+
+// Pipeline sends MAIL FROM, RCPT TO and DATA commands of a transaction as
+// a single group, then reads their replies in order (PIPELINING, RFC 2920)
+// If the reply to DATA is 354, data must be sent with DataWriter.
+func (s *smtpClient) Pipeline(from string, mailParams []string, rcpts []rcptCmd) ([]smtpReply, error) {
+	var replies []smtpReply
+	var err error
+	timeout := make(chan bool, 1)
+	done := make(chan bool, 1)
+	timer := time.AfterFunc(time.Duration((3+len(rcpts))*s.timeoutBasePerCmd)*time.Second, func() {
+		timeout <- true
+	})
+	defer timer.Stop()
+	go func() {
+		defer func() { done <- true }()
+		cmds := []string{"MAIL FROM:<" + from + ">" + joinParams(mailParams)}
+		for _, r := range rcpts {
+			cmds = append(cmds, "RCPT TO:<"+r.to+">"+joinParams(r.params))
+		}
+		cmds = append(cmds, "DATA")
+		ids := make([]uint, 0, len(cmds))
+		for _, c := range cmds {
+			s.logDebug(">", "%s", c)
+			var id uint
+			if id, err = s.text.Cmd("%s", c); err != nil {
+				return
+			}
+			ids = append(ids, id)
+		}
+		for _, id := range ids {
+			s.text.StartResponse(id)
+			code, msg, rErr := s.text.ReadResponse(-1)
+			s.text.EndResponse(id)
+			s.logDebug("<", "%d-%s", code, strings.Replace(msg, "\n", " ", -1))
+			if rErr != nil {
+				if _, ok := rErr.(*textproto.Error); !ok {
+					err = rErr
+					return
+				}
+			}
+			replies = append(replies, smtpReply{code, msg})
+		}
+	}()
+
+	select {
+	case <-timeout:
+		return nil, errors.New("server do not reply in time -> timeout")
+	case <-done:
+		return replies, err
+	}
+}
+
+// joinParams returns ESMTP parameters of a command
+func joinParams(params []string) string {
+	if len(params) == 0 {
+		return ""
+	}
+	return " " + strings.Join(params, " ")
+}
+
 // DATA
 type dataCloser struct {
 	s *smtpClient
@@ -475,53 +544,15 @@ func (s *smtpClient) Data() (*dataCloser, int, string, error) {
 	return &dataCloser{s, s.text.DotWriter()}, code, msg, nil
 }
 
+// DataWriter returns a writer for the data of a pipelined DATA command
+// accepted by the server
+func (s *smtpClient) DataWriter() *dataCloser {
+	return &dataCloser{s, s.text.DotWriter()}
+}
+
 // QUIT
 func (s *smtpClient) Quit() (code int, msg string, err error) {
 	code, msg, err = s.cmd(s.timeoutBasePerCmd, 221, "QUIT")
-	_ = s.text.Close()
+	_ = s.close()
 	return
 }
-
-// remoteIPOK check if a remote IP is in Bolt bucket ipko for less than 15 minutes
-func isRemoteIPOK(ip string) bool {
-	ok := true
-	removeFlag := false
-	err := Bolt.View(func(tx *bolt.Tx) error {
-		ts := tx.Bucket([]byte("koip")).Get([]byte(ip))
-		// not in db
-		if len(ts) == 0 {
-			return nil
-		}
-		t, err := strconv.ParseInt(string(ts), 10, 64)
-		if err != nil {
-			return err
-		}
-		insertedAt := time.Unix(t, 0)
-		if time.Since(insertedAt).Minutes() > 15 {
-			removeFlag = true
-		} else {
-			ok = false
-		}
-		return nil
-	})
-	if err != nil {
-		Logger.Error("Bolt -", err)
-	}
-
-	// remove record
-	if removeFlag {
-		if err := Bolt.Update(func(tx *bolt.Tx) error {
-			return tx.Bucket([]byte("koip")).Delete([]byte(ip))
-		}); err != nil {
-			Logger.Error("Bolt -", err)
-		}
-	}
-	return ok
-}
-
-// Flag IP ip as unjoignable
-func setIPKO(ip string) error {
-	return Bolt.Update(func(tx *bolt.Tx) error {
-		return tx.Bucket([]byte("koip")).Put([]byte(ip), []byte(strconv.FormatInt(time.Now().Unix(), 10)))
-	})
-}
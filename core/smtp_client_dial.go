@@ -0,0 +1,235 @@
+package core
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/textproto"
+	"strings"
+	"time"
+)
+
+// happyEyeballsDelay is the delay before starting the next connection
+// attempt while the previous ones are pending (RFC 8305 5)
+const happyEyeballsDelay = 250 * time.Millisecond
+
+// localIP represents a local IP used for outgoing connections and the
+// hostname used in HELO from this IP
+type localIP struct {
+	ip         net.IP
+	systemName string
+}
+
+// dialCandidate represents a connection attempt from a local IP to a
+// remote address
+type dialCandidate struct {
+	local  localIP
+	remote net.TCPAddr
+}
+
+// dialResult is the result of a connection attempt
+type dialResult struct {
+	candidate dialCandidate
+	client    *smtpClient
+	err       error
+}
+
+// parseLocalIP parses a local IP entry: IP[:hostname]
+// IPv6 addresses must be bracketed: [2001:db8::1]:hostname
+func parseLocalIP(s string) (ip net.IP, systemName string, err error) {
+	s = strings.TrimSpace(s)
+	ipStr := s
+	if strings.HasPrefix(s, "[") {
+		end := strings.Index(s, "]")
+		if end == -1 {
+			return nil, "", errors.New("invalid IP " + s)
+		}
+		ipStr = s[1:end]
+		rest := s[end+1:]
+		if rest != "" {
+			if rest[0] != ':' {
+				return nil, "", errors.New("invalid IP:name " + s)
+			}
+			systemName = rest[1:]
+		}
+	} else if p := strings.Index(s, ":"); p != -1 {
+		ipStr = s[:p]
+		systemName = s[p+1:]
+	}
+	ip = net.ParseIP(ipStr)
+	if ip == nil {
+		return nil, "", errors.New("invalid IP " + s + " (IPv6 addresses must be bracketed)")
+	}
+	if strings.Contains(systemName, ":") {
+		return nil, "", errors.New("invalid IP:name " + s + " (IPv6 addresses must be bracketed)")
+	}
+	return ip, systemName, nil
+}
+
+// defaultLocalIps returns the local IPs of routes without local IP:
+// deliverd_local_ips followed by the IPv6 pool deliverd_local_ips6
+func defaultLocalIps() string {
+	ips, ips6 := Cfg.GetLocalIps(), Cfg.GetLocalIps6()
+	if ips6 == "" {
+		return ips
+	}
+	sep := "&"
+	if strings.Contains(ips, "|") || strings.Contains(ips6, "|") {
+		sep = "|"
+	}
+	return ips + sep + ips6
+}
+
+// dialCandidates returns the connection attempts from localIPs to
+// remoteAddresses, each remote address with local IPs of its family.
+// IPv6 and IPv4 attempts are interleaved, IPv6 first (RFC 8305 4).
+func dialCandidates(localIPs []localIP, remoteAddresses []net.TCPAddr) []dialCandidate {
+	var v6, v4 []dialCandidate
+	for _, local := range localIPs {
+		for _, remote := range remoteAddresses {
+			isV4 := remote.IP.To4() != nil
+			if (local.ip.To4() != nil) != isV4 {
+				continue
+			}
+			if isV4 {
+				v4 = append(v4, dialCandidate{local, remote})
+			} else {
+				v6 = append(v6, dialCandidate{local, remote})
+			}
+		}
+	}
+	candidates := make([]dialCandidate, 0, len(v6)+len(v4))
+	for i := 0; i < len(v6) || i < len(v4); i++ {
+		if i < len(v6) {
+			candidates = append(candidates, v6[i])
+		}
+		if i < len(v4) {
+			candidates = append(candidates, v4[i])
+		}
+	}
+	return candidates
+}
+
+// dialSMTP connects to the remote address of c and reads the greeting
+func dialSMTP(c dialCandidate, route *Route, timeoutBasePerCmd int) (*smtpClient, error) {
+	deadline := time.Now().Add(time.Duration(timeoutBasePerCmd) * time.Second)
+	dialer := net.Dialer{
+		Deadline:  deadline,
+		LocalAddr: &net.TCPAddr{IP: c.local.ip},
+	}
+	conn, err := dialer.Dial("tcp", c.remote.String())
+	if err != nil {
+		return nil, err
+	}
+	if err = conn.SetDeadline(deadline); err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	client := &smtpClient{
+		conn:              conn,
+		timeoutBasePerCmd: timeoutBasePerCmd,
+		systemName:        c.local.systemName,
+		route:             route,
+		text:              textproto.NewConn(conn),
+	}
+	// SMTPS
+	if route.tlsPolicy() == RouteTLSImplicit {
+		config, err := route.tlsConfig(Cfg.GetDeliverdRemoteTLSSkipVerify() && !route.tlsVerifyRequired())
+		if err != nil {
+			_ = conn.Close()
+			return nil, err
+		}
+		client.connTLS = tls.Client(conn, config)
+		if err = client.connTLS.Handshake(); err != nil {
+			_ = conn.Close()
+			return nil, err
+		}
+		client.text = textproto.NewConn(client.connTLS)
+		client.tls = true
+	}
+	if _, _, err = client.text.ReadResponse(220); err != nil {
+		_ = client.close()
+		return nil, err
+	}
+	if err = conn.SetDeadline(time.Time{}); err != nil {
+		_ = client.close()
+		return nil, err
+	}
+	return client, nil
+}
+
+// dialHappyEyeballs races connection attempts to candidates and returns
+// the first client which is greeted by the remote server.
+// A new attempt is started every happyEyeballsDelay or as soon as an
+// attempt fails.
+func dialHappyEyeballs(d *Delivery, route *Route, candidates []dialCandidate, timeoutBasePerCmd int) (*smtpClient, error) {
+	if len(candidates) == 0 {
+		return nil, errors.New("no usable local IP / remote address pair for route to " + route.RemoteHost)
+	}
+	results := make(chan dialResult, len(candidates))
+	next, pending := 0, 0
+	var lastErr error
+	// start dials the next candidate whose remote host may be tried
+	// The circuit breaker is checked here, as a half-open host is probed
+	// by the delivery which claims it.
+	start := func() {
+		for next < len(candidates) {
+			c := candidates[next]
+			next++
+			if !remoteHostAllow(c.remote.IP.String(), time.Duration(timeoutBasePerCmd)*time.Second) {
+				Logger.Info("deliverd-remote " + d.ID + " - remote host " + c.remote.IP.String() + " is unreachable (circuit open), not tried")
+				lastErr = errors.New("remote host " + c.remote.IP.String() + " is unreachable (circuit open)")
+				continue
+			}
+			pending++
+			Logger.Debugf("Dialing remote host: %s from local host: %s using hostname %s",
+				c.remote.String(), c.local.ip.String(), c.local.systemName)
+			go func() {
+				client, err := dialSMTP(c, route, timeoutBasePerCmd)
+				results <- dialResult{c, client, err}
+			}()
+			return
+		}
+	}
+
+	start()
+	for pending != 0 {
+		var delay <-chan time.Time
+		if next < len(candidates) {
+			delay = time.After(happyEyeballsDelay)
+		}
+		select {
+		case r := <-results:
+			pending--
+			if r.err == nil {
+				remoteHostSuccess(r.candidate.remote.IP.String())
+				// close the connections of attempts still pending
+				go func(n int) {
+					for ; n != 0; n-- {
+						if late := <-results; late.client != nil {
+							_ = late.client.close()
+						}
+					}
+				}(pending)
+				return r.client, nil
+			}
+			// a 5xx greeting is an answer, not an unreachable host
+			if tpErr, ok := r.err.(*textproto.Error); !ok || tpErr.Code < 500 {
+				remoteHostFailure(r.candidate.remote.IP.String(), route.RemoteHost, r.err)
+			}
+			if netErr, ok := r.err.(net.Error); ok && netErr.Timeout() {
+				r.err = fmt.Errorf("deliverd-remote %s - timeout connecting %s->%s", d.ID, r.candidate.local.ip.String(), r.candidate.remote.String())
+			}
+			Logger.Info(fmt.Sprintf("deliverd-remote %s - unable to get a SMTP client for %s->%s - %s ",
+				d.ID, r.candidate.local.ip.String(), r.candidate.remote.String(), r.err.Error()))
+			lastErr = r.err
+			if next < len(candidates) {
+				start()
+			}
+		case <-delay:
+			start()
+		}
+	}
+	return nil, lastErr
+}
@@ -0,0 +1,74 @@
+package core
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_parseLocalIP(t *testing.T) {
+	tests := []struct {
+		s          string
+		ip         string
+		systemName string
+		valid      bool
+	}{
+		{"127.0.0.1", "127.0.0.1", "", true},
+		{" 127.0.0.1:mx.example.com ", "127.0.0.1", "mx.example.com", true},
+		{"[2001:db8::1]", "2001:db8::1", "", true},
+		{"[2001:db8::1]:mx.example.com", "2001:db8::1", "mx.example.com", true},
+		{"[::]", "::", "", true},
+		{"2001:db8::1", "", "", false},
+		{"[2001:db8::1", "", "", false},
+		{"[2001:db8::1]mx.example.com", "", "", false},
+		{"[2001:db8::1]:mx:example", "", "", false},
+		{"127.0.0.1:mx:example", "", "", false},
+		{"mx.example.com", "", "", false},
+		{"", "", "", false},
+	}
+	for _, test := range tests {
+		ip, systemName, err := parseLocalIP(test.s)
+		if !test.valid {
+			assert.Error(t, err, test.s)
+			continue
+		}
+		assert.NoError(t, err, test.s)
+		assert.True(t, ip.Equal(net.ParseIP(test.ip)), test.s)
+		assert.Equal(t, test.systemName, systemName, test.s)
+	}
+}
+
+func Test_dialCandidates(t *testing.T) {
+	local4a := localIP{ip: net.ParseIP("192.0.2.1")}
+	local4b := localIP{ip: net.ParseIP("192.0.2.2")}
+	local6 := localIP{ip: net.ParseIP("2001:db8::1")}
+	remote4a := net.TCPAddr{IP: net.ParseIP("198.51.100.1"), Port: 25}
+	remote4b := net.TCPAddr{IP: net.ParseIP("198.51.100.2"), Port: 25}
+	remote6 := net.TCPAddr{IP: net.ParseIP("2001:db8:1::1"), Port: 25}
+
+	tests := []struct {
+		name     string
+		locals   []localIP
+		remotes  []net.TCPAddr
+		expected []dialCandidate
+	}{
+		{"no local IP", nil, []net.TCPAddr{remote4a}, []dialCandidate{}},
+		{"no family match", []localIP{local6}, []net.TCPAddr{remote4a}, []dialCandidate{}},
+		{
+			"IPv4 in order of local IPs then remote addresses",
+			[]localIP{local4a, local4b},
+			[]net.TCPAddr{remote4a, remote4b},
+			[]dialCandidate{{local4a, remote4a}, {local4a, remote4b}, {local4b, remote4a}, {local4b, remote4b}},
+		},
+		{
+			"IPv6 first, interleaved with IPv4",
+			[]localIP{local4a, local6},
+			[]net.TCPAddr{remote4a, remote4b, remote6},
+			[]dialCandidate{{local6, remote6}, {local4a, remote4a}, {local4a, remote4b}},
+		},
+	}
+	for _, test := range tests {
+		assert.Equal(t, test.expected, dialCandidates(test.locals, test.remotes), test.name)
+	}
+}
@@ -0,0 +1,193 @@
+package core
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// smtpClientPool keeps idle SMTP clients (TLS established, authenticated)
+// to reuse them for the next messages to the same destination
+type smtpClientPool struct {
+	sync.Mutex
+	// idle clients by recipient domain and route
+	idle map[string][]*smtpClient
+	// connected clients, busy or idle
+	open map[*smtpClient]bool
+}
+
+// smtpPool is the pool of outgoing SMTP connections
+var smtpPool = &smtpClientPool{
+	idle: make(map[string][]*smtpClient),
+	open: make(map[*smtpClient]bool),
+}
+
+// poolKey returns the key of route for recipient domain host in the pool
+// A client is only reused for its recipient domain: TLS requirements
+// (MTA-STS, DANE, route TLS policy, CA bundle, client certificate) are
+// checked for a domain when the connection is initialized.
+func poolKey(host string, r *Route) string {
+	localIP := r.LocalIp.String
+	if localIP == "" {
+		localIP = Cfg.GetLocalIps()
+	}
+	return fmt.Sprintf("%s|%d|%s|%d|%s", strings.ToLower(host), r.Id, r.RemoteHost, r.RemotePort.Int64, localIP)
+}
+
+// opened registers a new connected client
+func (p *smtpClientPool) opened(client *smtpClient) {
+	p.Lock()
+	p.open[client] = true
+	p.Unlock()
+}
+
+// closed unregisters a closed client
+func (p *smtpClientPool) closed(client *smtpClient) {
+	p.Lock()
+	delete(p.open, client)
+	p.Unlock()
+}
+
+// get returns an idle client for one of the routes of highest priority of
+// delivery d, or nil if there is none
+func (p *smtpClientPool) get(d *Delivery) *smtpClient {
+	if Cfg.GetDeliverdRemotePoolIdleTimeout() <= 0 || len(d.RemoteRoutes) == 0 {
+		return nil
+	}
+
+	// local hostname must be the one which received the message
+	systemName := ""
+	if Cfg.GetDeliverdRemoteUseSameHost() {
+		var err error
+		if systemName, err = getReceivedBy(d.RawData); err != nil {
+			return nil
+		}
+	}
+
+	for i := range d.RemoteRoutes {
+		if d.RemoteRoutes[i].Priority != d.RemoteRoutes[0].Priority {
+			break
+		}
+		key := poolKey(d.QMsg.Host, &d.RemoteRoutes[i])
+		for {
+			client := p.pop(key, systemName, d.mtastsEnforced(), d.daneRequired())
+			if client == nil {
+				break
+			}
+			// RSET checks that the connection is still alive
+			if _, _, err := client.cmd(client.timeoutBasePerCmd, 250, "RSET"); err != nil {
+				_ = client.close()
+				continue
+			}
+			return client
+		}
+	}
+	return nil
+}
+
+// pop removes and returns the most recent idle client for route key
+// If verifiedTLS (resp. verifiedDANE) is true, only clients with a TLS
+// connection verified (resp. verified by DANE) are returned.
+func (p *smtpClientPool) pop(key, systemName string, verifiedTLS, verifiedDANE bool) *smtpClient {
+	timeout := time.Duration(Cfg.GetDeliverdRemotePoolIdleTimeout()) * time.Second
+	p.Lock()
+	defer p.Unlock()
+	clients := p.idle[key]
+	for i := len(clients) - 1; i >= 0; i-- {
+		c := clients[i]
+		// expired, will be closed by janitor
+		if time.Since(c.idleSince) > timeout {
+			continue
+		}
+		if systemName != "" && c.systemName != systemName {
+			continue
+		}
+		if (verifiedTLS && !c.tlsVerified) || (verifiedDANE && !c.daneVerified) {
+			continue
+		}
+		p.idle[key] = append(clients[:i:i], clients[i+1:]...)
+		return c
+	}
+	return nil
+}
+
+// idleCount returns the number of idle clients of delivery policy policyID
+func (p *smtpClientPool) idleCount(policyID int64) (count int) {
+	p.Lock()
+	defer p.Unlock()
+	for _, clients := range p.idle {
+		for _, c := range clients {
+			if c.policyID == policyID {
+				count++
+			}
+		}
+	}
+	return
+}
+
+// put puts client, used for recipient domain host, in the pool
+// It returns false if the client can't be kept (pooling disabled or limits
+// of open connections reached), in this case the caller has to close it.
+func (p *smtpClientPool) put(client *smtpClient, host string) bool {
+	if Cfg.GetDeliverdRemotePoolIdleTimeout() <= 0 {
+		return false
+	}
+	maxPerHost := Cfg.GetDeliverdRemotePoolMaxPerHost()
+	maxPerLocalIP := Cfg.GetDeliverdRemotePoolMaxPerLocalIp()
+	remoteAddr := client.RemoteAddr()
+	localIP, _, _ := net.SplitHostPort(client.LocalAddr())
+
+	p.Lock()
+	defer p.Unlock()
+	// other connections, busy or idle
+	perHost, perLocalIP := 0, 0
+	for c := range p.open {
+		if c == client {
+			continue
+		}
+		if c.RemoteAddr() == remoteAddr {
+			perHost++
+		}
+		if ip, _, _ := net.SplitHostPort(c.LocalAddr()); ip == localIP {
+			perLocalIP++
+		}
+	}
+	if (maxPerHost > 0 && perHost >= maxPerHost) || (maxPerLocalIP > 0 && perLocalIP >= maxPerLocalIP) {
+		return false
+	}
+	client.idleSince = time.Now()
+	key := poolKey(host, client.route)
+	p.idle[key] = append(p.idle[key], client)
+	return true
+}
+
+// janitor closes clients which have been idle for too long
+func (p *smtpClientPool) janitor() {
+	for {
+		time.Sleep(10 * time.Second)
+		timeout := time.Duration(Cfg.GetDeliverdRemotePoolIdleTimeout()) * time.Second
+		expired := []*smtpClient{}
+		p.Lock()
+		for key, clients := range p.idle {
+			kept := []*smtpClient{}
+			for _, c := range clients {
+				if time.Since(c.idleSince) > timeout {
+					expired = append(expired, c)
+				} else {
+					kept = append(kept, c)
+				}
+			}
+			if len(kept) == 0 {
+				delete(p.idle, key)
+			} else {
+				p.idle[key] = kept
+			}
+		}
+		p.Unlock()
+		for _, c := range expired {
+			_, _, _ = c.Quit()
+		}
+	}
+}
@@ -52,6 +52,18 @@ func (s *Smtpd) ListenAndServe() {
 
 	defer func() { _ = listener.Close() }()
 
+	// greylisting housekeeping, once for all smtpd
+	if Cfg.GetSmtpdGreylistEnabled() {
+		greylistJanitorOnce.Do(func() {
+			go greylistJanitor()
+		})
+	}
+
+	// DMARC aggregate reports, once for all smtpd
+	dmarcReportLoopOnce.Do(func() {
+		go dmarcReportLoop()
+	})
+
 	for {
 		conn, err := listener.Accept()
 		if err != nil {
@@ -0,0 +1,218 @@
+package core
+
+import (
+	"context"
+	"net"
+	"strings"
+
+	"github.com/stunndard/cocosmail/dmarc"
+	"github.com/stunndard/cocosmail/message"
+	"github.com/toorop/go-dkim"
+)
+
+// DKIMResult is the result of the verification of a DKIM signature
+type DKIMResult struct {
+	Result   string // pass, fail, neutral, temperror or permerror
+	Domain   string // d= tag
+	Selector string // s= tag
+	Sig      string // first characters of the signature (b= tag)
+	Reason   string
+}
+
+// AuthResults are the results of the authentication checks of an incoming
+// message, written in its Authentication-Results header (RFC 8601)
+type AuthResults struct {
+	AuthUser  string       // SMTP AUTH login, empty if not authenticated
+	DKIM      []DKIMResult // empty if the message is not signed
+	SPF       string       // empty if SPF was not checked
+	IPRev     string       // pass, fail or temperror
+	IPRevHost string       // host name of the client IP if iprev passed
+	// DMARC
+	HeaderFrom []string        // author domains
+	DMARC      []*dmarc.Result // results of the domains of HeaderFrom, empty if not evaluated
+}
+
+// authenticate verifies the DKIM signatures of the current message and
+// the reverse DNS of the client
+// Authenticated users are not checked.
+func (s *SMTPServerSession) authenticate(remoteIP string) *AuthResults {
+	results := &AuthResults{SPF: string(s.SPFResult)}
+	if s.user != nil {
+		results.AuthUser = s.user.Login
+		return results
+	}
+	if Cfg.GetSmtpdDkimVerify() {
+		results.DKIM = verifyDKIMSignatures(s.CurrentRawMail)
+	}
+	results.IPRev, results.IPRevHost = checkIPRev(remoteIP)
+	return results
+}
+
+// verifyDKIMSignatures verifies each DKIM-Signature header of raw
+// go-dkim only verifies the first signature of a message, so each
+// signature is verified on a copy of the message without the others.
+func verifyDKIMSignatures(raw []byte) (results []DKIMResult) {
+	fields, body := message.RawSplitHeaders(raw)
+	lookupTXT := dkim.DNSOptLookupTXT(func(name string) ([]string, error) {
+		return DNS.LookupTXT(context.Background(), name)
+	})
+	for i, field := range fields {
+		if message.RawHeaderName(field) != "dkim-signature" {
+			continue
+		}
+		var kept [][]byte
+		for j, f := range fields {
+			if j == i || message.RawHeaderName(f) != "dkim-signature" {
+				kept = append(kept, f)
+			}
+		}
+		email := message.RawJoinHeaders(kept, body)
+		tags := parseDKIMTags(message.RawHeaderValue(field))
+		r := DKIMResult{
+			Domain:   tags["d"],
+			Selector: tags["s"],
+			Sig:      tags["b"],
+		}
+		if len(r.Sig) > 8 {
+			r.Sig = r.Sig[:8]
+		}
+		status, err := dkim.Verify(&email, lookupTXT)
+		switch status {
+		case dkim.SUCCESS:
+			r.Result = "pass"
+		case dkim.TEMPFAIL:
+			r.Result = "temperror"
+		case dkim.TESTINGSUCCESS, dkim.TESTINGPERMFAIL, dkim.TESTINGTEMPFAIL:
+			r.Result = "neutral"
+			r.Reason = "signing domain is testing DKIM"
+		default:
+			r.Result = "fail"
+			if r.Domain == "" || r.Selector == "" {
+				r.Result = "permerror"
+			}
+		}
+		if err != nil && r.Reason == "" {
+			r.Reason = err.Error()
+		}
+		results = append(results, r)
+	}
+	return
+}
+
+// parseDKIMTags returns the tags of a DKIM-Signature header value
+func parseDKIMTags(value string) map[string]string {
+	tags := make(map[string]string)
+	for _, tag := range strings.Split(value, ";") {
+		kv := strings.SplitN(tag, "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		v := strings.Join(strings.Fields(kv[1]), "")
+		tags[strings.TrimSpace(kv[0])] = v
+	}
+	return tags
+}
+
+// checkIPRev checks that a host name of ip resolves to ip (RFC 8601 3)
+func checkIPRev(ip string) (result, host string) {
+	names, err := DNS.LookupAddr(context.Background(), ip)
+	if err != nil {
+		if dnsErr, ok := err.(*net.DNSError); ok && dnsErr.IsNotFound {
+			return "fail", ""
+		}
+		return "temperror", ""
+	}
+	tempError := false
+	for _, name := range names {
+		addrs, err := DNS.LookupIPAddr(context.Background(), name)
+		if err != nil {
+			if dnsErr, ok := err.(*net.DNSError); !ok || !dnsErr.IsNotFound {
+				tempError = true
+			}
+			continue
+		}
+		for _, addr := range addrs {
+			if addr.IP.Equal(net.ParseIP(ip)) {
+				return "pass", strings.TrimSuffix(name, ".")
+			}
+		}
+	}
+	if tempError {
+		return "temperror", ""
+	}
+	return "fail", ""
+}
+
+// Header returns the Authentication-Results header of the results,
+// authserv-id is Cfg.GetMe()
+// Like the Received header, it does not reveal the login of authenticated
+// users if Cfg.GetSmtpdHideReceivedFromAuth(): no header is returned.
+func (r *AuthResults) Header(mailFrom, helo, remoteIP string) string {
+	if r.AuthUser != "" && Cfg.GetSmtpdHideReceivedFromAuth() {
+		return ""
+	}
+	var methods []string
+	if r.AuthUser != "" {
+		methods = append(methods, "auth=pass smtp.auth="+r.AuthUser)
+	} else {
+		if Cfg.GetSmtpdDkimVerify() {
+			if len(r.DKIM) == 0 {
+				methods = append(methods, "dkim=none")
+			}
+			for _, d := range r.DKIM {
+				method := "dkim=" + d.Result
+				if d.Reason != "" {
+					method += " (" + strings.NewReplacer("(", "", ")", "").Replace(d.Reason) + ")"
+				}
+				method += " header.d=" + d.Domain + " header.s=" + d.Selector + " header.b=" + d.Sig
+				methods = append(methods, method)
+			}
+		}
+		methods = append(methods, "iprev="+r.IPRev+" policy.iprev="+remoteIP+iprevComment(r.IPRevHost))
+	}
+	for i, res := range r.DMARC {
+		method := "dmarc=" + res.Result
+		if res.Record != nil {
+			method += " (p=" + res.Policy + " dis=" + res.Disposition + ")"
+		}
+		methods = append(methods, method+" header.from="+r.HeaderFrom[i])
+	}
+	if r.SPF != "" {
+		if mailFrom != "" {
+			methods = append(methods, "spf="+r.SPF+" smtp.mailfrom="+mailFrom)
+		} else {
+			methods = append(methods, "spf="+r.SPF+" smtp.helo="+helo)
+		}
+	}
+	return "Authentication-Results: " + Cfg.GetMe() + ";\r\n        " + strings.Join(methods, ";\r\n        ") + "\r\n"
+}
+
+// iprevComment returns the host name as a comment of the iprev result
+func iprevComment(host string) string {
+	if host == "" {
+		return ""
+	}
+	return " (" + host + ")"
+}
+
+// stripForgedAuthResults removes the Authentication-Results headers of raw
+// which claim to be ours (RFC 8601 5)
+func stripForgedAuthResults(raw []byte) (stripped []byte, count int) {
+	fields, body := message.RawSplitHeaders(raw)
+	var kept [][]byte
+	for _, field := range fields {
+		if message.RawHeaderName(field) == "authentication-results" {
+			authservID := strings.TrimSpace(strings.SplitN(message.RawHeaderValue(field), ";", 2)[0])
+			// authserv-id may be followed by a version
+			if f := strings.Fields(authservID); len(f) != 0 && strings.EqualFold(f[0], Cfg.GetMe()) {
+				count++
+				continue
+			}
+		}
+		kept = append(kept, field)
+	}
+	if count == 0 {
+		return raw, 0
+	}
+	return message.RawJoinHeaders(kept, body), count
+}
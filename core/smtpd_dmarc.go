@@ -0,0 +1,252 @@
+package core
+
+import (
+	"context"
+	"net"
+	"net/mail"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/stunndard/cocosmail/dmarc"
+	"github.com/stunndard/cocosmail/message"
+)
+
+// quarantineHeader marks messages to deliver in the Junk folder
+const quarantineHeader = "X-Cocosmail-Quarantine"
+
+var (
+	dmarcEvaluator     *dmarc.Evaluator
+	dmarcEvaluatorOnce sync.Once
+)
+
+// DMARCResult counts incoming messages of a day with the same DMARC
+// evaluation for the aggregate reports of the author domains (RFC 7489 7.2)
+type DMARCResult struct {
+	Id              int64
+	AggregationKey  string `sql:"type:char(40);unique_index"` // hash of the other fields but Count
+	Day             string // 2006-01-02 UTC
+	Domain          string // policy domain
+	Rua             string `sql:"type:text"` // comma separated report URIs
+	Policy          string // p
+	SubdomainPolicy string // sp
+	Pct             int
+	ADKIM           string
+	ASPF            string
+	SourceIP        string
+	HeaderFrom      string
+	EnvelopeFrom    string // domain of MAIL FROM
+	Disposition     string // none, quarantine or reject
+	DKIMEval        string // pass if an aligned DKIM signature passed, else fail
+	SPFEval         string // pass if SPF passed for an aligned domain, else fail
+	DKIMResults     string `sql:"type:text"` // domain:selector:result separated by space
+	SPFDomain       string
+	SPFResult       string
+	Count           int64
+}
+
+// getDMARCEvaluator returns the DMARC evaluator, using the public suffix
+// list of Cfg.GetSmtpdDMARCPSLFile() or the bundled one
+func getDMARCEvaluator() *dmarc.Evaluator {
+	dmarcEvaluatorOnce.Do(func() {
+		var psl *dmarc.List
+		if path := Cfg.GetSmtpdDMARCPSLFile(); path != "" {
+			f, err := os.Open(path)
+			if err == nil {
+				psl, err = dmarc.ParseList(f)
+				_ = f.Close()
+			}
+			if err != nil {
+				Logger.Error("smtpd - unable to load public suffix list " + path + ", using bundled list - " + err.Error())
+				psl = nil
+			}
+		}
+		dmarcEvaluator = dmarc.NewEvaluator(func(name string) ([]string, error) {
+			return DNS.LookupTXT(context.Background(), name)
+		}, psl)
+	})
+	return dmarcEvaluator
+}
+
+// fromDomainRe finds the domains of the addresses of a From header which
+// can't be parsed
+var fromDomainRe = regexp.MustCompile(`@([A-Za-z0-9-]+(?:\.[A-Za-z0-9-]+)+)`)
+
+// headerFromDomains returns the domains of the addresses of the From
+// headers of raw
+// malformed is true if there is not exactly one From header or if it
+// can't be parsed (RFC 7489 6.6.1), the domains are then found as well
+// as possible.
+func headerFromDomains(raw []byte) (domains []string, malformed bool) {
+	fields, _ := message.RawSplitHeaders(raw)
+	var values []string
+	for _, field := range fields {
+		if message.RawHeaderName(field) == "from" {
+			values = append(values, message.RawHeaderValue(field))
+		}
+	}
+	malformed = len(values) != 1
+	for _, value := range values {
+		var found []string
+		if addresses, err := mail.ParseAddressList(value); err == nil {
+			for _, address := range addresses {
+				p := strings.LastIndex(address.Address, "@")
+				if p == -1 || p == len(address.Address)-1 {
+					malformed = true
+					continue
+				}
+				found = append(found, address.Address[p+1:])
+			}
+		} else {
+			malformed = true
+			for _, m := range fromDomainRe.FindAllStringSubmatch(value, -1) {
+				found = append(found, m[1])
+			}
+		}
+		for _, domain := range found {
+			domain = strings.ToLower(domain)
+			if !IsStringInSlice(domain, domains) {
+				domains = append(domains, domain)
+			}
+		}
+	}
+	return
+}
+
+// checkDMARC evaluates the DMARC policies of the author domains of the
+// current message and returns the action to take: none, quarantine or
+// reject, as mapped by Cfg.GetSmtpdDMARCActions(), and its reason
+// The strictest disposition of the author domains is applied. A message
+// without a single valid From header gets the reject disposition if one
+// of its author domains publishes a DMARC record.
+// Authenticated users and clients allowed to relay are not checked.
+func (s *SMTPServerSession) checkDMARC(clientIP string) (action, reason string) {
+	if !Cfg.GetSmtpdDMARCCheck() || s.AuthResults.AuthUser != "" {
+		return dmarc.PolicyNone, ""
+	}
+	if canRelay, err := IpCanRelay(net.ParseIP(clientIP)); err != nil || canRelay {
+		return dmarc.PolicyNone, ""
+	}
+	domains, malformed := headerFromDomains(s.CurrentRawMail)
+	if len(domains) == 0 {
+		s.Log("DMARC - no author domain in From header, not evaluated")
+		return dmarc.PolicyNone, ""
+	}
+
+	disposition := dmarc.PolicyNone
+	for _, domain := range domains {
+		in := dmarc.Input{
+			FromDomain: domain,
+			SPFDomain:  message.GetHostFromAddress(s.Envelope.MailFrom),
+			SPFResult:  string(s.SPFResult),
+		}
+		if s.Envelope.MailFrom == "" {
+			in.SPFDomain = s.helo
+		}
+		for _, d := range s.AuthResults.DKIM {
+			in.DKIM = append(in.DKIM, dmarc.DKIMResult{Domain: d.Domain, Result: d.Result})
+		}
+		res := getDMARCEvaluator().Evaluate(in)
+		s.AuthResults.HeaderFrom = append(s.AuthResults.HeaderFrom, domain)
+		s.AuthResults.DMARC = append(s.AuthResults.DMARC, res)
+		if res.Result == dmarc.ResultNone {
+			continue
+		}
+		s.Log("DMARC - " + res.Result + " for " + in.FromDomain + " - policy " + res.Policy + " - disposition " + res.Disposition)
+		if res.Record != nil {
+			s.recordDMARCResult(clientIP, in, res)
+			if malformed && disposition != dmarc.PolicyReject {
+				s.Log("DMARC - From header malformed or not unique, " + res.PolicyDomain + " publishes a DMARC record")
+				disposition = dmarc.PolicyReject
+				reason = "DMARC, malformed or multiple From headers"
+				continue
+			}
+		}
+		if dispositionRank(res.Disposition) > dispositionRank(disposition) {
+			disposition = res.Disposition
+			reason = "DMARC policy of " + res.PolicyDomain
+		}
+	}
+	if disposition == dmarc.PolicyNone {
+		return dmarc.PolicyNone, ""
+	}
+	return dmarcAction(disposition), reason
+}
+
+// dispositionRank orders dispositions from the most lenient
+func dispositionRank(disposition string) int {
+	switch disposition {
+	case dmarc.PolicyReject:
+		return 2
+	case dmarc.PolicyQuarantine:
+		return 1
+	}
+	return 0
+}
+
+// dmarcAction returns the action configured for disposition
+// Bad actions are logged and disposition is applied.
+func dmarcAction(disposition string) string {
+	actions := strings.Split(Cfg.GetSmtpdDMARCActions(), ":")
+	action := dmarc.PolicyNone
+	switch {
+	case disposition == dmarc.PolicyReject && len(actions) > 0:
+		action = actions[0]
+	case disposition == dmarc.PolicyQuarantine && len(actions) > 1:
+		action = actions[1]
+	}
+	action = strings.ToLower(strings.TrimSpace(action))
+	switch action {
+	case dmarc.PolicyNone, dmarc.PolicyQuarantine, dmarc.PolicyReject:
+		return action
+	}
+	Logger.Error("smtpd - bad DMARC action " + action + " in smtpd_dmarc_actions, must be one of reject, quarantine or none")
+	return disposition
+}
+
+// recordDMARCResult counts the evaluation for the aggregate report of
+// the policy domain, if it requests reports
+func (s *SMTPServerSession) recordDMARCResult(clientIP string, in dmarc.Input, res *dmarc.Result) {
+	if !Cfg.GetSmtpdDMARCReports() || len(res.Record.RUA) == 0 {
+		return
+	}
+	r := DMARCResult{
+		Day:             time.Now().UTC().Format("2006-01-02"),
+		Domain:          res.PolicyDomain,
+		Rua:             strings.Join(res.Record.RUA, ","),
+		Policy:          res.Record.Policy,
+		SubdomainPolicy: res.Record.SubdomainPolicy,
+		Pct:             res.Record.Percent,
+		ADKIM:           res.Record.ADKIM,
+		ASPF:            res.Record.ASPF,
+		SourceIP:        clientIP,
+		HeaderFrom:      in.FromDomain,
+		EnvelopeFrom:    message.GetHostFromAddress(s.Envelope.MailFrom),
+		Disposition:     res.Disposition,
+		DKIMEval:        "fail",
+		SPFEval:         "fail",
+		SPFDomain:       in.SPFDomain,
+		SPFResult:       in.SPFResult,
+	}
+	if res.DKIMAligned {
+		r.DKIMEval = "pass"
+	}
+	if res.SPFAligned {
+		r.SPFEval = "pass"
+	}
+	var dkimResults []string
+	for _, d := range s.AuthResults.DKIM {
+		dkimResults = append(dkimResults, d.Domain+":"+d.Selector+":"+d.Result)
+	}
+	r.DKIMResults = strings.Join(dkimResults, " ")
+
+	r.AggregationKey = aggregationKey(r.Day, r.Domain, r.Rua, r.Policy, r.SubdomainPolicy, strconv.Itoa(r.Pct), r.ADKIM, r.ASPF, r.SourceIP, r.HeaderFrom, r.EnvelopeFrom, r.Disposition, r.DKIMEval, r.SPFEval, r.DKIMResults, r.SPFDomain, r.SPFResult)
+	r.Count = 1
+	if err := countResult(DMARCResult{}, r.AggregationKey, &r); err != nil {
+		s.LogError("DMARC - unable to record result for aggregate report - " + err.Error())
+	}
+}
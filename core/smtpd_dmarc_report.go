@@ -0,0 +1,292 @@
+package core
+
+import (
+	"archive/zip"
+	"bytes"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/stunndard/cocosmail/dmarc"
+)
+
+var dmarcReportLoopOnce sync.Once
+
+// DMARCPendingReport is a DMARC aggregate report not sent yet
+type DMARCPendingReport struct {
+	Day      string
+	Domain   string
+	Rua      []string
+	Messages int64 // number of messages
+	Records  int   // number of records of the report
+}
+
+// DMARCGetPendingReports returns the reports not sent yet, including the
+// report of today
+func DMARCGetPendingReports() (reports []DMARCPendingReport, err error) {
+	reports = []DMARCPendingReport{}
+	results, keys, err := getDMARCResults("")
+	if err != nil {
+		return nil, err
+	}
+	for _, key := range keys {
+		day, domain := splitDMARCKey(key)
+		feedback := newDMARCFeedback(day, domain, results[key])
+		report := DMARCPendingReport{
+			Day:     day,
+			Domain:  domain,
+			Rua:     strings.Split(results[key][len(results[key])-1].Rua, ","),
+			Records: len(feedback.Records),
+		}
+		for _, r := range feedback.Records {
+			report.Messages += r.Row.Count
+		}
+		reports = append(reports, report)
+	}
+	return
+}
+
+// DMARCGetReport returns the XML report of domain for day
+func DMARCGetReport(day, domain string) ([]byte, error) {
+	results := []DMARCResult{}
+	if err := DB.Where("day = ? AND domain = ?", day, strings.ToLower(domain)).Order("id").Find(&results).Error; err != nil {
+		return nil, err
+	}
+	if len(results) == 0 {
+		return nil, errors.New("no DMARC report of " + day + " for " + domain)
+	}
+	feedback := newDMARCFeedback(day, strings.ToLower(domain), results)
+	return feedback.Marshal()
+}
+
+// getDMARCResults returns the results of the days before before (all if
+// empty), by day and domain, and their sorted keys
+func getDMARCResults(before string) (byDayDomain map[string][]DMARCResult, keys []string, err error) {
+	results := []DMARCResult{}
+	query := DB.Order("day, domain, id")
+	if before != "" {
+		query = query.Where("day < ?", before)
+	}
+	if err = query.Find(&results).Error; err != nil {
+		return
+	}
+	byDayDomain = map[string][]DMARCResult{}
+	for _, r := range results {
+		key := r.Day + " " + r.Domain
+		if _, ok := byDayDomain[key]; !ok {
+			keys = append(keys, key)
+		}
+		byDayDomain[key] = append(byDayDomain[key], r)
+	}
+	return
+}
+
+// splitDMARCKey returns day and domain of a key of getDMARCResults
+func splitDMARCKey(key string) (day, domain string) {
+	parts := strings.SplitN(key, " ", 2)
+	return parts[0], parts[1]
+}
+
+// dmarcReportID returns the report ID of domain for day
+func dmarcReportID(day, domain string) string {
+	return day + "_" + domain + "@" + Cfg.GetMe()
+}
+
+// newDMARCFeedback returns the report of domain for day from its results
+// The published policy is the last one seen during the day.
+func newDMARCFeedback(day, domain string, results []DMARCResult) *dmarc.Feedback {
+	start, _ := time.Parse("2006-01-02", day)
+	last := results[len(results)-1]
+	feedback := &dmarc.Feedback{
+		ReportMetadata: dmarc.ReportMetadata{
+			OrgName:  Cfg.GetMe(),
+			Email:    getReportsFrom(),
+			ReportID: dmarcReportID(day, domain),
+			DateRange: dmarc.DateRange{
+				Begin: start.Unix(),
+				End:   start.Add(24*time.Hour - time.Second).Unix(),
+			},
+		},
+		PolicyPublished: dmarc.PolicyPublished{
+			Domain: domain,
+			ADKIM:  last.ADKIM,
+			ASPF:   last.ASPF,
+			P:      last.Policy,
+			SP:     last.SubdomainPolicy,
+			Pct:    last.Pct,
+		},
+	}
+
+	// results only differing by published policy are merged
+	records := map[string]*dmarc.ReportRecord{}
+	keys := []string{}
+	for _, r := range results {
+		key := strings.Join([]string{r.SourceIP, r.HeaderFrom, r.EnvelopeFrom, r.Disposition, r.DKIMEval, r.SPFEval, r.DKIMResults, r.SPFDomain, r.SPFResult}, "\n")
+		if record, ok := records[key]; ok {
+			record.Row.Count += r.Count
+			continue
+		}
+		record := &dmarc.ReportRecord{
+			Row: dmarc.ReportRow{
+				SourceIP: r.SourceIP,
+				Count:    r.Count,
+				PolicyEvaluated: dmarc.PolicyEvaluated{
+					Disposition: r.Disposition,
+					DKIM:        r.DKIMEval,
+					SPF:         r.SPFEval,
+				},
+			},
+			Identifiers: dmarc.ReportIdentifiers{
+				HeaderFrom:   r.HeaderFrom,
+				EnvelopeFrom: r.EnvelopeFrom,
+			},
+		}
+		for _, d := range strings.Fields(r.DKIMResults) {
+			// domain:selector:result
+			parts := strings.SplitN(d, ":", 3)
+			if len(parts) != 3 {
+				continue
+			}
+			record.AuthResults.DKIM = append(record.AuthResults.DKIM, dmarc.DKIMAuthResult{
+				Domain:   parts[0],
+				Selector: parts[1],
+				Result:   parts[2],
+			})
+		}
+		spf := dmarc.SPFAuthResult{
+			Domain: r.SPFDomain,
+			Scope:  "mfrom",
+			Result: strings.ToLower(r.SPFResult),
+		}
+		if r.EnvelopeFrom == "" {
+			spf.Scope = "helo"
+		}
+		if spf.Result == "" {
+			spf.Result = "none"
+		}
+		record.AuthResults.SPF = []dmarc.SPFAuthResult{spf}
+		records[key] = record
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		feedback.Records = append(feedback.Records, *records[key])
+	}
+	return feedback
+}
+
+// sendDMARCReports sends the reports of the days before today and
+// removes their results
+func sendDMARCReports() error {
+	results, keys, err := getDMARCResults(time.Now().UTC().Format("2006-01-02"))
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		day, domain := splitDMARCKey(key)
+		if err = sendDMARCReport(day, domain, results[key]); err != nil {
+			// temporary failure, retry later
+			Logger.Error("smtpd: unable to send DMARC report of " + day + " for " + domain + " - " + err.Error())
+			continue
+		}
+		if err = DB.Where("day = ? AND domain = ?", day, domain).Delete(DMARCResult{}).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sendDMARCReport queues the zipped report of domain for day to each
+// mailto: rua address of its last published policy
+// Addresses of other organizational domains must accept reports of
+// domain (RFC 7489 7.1), and reports larger than the size limit of an
+// address are not sent.
+// An error is returned only if the report could not be queued for any
+// address, to not send it twice to the others on retry.
+func sendDMARCReport(day, domain string, results []DMARCResult) error {
+	xml, err := newDMARCFeedback(day, domain, results).Marshal()
+	if err != nil {
+		return err
+	}
+	start, _ := time.Parse("2006-01-02", day)
+	end := start.Add(24*time.Hour - time.Second)
+	fileName := fmt.Sprintf("%s!%s!%d!%d", Cfg.GetMe(), domain, start.Unix(), end.Unix())
+	zipped := new(bytes.Buffer)
+	zw := zip.NewWriter(zipped)
+	w, err := zw.Create(fileName + ".xml")
+	if err != nil {
+		return err
+	}
+	if _, err = w.Write(xml); err != nil {
+		return err
+	}
+	if err = zw.Close(); err != nil {
+		return err
+	}
+
+	// destinations are checked before queuing, to not send twice on retry
+	evaluator := getDMARCEvaluator()
+	var rua []string
+	var lastErr error
+	for _, uri := range strings.Split(results[len(results)-1].Rua, ",") {
+		to, maxSize, err := dmarc.ParseReportURI(uri)
+		if err != nil {
+			Logger.Info("smtpd: DMARC report of " + day + " for " + domain + " not sent - " + err.Error())
+			continue
+		}
+		allowed, err := dmarc.ExternalDestinationAllowed(evaluator.LookupTXT, evaluator.PSL, domain, to)
+		if err != nil {
+			return err
+		}
+		if !allowed {
+			Logger.Info("smtpd: DMARC report of " + day + " for " + domain + " not sent - " + to + " does not accept reports for " + domain)
+			continue
+		}
+		if maxSize != 0 && int64(zipped.Len()) > maxSize {
+			Logger.Info(fmt.Sprintf("smtpd: DMARC report of %s for %s not sent to %s - size %d exceeds limit %d", day, domain, to, zipped.Len(), maxSize))
+			continue
+		}
+		rua = append(rua, to)
+	}
+
+	queued := 0
+	for _, to := range rua {
+		report := reportMail{
+			From:     getReportsFrom(),
+			To:       to,
+			Subject:  "Report Domain: " + domain + " Submitter: " + Cfg.GetMe() + " Report-ID: <" + dmarcReportID(day, domain) + ">",
+			Text:     "This is an aggregate DMARC report from " + Cfg.GetMe() + " for " + domain + " (" + day + ").\n",
+			FileType: "application/zip",
+			FileName: fileName + ".zip",
+			File:     zipped.Bytes(),
+		}
+		id, err := report.queue()
+		if err != nil {
+			Logger.Error("smtpd: unable to queue DMARC report of " + day + " for " + domain + " to " + to + " - " + err.Error())
+			lastErr = err
+			continue
+		}
+		queued++
+		Logger.Info("smtpd: DMARC report of " + day + " for " + domain + " to " + to + " queued with id " + id)
+	}
+	if queued == 0 {
+		return lastErr
+	}
+	return nil
+}
+
+// dmarcReportLoop sends the DMARC reports once a day
+func dmarcReportLoop() {
+	for {
+		time.Sleep(time.Hour)
+		if !Cfg.GetSmtpdDMARCReports() {
+			continue
+		}
+		if err := sendDMARCReports(); err != nil {
+			Logger.Error("smtpd: unable to send DMARC reports - " + err.Error())
+		}
+	}
+}
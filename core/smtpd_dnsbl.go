@@ -0,0 +1,266 @@
+package core
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/stunndard/cocosmail/resolver"
+)
+
+// DNSBL actions of a zone
+const (
+	DNSBLReject = "reject" // listed senders are rejected
+	DNSBLTag    = "tag"    // listing is only written in header
+	DNSBLScore  = "score"  // weight of zone is added to the score of the sender
+)
+
+// dnsblCodes is a range of return codes of a zone
+type dnsblCodes struct {
+	from, to net.IP
+}
+
+// dnsblZone represents a DNS blocklist (DNSBL) or a right hand side
+// blocklist (RHSBL) zone
+type dnsblZone struct {
+	zone   string
+	action string
+	weight int
+	// return codes meaning listed, any 127.0.0.x if empty
+	codes []dnsblCodes
+}
+
+// dnsblListing is a listing of the client IP or of the sender domain
+type dnsblListing struct {
+	zone   dnsblZone
+	name   string // IP or domain
+	code   string // A record returned by the zone
+	client bool   // client IP or sender domain
+}
+
+// parseDNSBLZones parses a comma separated list of zones:
+// zone[:action[:weight[:codes]]]
+// codes are | separated return codes or ranges: 127.0.0.2|127.0.0.4-127.0.0.11
+func parseDNSBLZones(s string) (zones []dnsblZone, err error) {
+	for _, entry := range strings.Split(s, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		parts := strings.Split(entry, ":")
+		if len(parts) > 4 || parts[0] == "" {
+			return nil, errors.New("bad DNSBL zone " + entry)
+		}
+		z := dnsblZone{
+			zone:   strings.Trim(strings.ToLower(parts[0]), "."),
+			action: DNSBLScore,
+			weight: 1,
+		}
+		if len(parts) > 1 && parts[1] != "" {
+			z.action = strings.ToLower(parts[1])
+			if z.action != DNSBLReject && z.action != DNSBLTag && z.action != DNSBLScore {
+				return nil, errors.New("bad action " + parts[1] + " for DNSBL zone " + z.zone + ", must be one of reject, tag or score")
+			}
+		}
+		if len(parts) > 2 && parts[2] != "" {
+			if z.weight, err = strconv.Atoi(parts[2]); err != nil {
+				return nil, errors.New("bad weight " + parts[2] + " for DNSBL zone " + z.zone)
+			}
+		}
+		if len(parts) > 3 && parts[3] != "" {
+			for _, r := range strings.Split(parts[3], "|") {
+				bounds := strings.SplitN(r, "-", 2)
+				c := dnsblCodes{from: net.ParseIP(bounds[0]).To4()}
+				c.to = c.from
+				if len(bounds) == 2 {
+					c.to = net.ParseIP(bounds[1]).To4()
+				}
+				if c.from == nil || c.to == nil {
+					return nil, errors.New("bad return code " + r + " for DNSBL zone " + z.zone)
+				}
+				z.codes = append(z.codes, c)
+			}
+		}
+		zones = append(zones, z)
+	}
+	return zones, nil
+}
+
+// listedBy returns true if code is a return code of a listing by z
+func (z dnsblZone) listedBy(code net.IP) bool {
+	code = code.To4()
+	if code == nil {
+		return false
+	}
+	if len(z.codes) == 0 {
+		// 127.255.255.x and others are errors (eg query refused)
+		return code[0] == 127 && code[1] == 0 && code[2] == 0
+	}
+	for _, c := range z.codes {
+		if bytes.Compare(code, c.from) >= 0 && bytes.Compare(code, c.to) <= 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// dnsblLookup queries zones for name in parallel and returns listings
+// name is the client IP (DNSBL) or the sender domain (RHSBL).
+// Lookup failures are logged and ignored, zones which don't answer within
+// Cfg.GetSmtpdDNSBLTimeout() seconds are skipped.
+func dnsblLookup(zones []dnsblZone, name string, client bool) []dnsblListing {
+	prefix := strings.Trim(strings.ToLower(name), ".")
+	if client {
+		reversed, err := resolver.ReverseName(name)
+		if err != nil {
+			return nil
+		}
+		prefix = strings.TrimSuffix(strings.TrimSuffix(reversed, ".in-addr.arpa."), ".ip6.arpa.")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(Cfg.GetSmtpdDNSBLTimeout())*time.Second)
+	defer cancel()
+	var listings []dnsblListing
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for _, z := range zones {
+		wg.Add(1)
+		go func(z dnsblZone) {
+			defer wg.Done()
+			addrs, err := DNS.LookupIPAddr(ctx, prefix+"."+z.zone)
+			if err != nil {
+				if dnsErr, ok := err.(*net.DNSError); !ok || !dnsErr.IsNotFound {
+					Logger.Info("smtpd - DNSBL lookup of " + name + " in " + z.zone + " failed - " + err.Error())
+				}
+				return
+			}
+			for _, addr := range addrs {
+				if z.listedBy(addr.IP) {
+					mu.Lock()
+					listings = append(listings, dnsblListing{zone: z, name: name, code: addr.IP.String(), client: client})
+					mu.Unlock()
+					return
+				}
+			}
+		}(z)
+	}
+	wg.Wait()
+	return listings
+}
+
+// dnsblCheckClient looks up the client IP in DNSBL zones
+// Clients allowed to relay are trusted and not checked.
+func (s *SMTPServerSession) dnsblCheckClient() {
+	if Cfg.GetSmtpdDNSBLZones() == "" && Cfg.GetSmtpdRHSBLZones() == "" {
+		return
+	}
+	ip, _, err := net.SplitHostPort(s.Conn.RemoteAddr().String())
+	if err != nil {
+		s.LogError("DNSBL - " + err.Error())
+		s.dnsblTrusted = true
+		return
+	}
+	canRelay, err := IpCanRelay(net.ParseIP(ip))
+	if err != nil {
+		s.LogError("DNSBL - unable to check if client can relay - " + err.Error())
+	}
+	if err != nil || canRelay {
+		s.dnsblTrusted = true
+		return
+	}
+	if Cfg.GetSmtpdDNSBLZones() == "" {
+		return
+	}
+	zones, err := parseDNSBLZones(Cfg.GetSmtpdDNSBLZones())
+	if err != nil {
+		s.LogError("DNSBL - " + err.Error())
+		return
+	}
+	s.dnsblChecked = true
+	s.dnsblListings = dnsblLookup(zones, ip, true)
+	for _, l := range s.dnsblListings {
+		s.Log(fmt.Sprintf("DNSBL - client %s listed by %s (%s)", ip, l.zone.zone, l.code))
+	}
+}
+
+// rhsblCheckSender looks up the domain of the sender in RHSBL zones
+// Listings of the previous sender are dropped.
+func (s *SMTPServerSession) rhsblCheckSender(domain string) {
+	var clientListings []dnsblListing
+	for _, l := range s.dnsblListings {
+		if l.client {
+			clientListings = append(clientListings, l)
+		}
+	}
+	s.dnsblListings = clientListings
+	s.rhsblChecked = false
+	if s.dnsblTrusted || Cfg.GetSmtpdRHSBLZones() == "" || domain == "" {
+		return
+	}
+	zones, err := parseDNSBLZones(Cfg.GetSmtpdRHSBLZones())
+	if err != nil {
+		s.LogError("RHSBL - " + err.Error())
+		return
+	}
+	s.rhsblChecked = true
+	listings := dnsblLookup(zones, domain, false)
+	for _, l := range listings {
+		s.Log(fmt.Sprintf("RHSBL - sender domain %s listed by %s (%s)", domain, l.zone.zone, l.code))
+	}
+	s.dnsblListings = append(s.dnsblListings, listings...)
+}
+
+// dnsblVerdict returns the score of the sender and, if it must be
+// rejected, the reason
+func (s *SMTPServerSession) dnsblVerdict() (score int, reject string) {
+	for _, l := range s.dnsblListings {
+		switch l.zone.action {
+		case DNSBLReject:
+			if reject == "" {
+				reject = l.describe()
+			}
+		case DNSBLScore:
+			score += l.zone.weight
+		}
+	}
+	if threshold := Cfg.GetSmtpdDNSBLThreshold(); reject == "" && threshold > 0 && score >= threshold {
+		reject = fmt.Sprintf("DNSBL score %d", score)
+	}
+	return
+}
+
+// describe returns a description of the listing
+func (l dnsblListing) describe() string {
+	return l.kind() + " " + l.name + " listed by " + l.zone.zone
+}
+
+// kind returns what is listed
+func (l dnsblListing) kind() string {
+	if l.client {
+		return "client"
+	}
+	return "sender domain"
+}
+
+// dnsblHeader returns the X-Cocosmail-DNSBL header, empty if no lookup
+// was performed or if the sender is authenticated
+func (s *SMTPServerSession) dnsblHeader() string {
+	if s.user != nil || (!s.dnsblChecked && !s.rhsblChecked) {
+		return ""
+	}
+	score, _ := s.dnsblVerdict()
+	header := "X-Cocosmail-DNSBL: score=" + strconv.Itoa(score)
+	for _, l := range s.dnsblListings {
+		header += fmt.Sprintf(";\r\n        %s=%s (%s %s, %s", l.zone.zone, l.code, l.kind(), l.name, l.zone.action)
+		if l.zone.action == DNSBLScore {
+			header += " " + strconv.Itoa(l.zone.weight)
+		}
+		header += ")"
+	}
+	return header + "\r\n"
+}
@@ -0,0 +1,109 @@
+package core
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_parseDNSBLZones(t *testing.T) {
+	tests := []struct {
+		s      string
+		zones  int
+		action string
+		weight int
+		codes  int
+		valid  bool
+	}{
+		{"zen.spamhaus.org", 1, DNSBLScore, 1, 0, true},
+		{" Zen.Spamhaus.org. :REJECT", 1, DNSBLReject, 1, 0, true},
+		{"bl.example.org:tag:3", 1, DNSBLTag, 3, 0, true},
+		{"bl.example.org:score:2:127.0.0.2|127.0.0.4-127.0.0.11", 1, DNSBLScore, 2, 2, true},
+		{"bl.example.org::5", 1, DNSBLScore, 5, 0, true},
+		{"a.example.org,b.example.org:reject", 2, DNSBLScore, 1, 0, true},
+		{"", 0, "", 0, 0, true},
+		{"bl.example.org:drop", 0, "", 0, 0, false},
+		{"bl.example.org:score:x", 0, "", 0, 0, false},
+		{"bl.example.org:score:1:127.0.0", 0, "", 0, 0, false},
+		{"bl.example.org:score:1:127.0.0.2-x", 0, "", 0, 0, false},
+		{"bl.example.org:score:1:2001:db8::1", 0, "", 0, 0, false},
+		{":reject", 0, "", 0, 0, false},
+	}
+	for _, test := range tests {
+		zones, err := parseDNSBLZones(test.s)
+		if !test.valid {
+			assert.Error(t, err, test.s)
+			continue
+		}
+		assert.NoError(t, err, test.s)
+		assert.Equal(t, test.zones, len(zones), test.s)
+		if len(zones) == 0 {
+			continue
+		}
+		assert.Equal(t, test.action, zones[0].action, test.s)
+		assert.Equal(t, test.weight, zones[0].weight, test.s)
+		assert.Equal(t, test.codes, len(zones[0].codes), test.s)
+	}
+	zones, err := parseDNSBLZones(" Zen.Spamhaus.org. ")
+	assert.NoError(t, err)
+	assert.Equal(t, "zen.spamhaus.org", zones[0].zone)
+}
+
+func Test_listedBy(t *testing.T) {
+	anyCode, err := parseDNSBLZones("bl.example.org")
+	assert.NoError(t, err)
+	ranges, err := parseDNSBLZones("bl.example.org:score:1:127.0.0.2|127.0.0.4-127.0.0.11")
+	assert.NoError(t, err)
+	tests := []struct {
+		zone   dnsblZone
+		code   string
+		listed bool
+	}{
+		{anyCode[0], "127.0.0.2", true},
+		{anyCode[0], "127.0.0.255", true},
+		{anyCode[0], "127.255.255.254", false}, // query refused
+		{anyCode[0], "127.255.255.252", false},
+		{anyCode[0], "10.0.0.2", false},
+		{anyCode[0], "2001:db8::1", false},
+		{ranges[0], "127.0.0.2", true},
+		{ranges[0], "127.0.0.3", false},
+		{ranges[0], "127.0.0.4", true},
+		{ranges[0], "127.0.0.11", true},
+		{ranges[0], "127.0.0.12", false},
+		{ranges[0], "127.255.255.254", false},
+	}
+	for _, test := range tests {
+		assert.Equal(t, test.listed, test.zone.listedBy(net.ParseIP(test.code)), test.code)
+	}
+}
+
+func Test_dnsblVerdict(t *testing.T) {
+	Cfg = &Config{}
+	zones, err := parseDNSBLZones("a.example.org:score:2,b.example.org:score:1,c.example.org:tag,d.example.org:reject")
+	assert.NoError(t, err)
+	listing := func(z dnsblZone) dnsblListing {
+		return dnsblListing{zone: z, name: "192.0.2.1", code: "127.0.0.2", client: true}
+	}
+	tests := []struct {
+		threshold int
+		listings  []dnsblListing
+		score     int
+		reject    bool
+	}{
+		{0, nil, 0, false},
+		{0, []dnsblListing{listing(zones[0]), listing(zones[1])}, 3, false},
+		{3, []dnsblListing{listing(zones[0]), listing(zones[1])}, 3, true},
+		{4, []dnsblListing{listing(zones[0]), listing(zones[1])}, 3, false},
+		{1, []dnsblListing{listing(zones[2])}, 0, false},
+		{0, []dnsblListing{listing(zones[3])}, 0, true},
+		{0, []dnsblListing{listing(zones[0]), listing(zones[3])}, 2, true},
+	}
+	for i, test := range tests {
+		Cfg.cfg.SmtpdDNSBLThreshold = test.threshold
+		s := &SMTPServerSession{dnsblListings: test.listings}
+		score, reject := s.dnsblVerdict()
+		assert.Equal(t, test.score, score, i)
+		assert.Equal(t, test.reject, reject != "", i)
+	}
+}
@@ -0,0 +1,338 @@
+package core
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+// greylistBucket is the Bolt bucket of greylisted triplets
+var greylistBucket = []byte("greylist")
+
+var greylistJanitorOnce sync.Once
+
+// GreylistEntry represents a (client network, MAIL FROM, RCPT TO) triplet
+type GreylistEntry struct {
+	Network   string // client IP /24 or /64
+	MailFrom  string
+	RcptTo    string
+	FirstSeen time.Time
+	LastSeen  time.Time
+	PassedAt  time.Time // zero while greylisted
+	Attempts  int       // refused attempts
+}
+
+// Passed returns true if the triplet passed greylisting
+func (e *GreylistEntry) Passed() bool {
+	return !e.PassedAt.IsZero()
+}
+
+// expired returns true if a pending triplet was not retried in the retry
+// window, or if a triplet which passed was not seen for expire days
+func (e *GreylistEntry) expired(now time.Time) bool {
+	if !e.Passed() {
+		return now.Sub(e.FirstSeen) > time.Duration(Cfg.GetSmtpdGreylistRetryWindow())*time.Hour
+	}
+	return now.Sub(e.LastSeen) > time.Duration(Cfg.GetSmtpdGreylistExpire())*24*time.Hour
+}
+
+// GreylistWhitelist represents an IP, a network (CIDR) or a domain which
+// is not greylisted
+type GreylistWhitelist struct {
+	Id    int64
+	Entry string `sql:"unique"`
+}
+
+// greylistNetwork returns the network of a client IP: /24 for IPv4, /64
+// for IPv6, as clients may retry from another IP of their pool
+func greylistNetwork(ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		return (&net.IPNet{IP: ip4.Mask(net.CIDRMask(24, 32)), Mask: net.CIDRMask(24, 32)}).String()
+	}
+	return (&net.IPNet{IP: ip.Mask(net.CIDRMask(64, 128)), Mask: net.CIDRMask(64, 128)}).String()
+}
+
+// greylistCheck returns true if the triplet (ip, from, rcpt) can be
+// accepted: it is whitelisted or it was first seen more than
+// Cfg.GetSmtpdGreylistDelay() seconds ago
+func greylistCheck(ip net.IP, from, rcpt string) (pass bool, err error) {
+	if pass, err = greylistWhitelisted(ip, rcpt); err != nil || pass {
+		return
+	}
+	from, rcpt = strings.ToLower(from), strings.ToLower(rcpt)
+	network := greylistNetwork(ip)
+	key := []byte(network + " " + from + " " + rcpt)
+	delay := time.Duration(Cfg.GetSmtpdGreylistDelay()) * time.Second
+	now := time.Now()
+	err = Bolt.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(greylistBucket)
+		e := GreylistEntry{}
+		if v := b.Get(key); v != nil {
+			if err := json.Unmarshal(v, &e); err != nil {
+				return err
+			}
+		}
+		if e.FirstSeen.IsZero() || e.expired(now) {
+			e = GreylistEntry{
+				Network:   network,
+				MailFrom:  from,
+				RcptTo:    rcpt,
+				FirstSeen: now,
+			}
+		}
+		e.LastSeen = now
+		if !e.Passed() && now.Sub(e.FirstSeen) >= delay {
+			e.PassedAt = now
+		}
+		pass = e.Passed()
+		if !pass {
+			e.Attempts++
+		}
+		v, err := json.Marshal(e)
+		if err != nil {
+			return err
+		}
+		return b.Put(key, v)
+	})
+	return
+}
+
+// greylistWhitelisted returns true if the client IP, the recipient domain
+// or the verified host name of the client (iprev) is whitelisted
+// The sender domain is not used, it can be forged by anyone.
+func greylistWhitelisted(ip net.IP, rcpt string) (bool, error) {
+	entries, err := GreylistWhitelistGetAll()
+	if err != nil {
+		return false, err
+	}
+	rcptDomain := ""
+	if p := strings.LastIndex(rcpt, "@"); p != -1 {
+		rcptDomain = strings.ToLower(rcpt[p+1:])
+	}
+	var domains []string
+	for _, w := range entries {
+		if wIP := net.ParseIP(w.Entry); wIP != nil {
+			if wIP.Equal(ip) {
+				return true, nil
+			}
+			continue
+		}
+		if _, wNet, err := net.ParseCIDR(w.Entry); err == nil {
+			if wNet.Contains(ip) {
+				return true, nil
+			}
+			continue
+		}
+		if greylistDomainMatch(rcptDomain, w.Entry) {
+			return true, nil
+		}
+		domains = append(domains, w.Entry)
+	}
+	if len(domains) == 0 {
+		return false, nil
+	}
+	// client host name, only if it resolves back to the client IP
+	result, host := checkIPRev(ip.String())
+	if result != "pass" {
+		return false, nil
+	}
+	host = strings.ToLower(host)
+	for _, domain := range domains {
+		if greylistDomainMatch(host, domain) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// greylistDomainMatch returns true if domain is the whitelisted domain
+// entry or one of its subdomains
+func greylistDomainMatch(domain, entry string) bool {
+	return domain != "" && (domain == entry || strings.HasSuffix(domain, "."+entry))
+}
+
+// GreylistGetAll returns the greylisted triplets
+// When cocosmail is running, its Bolt database is locked and triplets are
+// requested to its REST server.
+func GreylistGetAll() (entries []GreylistEntry, err error) {
+	entries = []GreylistEntry{}
+	db := Bolt
+	if db == nil {
+		db, err = bolt.Open(GetBoltFilePath(), 0600, &bolt.Options{ReadOnly: true, Timeout: time.Second})
+		if err == bolt.ErrTimeout {
+			return greylistGetAllFromRestServer()
+		}
+		if err != nil {
+			return nil, errors.New("unable to open " + GetBoltFilePath() + " - " + err.Error())
+		}
+		defer db.Close()
+	}
+	err = db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(greylistBucket)
+		if b == nil {
+			return nil
+		}
+		return b.ForEach(func(k, v []byte) error {
+			e := GreylistEntry{}
+			if err := json.Unmarshal(v, &e); err != nil {
+				return err
+			}
+			entries = append(entries, e)
+			return nil
+		})
+	})
+	return
+}
+
+// greylistGetAllFromRestServer returns the greylisted triplets of the
+// running cocosmail from its REST server (GET /greylist)
+func greylistGetAllFromRestServer() ([]GreylistEntry, error) {
+	if !Cfg.GetRestServerLaunch() {
+		return nil, errors.New("greylist is locked by the running cocosmail and its REST server is not launched")
+	}
+	host := Cfg.GetRestServerIp()
+	if ip := net.ParseIP(host); ip != nil && ip.IsUnspecified() {
+		host = "127.0.0.1"
+	}
+	url := "http://"
+	client := &http.Client{Timeout: 30 * time.Second}
+	if Cfg.GetRestServerIsTls() {
+		url = "https://"
+		// local server, its certificate is usually self signed
+		client.Transport = &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}
+	}
+	url += net.JoinHostPort(host, strconv.Itoa(Cfg.GetRestServerPort())) + "/greylist"
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.SetBasicAuth(Cfg.GetRestServerLogin(), Cfg.GetRestServerPasswd())
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, errors.New("unable to get greylist from REST server - " + err.Error())
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.New("unable to get greylist from REST server - " + resp.Status)
+	}
+	var restEntries []struct {
+		Network   string    `json:"network"`
+		MailFrom  string    `json:"mailFrom"`
+		RcptTo    string    `json:"rcptTo"`
+		FirstSeen time.Time `json:"firstSeen"`
+		LastSeen  time.Time `json:"lastSeen"`
+		PassedAt  time.Time `json:"passedAt"`
+		Attempts  int       `json:"attempts"`
+	}
+	if err = json.NewDecoder(resp.Body).Decode(&restEntries); err != nil {
+		return nil, errors.New("bad greylist from REST server - " + err.Error())
+	}
+	entries := []GreylistEntry{}
+	for _, e := range restEntries {
+		entries = append(entries, GreylistEntry(e))
+	}
+	return entries, nil
+}
+
+// GreylistWhitelistAdd whitelists an IP, a network (CIDR) or a domain
+// A domain also whitelists its subdomains.
+func GreylistWhitelistAdd(entry string) error {
+	entry, err := normalizeGreylistWhitelistEntry(entry)
+	if err != nil {
+		return err
+	}
+	exists, err := greylistWhitelistExists(entry)
+	if err != nil || exists {
+		return err
+	}
+	return DB.Save(&GreylistWhitelist{Entry: entry}).Error
+}
+
+// GreylistWhitelistGetAll returns the whitelist
+func GreylistWhitelistGetAll() (entries []GreylistWhitelist, err error) {
+	entries = []GreylistWhitelist{}
+	err = DB.Order("entry").Find(&entries).Error
+	return
+}
+
+// GreylistWhitelistDel removes an entry of the whitelist
+func GreylistWhitelistDel(entry string) error {
+	entry, err := normalizeGreylistWhitelistEntry(entry)
+	if err != nil {
+		return err
+	}
+	exists, err := greylistWhitelistExists(entry)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return errors.New(entry + " is not whitelisted")
+	}
+	return DB.Where("entry = ?", entry).Delete(&GreylistWhitelist{}).Error
+}
+
+// greylistWhitelistExists returns true if entry is whitelisted
+func greylistWhitelistExists(entry string) (bool, error) {
+	count := 0
+	err := DB.Model(GreylistWhitelist{}).Where("entry = ?", entry).Count(&count).Error
+	return count != 0, err
+}
+
+// normalizeGreylistWhitelistEntry validates and normalizes a whitelist entry
+func normalizeGreylistWhitelistEntry(entry string) (string, error) {
+	entry = strings.ToLower(strings.TrimSpace(entry))
+	if ip := net.ParseIP(entry); ip != nil {
+		return ip.String(), nil
+	}
+	if _, ipNet, err := net.ParseCIDR(entry); err == nil {
+		return ipNet.String(), nil
+	}
+	entry = strings.TrimSuffix(entry, ".")
+	if entry == "" || strings.ContainsAny(entry, " @/:") || !strings.Contains(entry, ".") {
+		return "", errors.New("invalid IP, network or domain: " + entry)
+	}
+	return entry, nil
+}
+
+// greylistJanitor removes expired triplets every hour
+func greylistJanitor() {
+	for {
+		time.Sleep(time.Hour)
+		now := time.Now()
+		removed := 0
+		err := Bolt.Update(func(tx *bolt.Tx) error {
+			b := tx.Bucket(greylistBucket)
+			var expired [][]byte
+			err := b.ForEach(func(k, v []byte) error {
+				e := GreylistEntry{}
+				if err := json.Unmarshal(v, &e); err != nil || e.expired(now) {
+					expired = append(expired, append([]byte{}, k...))
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			for _, k := range expired {
+				if err = b.Delete(k); err != nil {
+					return err
+				}
+			}
+			removed = len(expired)
+			return nil
+		})
+		if err != nil {
+			Logger.Error("smtpd: unable to remove expired greylist entries - " + err.Error())
+		} else if removed != 0 {
+			Logger.Info("smtpd: " + strconv.Itoa(removed) + " expired greylist entries removed")
+		}
+	}
+}
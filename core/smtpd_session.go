@@ -3,21 +3,26 @@ package core
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"crypto/rand"
 	"crypto/tls"
 	"encoding/base64"
 	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"net"
 	"net/mail"
 	"path"
 	"runtime/debug"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"blitiri.com.ar/go/spf"
 	"github.com/jinzhu/gorm"
+	"github.com/stunndard/cocosmail/dmarc"
 	"github.com/stunndard/cocosmail/message"
 	"github.com/traefik/yaegi/interp"
 	"golang.org/x/crypto/bcrypt"
@@ -42,6 +47,11 @@ type SMTPServerSession struct {
 	uuid             string
 	Conn             net.Conn
 	connTLS          *tls.Conn
+	reader           *bufio.Reader // buffered input, keeps pipelined commands
+	outBuf           bytes.Buffer  // pending replies when the client pipelines
+	outMu            sync.Mutex
+	pipelining       bool
+	bdat             bool // BDAT transaction in progress
 	systemName       string
 	certName         string
 	YagPlugins       []YagPlugin
@@ -67,6 +77,11 @@ type SMTPServerSession struct {
 	exiting          bool
 	CurrentRawMail   []byte
 	SPFResult        spf.Result
+	dnsblTrusted     bool           // client is not checked against DNSBL/RHSBL
+	dnsblChecked     bool           // client IP was looked up in DNSBL zones
+	rhsblChecked     bool           // sender domain was looked up in RHSBL zones
+	dnsblListings    []dnsblListing // listings of client IP and sender domain
+	AuthResults      *AuthResults   // DKIM, SPF & iprev results of current message
 }
 
 // NewSMTPServerSession returns a new SMTP session
@@ -77,6 +92,7 @@ func NewSMTPServerSession(conn net.Conn, dsn Dsn) (*SMTPServerSession, error) {
 		certName:       dsn.CertName,
 		startAt:        time.Now(),
 		Conn:           conn,
+		reader:         bufio.NewReader(conn),
 		remoteAddr:     conn.RemoteAddr().String(),
 		RelayGranted:   false,
 		rcptCount:      0,
@@ -146,6 +162,7 @@ func (s *SMTPServerSession) ExitAsap() {
 
 	// Plugins
 	ExecSMTPdPlugins("exitasap", s)
+	s.flush()
 	_ = s.Conn.Close()
 }
 
@@ -158,10 +175,17 @@ func (s *SMTPServerSession) resetTimeout() {
 // Reset session
 func (s *SMTPServerSession) Reset() {
 	s.Envelope.MailFrom = ""
+	s.Envelope.Body = ""
+	s.Envelope.SMTPUTF8 = false
+	s.Envelope.Ret = ""
+	s.Envelope.EnvId = ""
+	s.Envelope.DSN = nil
 	s.seenMail = false
 	s.Envelope.RcptTo = []string{}
 	s.rcptCount = 0
 	s.CurrentRawMail = []byte{}
+	s.bdat = false
+	s.AuthResults = nil
 	s.resetTimeout()
 }
 
@@ -169,7 +193,7 @@ func (s *SMTPServerSession) Reset() {
 func (s *SMTPServerSession) Out(code uint32, msg string) {
 	if !s.exiting {
 		// _, _ = s.Conn.Write([]byte(msg + "\r\n"))
-		_, _ = s.Conn.Write([]byte(fmt.Sprintf("%d %s\r\n", code, msg)))
+		s.write([]byte(fmt.Sprintf("%d %s\r\n", code, msg)))
 		s.SMTPResponseCode = code
 		s.LogDebug(fmt.Sprintf("> %d %s", code, msg))
 		s.resetTimeout()
@@ -180,13 +204,60 @@ func (s *SMTPServerSession) Out(code uint32, msg string) {
 func (s *SMTPServerSession) OutMulti(code uint32, msg string) {
 	if !s.exiting {
 		// _, _ = s.Conn.Write([]byte(msg + "\r\n"))
-		_, _ = s.Conn.Write([]byte(fmt.Sprintf("%d-%s\r\n", code, msg)))
+		s.write([]byte(fmt.Sprintf("%d-%s\r\n", code, msg)))
 		s.SMTPResponseCode = code
 		s.LogDebug(fmt.Sprintf("> %d-%s", code, msg))
 		s.resetTimeout()
 	}
 }
 
+// write sends a reply to the client
+// if the client uses PIPELINING replies are buffered until the next flush
+func (s *SMTPServerSession) write(reply []byte) {
+	s.outMu.Lock()
+	defer s.outMu.Unlock()
+	if s.pipelining {
+		s.outBuf.Write(reply)
+		return
+	}
+	_, _ = s.Conn.Write(reply)
+}
+
+// flush sends buffered replies to the client
+func (s *SMTPServerSession) flush() {
+	s.outMu.Lock()
+	defer s.outMu.Unlock()
+	if s.outBuf.Len() == 0 {
+		return
+	}
+	_, _ = s.Conn.Write(s.outBuf.Bytes())
+	s.outBuf.Reset()
+}
+
+// isPipelinable returns true if the reply to verb can be buffered (RFC 2920 3.1)
+// all other commands are synchronization points
+func isPipelinable(verb string) bool {
+	switch verb {
+	case "mail", "rcpt", "rset", "bdat":
+		return true
+	}
+	return false
+}
+
+// isValidDSNNotify checks the value of the NOTIFY parameter (RFC 3461 4.1)
+func isValidDSNNotify(notify string) bool {
+	notify = strings.ToUpper(notify)
+	if notify == "NEVER" {
+		return true
+	}
+	for _, k := range strings.Split(notify, ",") {
+		if k != "SUCCESS" && k != "FAILURE" && k != "DELAY" {
+			return false
+		}
+	}
+	return true
+}
+
 // Log helper for INFO log
 func (s *SMTPServerSession) Log(msg ...string) {
 	Logger.Info("smtpd ", s.uuid, "-", s.Conn.RemoteAddr().String(), "-", strings.Join(msg, " "))
@@ -215,7 +286,7 @@ func (s *SMTPServerSession) strayNewline() {
 func (s *SMTPServerSession) purgeConn() (err error) {
 	ch := make([]byte, 1)
 	for {
-		_, err = s.Conn.Read(ch)
+		_, err = s.reader.Read(ch)
 		if err != nil {
 			return
 		}
@@ -256,6 +327,9 @@ func (s *SMTPServerSession) smtpGreeting() {
 		return
 	}
 
+	// DNSBL, listed clients are rejected at MAIL FROM unless they authenticate
+	s.dnsblCheckClient()
+
 	greeting := s.systemName + " ESMTP " + s.uuid
 	if !Cfg.GetHideServerSignature() {
 		greeting += " - cocosmail " + Version
@@ -336,6 +410,18 @@ func (s *SMTPServerSession) smtpEhlo(msg []string) {
 		// Extensions
 		// Size
 		s.OutMulti(250, fmt.Sprintf("SIZE %d", Cfg.GetSmtpdMaxDataBytes()))
+		s.OutMulti(250, "8BITMIME")
+		s.OutMulti(250, "SMTPUTF8")
+		s.OutMulti(250, "DSN")
+		// Pipelining
+		if Cfg.GetSmtpdPipelining() {
+			s.OutMulti(250, "PIPELINING")
+			s.pipelining = true
+		}
+		// Chunking
+		if Cfg.GetSmtpdChunking() {
+			s.OutMulti(250, "CHUNKING")
+		}
 		if !s.tls {
 			// no auth is allowed over non-secure coonection
 			s.Out(250, "STARTTLS")
@@ -362,7 +448,7 @@ func (s *SMTPServerSession) smtpMailFrom(msg []string) {
 	}
 	msgLen := len(msg)
 	// mail from ?
-	if msgLen == 1 || !strings.HasPrefix(strings.ToLower(msg[1]), "from:") || msgLen > 4 {
+	if msgLen == 1 || !strings.HasPrefix(strings.ToLower(msg[1]), "from:") {
 		s.Log(fmt.Sprintf("MAIL - Bad syntax: %s", strings.Join(msg, " ")))
 		s.pause(2)
 		s.Out(501, "5.5.4 Syntax: MAIL FROM:<address> [SIZE]")
@@ -393,49 +479,91 @@ func (s *SMTPServerSession) smtpMailFrom(msg []string) {
 		s.Envelope.MailFrom = ""
 	}
 
-	// Extensions size
-	if len(extension) != 0 {
-		// Only SIZE is supported (and announced)
-		if len(extension) > 1 {
-			s.Log(fmt.Sprintf("MAIL - Bad syntax: %s", strings.Join(msg, " ")))
-			s.pause(2)
-			s.Out(501, "5.5.4 Syntax: MAIL FROM:<address> [SIZE]")
-			return
-		}
+	// Extensions
+	for _, ext := range extension {
+		extValue := strings.SplitN(ext, "=", 2)
+		switch strings.ToLower(extValue[0]) {
 		// SIZE
-		extValue := strings.Split(extension[0], "=")
-		if len(extValue) != 2 {
-			s.Log(fmt.Sprintf("MAIL FROM - Bad syntax : %s ", strings.Join(msg, " ")))
-			s.pause(2)
-			s.Out(501, "5.5.4 Syntax: MAIL FROM:<address> [SIZE]")
-			return
-		}
-		if strings.ToLower(extValue[0]) != "size" {
-			s.Log(fmt.Sprintf("MAIL FROM - Unsuported extension : %s ", extValue[0]))
-			s.pause(2)
-			s.Out(501, "5.5.4 Invalid arguments")
-			return
-		}
-		if Cfg.GetSmtpdMaxDataBytes() != 0 {
-			size, err := strconv.ParseUint(extValue[1], 10, 64)
-			if err != nil {
-				s.Log(fmt.Sprintf("MAIL FROM - bad value for size extension SIZE=%v", extValue[1]))
+		case "size":
+			if len(extValue) != 2 {
+				s.Log(fmt.Sprintf("MAIL FROM - Bad syntax : %s ", strings.Join(msg, " ")))
+				s.pause(2)
+				s.Out(501, "5.5.4 Syntax: MAIL FROM:<address> [SIZE]")
+				return
+			}
+			if Cfg.GetSmtpdMaxDataBytes() != 0 {
+				size, err := strconv.ParseUint(extValue[1], 10, 64)
+				if err != nil {
+					s.Log(fmt.Sprintf("MAIL FROM - bad value for size extension SIZE=%v", extValue[1]))
+					s.pause(2)
+					s.Out(501, "5.5.4 Invalid arguments")
+					return
+				}
+				if size > Cfg.GetSmtpdMaxDataBytes() {
+					s.Log(fmt.Sprintf("MAIL FROM - message exceeds fixed maximum message size %d/%d", size,
+						Cfg.GetSmtpdMaxDataBytes()))
+					s.Out(552, "message exceeds fixed maximum message size")
+					s.pause(1)
+					return
+				}
+			}
+		// 8BITMIME
+		case "body":
+			if len(extValue) != 2 {
+				s.Log(fmt.Sprintf("MAIL FROM - Bad syntax : %s ", strings.Join(msg, " ")))
+				s.pause(2)
+				s.Out(501, "5.5.4 Syntax: MAIL FROM:<address> [BODY=7BIT|8BITMIME]")
+				return
+			}
+			body := strings.ToUpper(extValue[1])
+			if body != "7BIT" && body != "8BITMIME" {
+				s.Log(fmt.Sprintf("MAIL FROM - unsupported body type BODY=%v", extValue[1]))
+				s.pause(2)
+				s.Out(501, "5.5.4 Invalid arguments")
+				return
+			}
+			s.Envelope.Body = body
+		// SMTPUTF8
+		case "smtputf8":
+			if len(extValue) != 1 {
+				s.Log(fmt.Sprintf("MAIL FROM - Bad syntax : %s ", strings.Join(msg, " ")))
 				s.pause(2)
 				s.Out(501, "5.5.4 Invalid arguments")
 				return
 			}
-			if size > Cfg.GetSmtpdMaxDataBytes() {
-				s.Log(fmt.Sprintf("MAIL FROM - message exceeds fixed maximum message size %d/%d", size,
-					Cfg.GetSmtpdMaxDataBytes()))
-				s.Out(552, "message exceeds fixed maximum message size")
-				s.pause(1)
+			s.Envelope.SMTPUTF8 = true
+		// DSN
+		case "ret":
+			ret := ""
+			if len(extValue) == 2 {
+				ret = strings.ToUpper(extValue[1])
+			}
+			if ret != "FULL" && ret != "HDRS" {
+				s.Log(fmt.Sprintf("MAIL FROM - Bad syntax : %s ", strings.Join(msg, " ")))
+				s.pause(2)
+				s.Out(501, "5.5.4 Syntax: MAIL FROM:<address> [RET=FULL|HDRS]")
 				return
 			}
+			s.Envelope.Ret = ret
+		case "envid":
+			if len(extValue) != 2 || len(extValue[1]) == 0 || len(extValue[1]) > 100 || !message.IsXtext(extValue[1]) {
+				s.Log(fmt.Sprintf("MAIL FROM - Bad syntax : %s ", strings.Join(msg, " ")))
+				s.pause(2)
+				s.Out(501, "5.5.4 Syntax: MAIL FROM:<address> [ENVID=xtext]")
+				return
+			}
+			s.Envelope.EnvId = extValue[1]
+		default:
+			s.Log(fmt.Sprintf("MAIL FROM - Unsuported extension : %s ", extValue[0]))
+			s.pause(2)
+			s.Out(501, "5.5.4 Invalid arguments")
+			return
 		}
 	}
 
 	// remove <>
 	s.Envelope.MailFrom = RemoveBrackets(s.Envelope.MailFrom)
+	senderDomain := ""
 
 	// mail from is valid ?
 	reversePathlen := len(s.Envelope.MailFrom)
@@ -446,6 +574,13 @@ func (s *SMTPServerSession) smtpMailFrom(msg []string) {
 			s.Out(550, "reverse path must be lower than 255 char (RFC 5321 4.5.1.3.1)")
 			return
 		}
+		// RFC 6531 3.4: non-ASCII addresses need SMTPUTF8
+		if !s.Envelope.SMTPUTF8 && !message.Is7Bit([]byte(s.Envelope.MailFrom)) {
+			s.Log("MAIL - non-ASCII address without SMTPUTF8: " + s.Envelope.MailFrom)
+			s.pause(2)
+			s.Out(553, "5.6.7 non-ASCII addresses require SMTPUTF8")
+			return
+		}
 		localDomain := strings.Split(s.Envelope.MailFrom, "@")
 		if len(localDomain) == 1 {
 			s.Log("MAIL - invalid address " + localDomain[0])
@@ -482,7 +617,20 @@ func (s *SMTPServerSession) smtpMailFrom(msg []string) {
 			s.Out(550, "5.5.2 need fully-qualified hostname for domain part")
 			return
 		}
+		senderDomain = localDomain[1]
 	}
+
+	// DNSBL & RHSBL, authenticated users are not checked
+	if s.user == nil {
+		s.rhsblCheckSender(senderDomain)
+		if _, reject := s.dnsblVerdict(); reject != "" {
+			s.Log("MAIL - rejected by DNSBL - " + reject)
+			s.pause(2)
+			s.Out(550, "5.7.1 Rejected, "+reject)
+			return
+		}
+	}
+
 	// Plugin - hook "mailpost"
 	done, drop := ExecSMTPdPlugins("mailpost", s)
 	if done || drop {
@@ -539,12 +687,19 @@ func (s *SMTPServerSession) smtpRcptTo(msg []string) {
 		return
 	}
 
-	// rcpt to: user
+	// rcpt to:<user> EXT || rcpt to: <user> EXT
+	var extension []string
 	if len(msg[1]) > 3 {
 		t := strings.Split(msg[1], ":")
 		s.LastRcptTo = strings.Join(t[1:], ":")
+		if len(msg) > 2 {
+			extension = msg[2:]
+		}
 	} else if len(msg) > 2 {
 		s.LastRcptTo = msg[2]
+		if len(msg) > 3 {
+			extension = msg[3:]
+		}
 	}
 
 	if len(s.LastRcptTo) == 0 {
@@ -555,6 +710,36 @@ func (s *SMTPServerSession) smtpRcptTo(msg []string) {
 	}
 	s.LastRcptTo = RemoveBrackets(s.LastRcptTo)
 
+	// Extensions
+	rcptDSN := message.RcptDSN{}
+	for _, ext := range extension {
+		extValue := strings.SplitN(ext, "=", 2)
+		switch strings.ToLower(extValue[0]) {
+		// DSN
+		case "notify":
+			if len(extValue) != 2 || !isValidDSNNotify(extValue[1]) {
+				s.Log(fmt.Sprintf("RCPT TO - Bad syntax : %s ", strings.Join(msg, " ")))
+				s.pause(2)
+				s.Out(501, "5.5.4 Syntax: RCPT TO:<address> [NOTIFY=NEVER|SUCCESS,FAILURE,DELAY]")
+				return
+			}
+			rcptDSN.Notify = strings.ToUpper(extValue[1])
+		case "orcpt":
+			if len(extValue) != 2 || len(extValue[1]) > 500 || !strings.Contains(extValue[1], ";") || !message.IsXtext(extValue[1]) {
+				s.Log(fmt.Sprintf("RCPT TO - Bad syntax : %s ", strings.Join(msg, " ")))
+				s.pause(2)
+				s.Out(501, "5.5.4 Syntax: RCPT TO:<address> [ORCPT=addr-type;xtext]")
+				return
+			}
+			rcptDSN.ORcpt = extValue[1]
+		default:
+			s.Log(fmt.Sprintf("RCPT TO - Unsuported extension : %s ", extValue[0]))
+			s.pause(2)
+			s.Out(501, "5.5.4 Invalid arguments")
+			return
+		}
+	}
+
 	// We MUST recognize source route syntax but SHOULD strip off source routing
 	// RFC 5321 4.1.1.3
 	t := strings.SplitAfter(s.LastRcptTo, ":")
@@ -564,6 +749,14 @@ func (s *SMTPServerSession) smtpRcptTo(msg []string) {
 	if strings.ToLower(s.LastRcptTo) == "postmaster" {
 		s.LastRcptTo += "@" + s.systemName
 	}
+	// RFC 6531 3.4: non-ASCII addresses need SMTPUTF8
+	if !s.Envelope.SMTPUTF8 && !message.Is7Bit([]byte(s.LastRcptTo)) {
+		s.Log("RCPT - non-ASCII address without SMTPUTF8: " + s.LastRcptTo)
+		s.pause(2)
+		s.Out(553, "5.6.7 non-ASCII addresses require SMTPUTF8")
+		return
+	}
+
 	// Check validity
 	_, err = mail.ParseAddress(s.LastRcptTo)
 	if err != nil {
@@ -664,7 +857,7 @@ func (s *SMTPServerSession) smtpRcptTo(msg []string) {
 
 	// check spf
 	if Cfg.GetSmtpdSPFCheck() {
-		spfResult, _ := spf.CheckHostWithSender(remoteIP, s.helo, s.Envelope.MailFrom, spf.OverrideLookupLimit(50))
+		spfResult, _ := spf.CheckHostWithSender(remoteIP, s.helo, s.Envelope.MailFrom, spf.OverrideLookupLimit(50), spf.WithResolver(DNS))
 		s.SPFResult = spfResult
 		s.LogDebug(fmt.Sprintf("RCPT - SPF Mail From: %s, SPF result: %s", s.Envelope.MailFrom, spfResult))
 
@@ -726,9 +919,29 @@ func (s *SMTPServerSession) smtpRcptTo(msg []string) {
 		return
 	}
 
+	// Greylisting
+	// on error the recipient is accepted, mails must not be lost because of
+	// a failing cache
+	if Cfg.GetSmtpdGreylistEnabled() && s.user == nil && !canRelay {
+		pass, err := greylistCheck(remoteIP, s.Envelope.MailFrom, s.LastRcptTo)
+		if err != nil {
+			s.LogError("RCPT - greylisting failed - " + err.Error())
+		} else if !pass {
+			s.Log("RCPT - greylisted - from " + s.Envelope.MailFrom + " to " + s.LastRcptTo)
+			s.Out(451, "4.7.1 Greylisted, please try again later")
+			return
+		}
+	}
+
 	// Check if there is already this recipient
 	if !IsStringInSlice(s.LastRcptTo, s.Envelope.RcptTo) {
 		s.Envelope.RcptTo = append(s.Envelope.RcptTo, s.LastRcptTo)
+		if rcptDSN != (message.RcptDSN{}) {
+			if s.Envelope.DSN == nil {
+				s.Envelope.DSN = make(map[string]message.RcptDSN)
+			}
+			s.Envelope.DSN[s.LastRcptTo] = rcptDSN
+		}
 		s.Log("RCPT - + " + s.LastRcptTo)
 	}
 	s.Out(250, "OK")
@@ -853,7 +1066,7 @@ func (s *SMTPServerSession) smtpExpn(_ []string) {
 // Voir un truc comme DATA -> temp file -> mv queue file
 func (s *SMTPServerSession) smtpData(msg []string) {
 	defer s.recoverOnPanic()
-	if !s.seenMail || len(s.Envelope.RcptTo) == 0 {
+	if !s.seenMail || len(s.Envelope.RcptTo) == 0 || s.bdat {
 		s.Log("DATA - out of sequence")
 		s.pause(2)
 		s.Out(503, "5.5.1 command out of sequence")
@@ -867,6 +1080,8 @@ func (s *SMTPServerSession) smtpData(msg []string) {
 		return
 	}
 	s.Out(354, "End data with <CR><LF>.<CR><LF>")
+	// DATA is a synchronization point, client waits for 354
+	s.flush()
 
 	// Get RAW mail
 	s.CurrentRawMail = make([]byte, 0, 1024*1024)
@@ -881,37 +1096,17 @@ func (s *SMTPServerSession) smtpData(msg []string) {
 	headers := ""
 	doneHeaders := false
 	doneEmail := false
+	bareNewline := false
 	var line []byte
+	var err error
 	lines := uint64(0)
 
-	sc := bufio.NewScanner(bufio.NewReader(s.Conn))
-	split := func(data []byte, atEOF bool) (advance int, token []byte, err error) {
-		if atEOF && len(data) == 0 {
-			return 0, nil, nil
-		}
-		if i := bytes.Index(data, []byte{CR, LF}); i >= 0 {
-			// We have a full newline-terminated line.
-			return i + 2, data[0 : i+2], nil
-		}
-		// If we're at EOF, we have a final, non-terminated line. Return it.
-		if atEOF {
-			return len(data), data, nil
-		}
-		// If the line is too long.
-		if len(data) > 1000 {
-			return 0, nil, errors.New("SMTP line too long")
-		}
-		// Request more data.
-		return 0, nil, nil
-	}
-	sc.Split(split)
-
 	for {
-		if !sc.Scan() {
-			err := sc.Err()
+		line, err = s.readDataLine(1000)
+		if err != nil {
 			z := ""
-			if err == nil {
-				// scan ended, but if this a real EOF?
+			if err == io.EOF {
+				// read ended, but if this a real EOF?
 				// we check doneEmail later
 				break
 			} else {
@@ -931,12 +1126,13 @@ func (s *SMTPServerSession) smtpData(msg []string) {
 			return
 		}
 
-		line = sc.Bytes()
-
 		if bytes.Equal(line, []byte{0x2E, CR, LF}) {
 			doneEmail = true
 			break
 		}
+		if hasBareNewline(line) {
+			bareNewline = true
+		}
 
 		if !doneHeaders {
 			// count hops in headers
@@ -1002,7 +1198,156 @@ func (s *SMTPServerSession) smtpData(msg []string) {
 		s.ExitAsap()
 		return
 	}
+	// bare CR or LF are refused once the whole message has been read, to
+	// stay in sync with the client (RFC 5321 2.3.8)
+	if bareNewline {
+		s.Log("DATA - message refused, bare CR or LF in data")
+		s.Out(554, "5.6.0 bare CR or LF not allowed in message data")
+		s.Reset()
+		return
+	}
+
+	s.queueCurrentMail()
+}
 
+// BDAT
+// RFC 3030 CHUNKING: the message is sent in chunks of explicit size,
+// the last one is flagged by LAST
+func (s *SMTPServerSession) smtpBdat(msg []string) {
+	defer s.recoverOnPanic()
+
+	if len(msg) < 2 || len(msg) > 3 || (len(msg) == 3 && strings.ToLower(msg[2]) != "last") {
+		s.Log("BDAT - invalid syntax: " + strings.Join(msg, " "))
+		s.pause(2)
+		s.Out(501, "5.5.4 Syntax: BDAT <size> [LAST]")
+		return
+	}
+	size, err := strconv.ParseUint(msg[1], 10, 64)
+	if err != nil {
+		s.Log("BDAT - invalid chunk size: " + strings.Join(msg, " "))
+		s.pause(2)
+		s.Out(501, "5.5.4 Syntax: BDAT <size> [LAST]")
+		return
+	}
+	last := len(msg) == 3
+
+	// the chunk has to be read even if it is rejected
+	if !s.seenMail || len(s.Envelope.RcptTo) == 0 {
+		s.Log("BDAT - out of sequence")
+		if err = s.readChunk(size, ioutil.Discard); err != nil {
+			s.LogError("BDAT - error receiving: " + err.Error())
+			s.ExitAsap()
+			return
+		}
+		s.pause(2)
+		s.Out(503, "5.5.1 command out of sequence")
+		return
+	}
+
+	// first chunk
+	if !s.bdat {
+		s.bdat = true
+		s.CurrentRawMail = make([]byte, 0, 1024*1024)
+		s.dataBytes = 0
+	}
+
+	maxDataBytes := Cfg.GetSmtpdMaxDataBytes()
+	if maxDataBytes != 0 && s.dataBytes+size > maxDataBytes {
+		s.Log(fmt.Sprintf("BDAT - Message size (%d) exceeds maxDataBytes (%d).", s.dataBytes+size, maxDataBytes))
+		if err = s.readChunk(size, ioutil.Discard); err != nil {
+			s.LogError("BDAT - error receiving: " + err.Error())
+			s.ExitAsap()
+			return
+		}
+		s.Out(552, "5.3.4 sorry, that message size exceeds my databytes limit")
+		s.Reset()
+		return
+	}
+
+	buf := bytes.NewBuffer(s.CurrentRawMail)
+	if err = s.readChunk(size, buf); err != nil {
+		s.LogError("BDAT - error receiving: " + err.Error())
+		s.Out(454, "something wrong happened when reading data from you")
+		s.ExitAsap()
+		return
+	}
+	s.CurrentRawMail = buf.Bytes()
+	s.dataBytes += size
+
+	if !last {
+		s.Out(250, fmt.Sprintf("2.0.0 %d octets received", size))
+		return
+	}
+	s.Log(fmt.Sprintf("BDAT - received %d bytes", s.dataBytes))
+
+	// headers checks, DATA does them while receiving
+	hops, headersSize, doneHeaders := rawHeadersInfo(s.CurrentRawMail)
+	if headersSize > MAXTOTALHEADERSIZE {
+		s.Log(fmt.Sprintf("BDAT - Headers in the message are too long: %d", headersSize))
+		s.Out(500, "headers in this message are too long")
+		s.Reset()
+		return
+	}
+	if hops > Cfg.GetSmtpdMaxHops() {
+		s.Log(fmt.Sprintf("BDAT - Message is looping. Hops : %d", hops))
+		s.Out(554, "5.4.6 too many hops, this message is looping")
+		s.Reset()
+		return
+	}
+
+	// If no headers in the message, treat the data as the message body only
+	if !doneHeaders {
+		s.CurrentRawMail = append([]byte{CR, LF}, s.CurrentRawMail...)
+	}
+
+	s.queueCurrentMail()
+}
+
+// readChunk reads exactly size bytes from the client and writes them to w
+func (s *SMTPServerSession) readChunk(size uint64, w io.Writer) error {
+	if s.reader.Buffered() == 0 {
+		s.flush()
+	}
+	for size > 0 {
+		n := uint64(64 * 1024)
+		if size < n {
+			n = size
+		}
+		if _, err := io.CopyN(w, s.reader, int64(n)); err != nil {
+			return err
+		}
+		size -= n
+		s.resetTimeout()
+	}
+	return nil
+}
+
+// rawHeadersInfo returns the number of hops (Received and Delivered headers),
+// the size of the headers and if the end of the headers was found
+func rawHeadersInfo(raw []byte) (hops, size int, doneHeaders bool) {
+	for len(raw) != 0 {
+		i := bytes.Index(raw, []byte{CR, LF})
+		if i == -1 {
+			return
+		}
+		if i == 0 {
+			doneHeaders = true
+			return
+		}
+		line := bytes.ToLower(raw[:i])
+		if bytes.HasPrefix(line, []byte("received: ")) || bytes.HasPrefix(line, []byte("delivered: ")) {
+			hops++
+		}
+		size += i + 2
+		raw = raw[i+2:]
+	}
+	return
+}
+
+// queueCurrentMail runs the received message through the scanner, adds
+// our headers, calls plugins and puts the message in queue.
+// It's shared by DATA and BDAT.
+func (s *SMTPServerSession) queueCurrentMail() {
 	// scan
 	// clamav
 	if Cfg.GetSmtpdClamavEnabled() {
@@ -1025,6 +1370,26 @@ func (s *SMTPServerSession) smtpData(msg []string) {
 		}
 	}
 
+	// DKIM & iprev are checked before our headers are added
+	clientIP, _, _ := net.SplitHostPort(s.Conn.RemoteAddr().String())
+	s.AuthResults = s.authenticate(clientIP)
+	var forged int
+	if s.CurrentRawMail, forged = stripForgedAuthResults(s.CurrentRawMail); forged != 0 {
+		s.Log(fmt.Sprintf("MAIL - %d forged Authentication-Results header(s) removed", forged))
+	}
+
+	// DMARC
+	switch action, reason := s.checkDMARC(clientIP); action {
+	case dmarc.PolicyReject:
+		s.Log("MAIL - rejected by " + reason)
+		s.pause(2)
+		s.Out(550, "5.7.1 Rejected by "+reason)
+		s.Reset()
+		return
+	case dmarc.PolicyQuarantine:
+		s.CurrentRawMail = append([]byte(quarantineHeader+": "+reason+"\r\n"), s.CurrentRawMail...)
+	}
+
 	// Message-ID
 	HeaderMessageID := message.RawGetMessageId(&s.CurrentRawMail)
 	if len(HeaderMessageID) == 0 {
@@ -1049,7 +1414,7 @@ func (s *SMTPServerSession) smtpData(msg []string) {
 		remoteIP = "unknown"
 	}
 	remoteHost := "unknown"
-	remoteHosts, err := net.LookupAddr(remoteIP)
+	remoteHosts, err := DNS.LookupAddr(context.Background(), remoteIP)
 	if err == nil {
 		remoteHost = strings.TrimSuffix(remoteHosts[0], ".")
 	}
@@ -1122,6 +1487,14 @@ func (s *SMTPServerSession) smtpData(msg []string) {
 		s.CurrentRawMail = append([]byte(recvSPF), s.CurrentRawMail...)
 	}
 
+	// DNSBL & RHSBL listings
+	if header := s.dnsblHeader(); header != "" {
+		s.CurrentRawMail = append([]byte(header), s.CurrentRawMail...)
+	}
+
+	// Authentication-Results (RFC 8601), plugins can read s.AuthResults
+	s.CurrentRawMail = append([]byte(s.AuthResults.Header(s.Envelope.MailFrom, s.helo, remoteIP)), s.CurrentRawMail...)
+
 	// Plugins
 	_, drop := ExecSMTPdPlugins("data", s)
 	if drop {
@@ -1197,6 +1570,7 @@ func (s *SMTPServerSession) smtpStartTLS() {
 	tlsConfig.Rand = rand.Reader
 
 	s.Out(220, "Ready to start TLS nego")
+	s.flush()
 
 	s.connTLS = tls.Server(s.Conn, &tlsConfig)
 	// run a handshake
@@ -1217,17 +1591,23 @@ func (s *SMTPServerSession) smtpStartTLS() {
 			" " + tlsGetCipherSuite(s.connTLS.ConnectionState().CipherSuite),
 	)
 	s.Conn = s.connTLS
+	// discard anything the client sent before the TLS handshake (RFC 3207 4.2)
+	s.reader = bufio.NewReader(s.Conn)
+	s.pipelining = false
 	s.tls = true
 	s.seenHelo = false
 }
 
 // Read one line of SMTP command or text.
-// Uses 1-byte read from socket.
+// Uses 1-byte read from the session reader.
 func (s *SMTPServerSession) readLine() (line string, err error) {
 	ch := make([]byte, 1)
 	for {
 		s.resetTimeout()
-		_, err := s.Conn.Read(ch)
+		if s.reader.Buffered() == 0 {
+			s.flush()
+		}
+		ch[0], err = s.reader.ReadByte()
 		if err != nil {
 			if err.Error() == "EOF" {
 				s.LogDebug(s.Conn.RemoteAddr().String(), "- Client sent EOF")
@@ -1262,54 +1642,29 @@ func (s *SMTPServerSession) readLine() (line string, err error) {
 }
 
 // Read one line of SMTP command or text.
-// Uses a scanner.
+// Uses the session buffered reader, so pipelined commands
+// are kept for the next call.
 func (s *SMTPServerSession) readLine2() (line string, err error) {
-	sc := bufio.NewScanner(bufio.NewReader(s.Conn))
-	split := func(data []byte, atEOF bool) (advance int, token []byte, err error) {
-		if atEOF && len(data) == 0 {
-			return 0, nil, nil
-		}
-		if i := bytes.Index(data, []byte{CR, LF}); i >= 0 {
-			// We have a full newline-terminated line.
-			return i + 2, data[0 : i+2], nil
-		}
-		// If we're at EOF, we have a final, non-terminated line. Return it.
-		if atEOF {
-			return 0, nil, errors.New("SMTP line not terminated")
+	raw, err := s.readRawLine(512)
+	if err != nil {
+		if err == io.EOF && len(raw) == 0 {
+			s.LogDebug("- Client sent EOF")
+			s.ExitAsap()
+			return "", errors.New("client sent EOF")
 		}
-		// If the line is too long.
-		if len(data) > 512 {
-			return 0, nil, errors.New("SMTP line too long")
+		if err == io.EOF {
+			err = errors.New("SMTP line not terminated")
 		}
-		// Request more data.
-		return 0, nil, nil
-	}
-	sc.Split(split)
-
-	if !sc.Scan() {
-		err := sc.Err()
-		if err != nil {
-			if err.Error() == "EOF" {
-				s.LogDebug(s.Conn.RemoteAddr().String(), "- Client sent EOF")
-			} else if strings.Contains(err.Error(), "connection reset by peer") {
-				s.Log(err.Error())
-			} else if !strings.Contains(err.Error(), "use of closed network connection") {
-				s.LogError("unable to read data from client - ", err.Error())
-			}
-			s.ExitAsap()
-			return "", err
-			/*
-				s.LogError(fmt.Sprintf("error receiving line: %s", err.Error()))
-				s.Out(500, err.Error())
-				return line, err
-			*/
+		if strings.Contains(err.Error(), "connection reset by peer") {
+			s.Log(err.Error())
+		} else if !strings.Contains(err.Error(), "use of closed network connection") {
+			s.LogError("unable to read data from client - ", err.Error())
 		}
-		s.LogDebug("- Client sent EOF")
 		s.ExitAsap()
-		return "", errors.New("client sent EOF")
+		return "", err
 	}
 
-	line = string(sc.Bytes())
+	line = string(raw)
 
 	if !strings.HasSuffix(line, "\r\n") {
 		errmsg := "SMTP line malformed, not ending with <CR><LF>"
@@ -1321,6 +1676,65 @@ func (s *SMTPServerSession) readLine2() (line string, err error) {
 	return line[:len(line)-2], err
 }
 
+// readRawLine reads from the client up to and including the next LF.
+// Pending replies are flushed before waiting for the client.
+// It fails if the line, LF included, is longer than max bytes.
+func (s *SMTPServerSession) readRawLine(max int) (line []byte, err error) {
+	if s.reader.Buffered() == 0 {
+		s.flush()
+	}
+	return readLineLF(s.reader, max)
+}
+
+// readDataLine reads a line of DATA from the client up to and including
+// the next CRLF.
+// Pending replies are flushed before waiting for the client.
+func (s *SMTPServerSession) readDataLine(max int) (line []byte, err error) {
+	if s.reader.Buffered() == 0 {
+		s.flush()
+	}
+	return readLineCRLF(s.reader, max)
+}
+
+// readLineLF reads from r up to and including the next LF
+// It fails if the line, LF included, is longer than max bytes.
+func readLineLF(r *bufio.Reader, max int) (line []byte, err error) {
+	for {
+		var chunk []byte
+		chunk, err = r.ReadSlice(LF)
+		line = append(line, chunk...)
+		// max includes the terminating CRLF
+		if len(line) > max {
+			return line, errors.New("SMTP line too long")
+		}
+		if err != bufio.ErrBufferFull {
+			return
+		}
+	}
+}
+
+// readLineCRLF reads from r up to and including the next CRLF
+// A bare LF doesn't end the line, so "\n.\r\n" can't end DATA (SMTP
+// smuggling). It fails if the line, CRLF included, is longer than max
+// bytes.
+func readLineCRLF(r *bufio.Reader, max int) (line []byte, err error) {
+	for {
+		var chunk []byte
+		chunk, err = readLineLF(r, max-len(line))
+		line = append(line, chunk...)
+		if err != nil || bytes.HasSuffix(line, []byte{CR, LF}) {
+			return
+		}
+	}
+}
+
+// hasBareNewline returns true if line has a CR or a LF which is not part
+// of its terminating CRLF
+func hasBareNewline(line []byte) bool {
+	line = bytes.TrimSuffix(line, []byte{CR, LF})
+	return bytes.IndexByte(line, CR) != -1 || bytes.IndexByte(line, LF) != -1
+}
+
 // SMTP AUTH
 func (s *SMTPServerSession) smtpAuth(rawMsg string) {
 	defer s.recoverOnPanic()
@@ -1592,6 +2006,8 @@ func (s *SMTPServerSession) handle() {
 				s.smtpRcptTo(smtpArgs)
 			case "data":
 				s.smtpData(smtpArgs)
+			case "bdat":
+				s.smtpBdat(smtpArgs)
 			case "starttls":
 				s.smtpStartTLS()
 			case "auth":
@@ -1610,6 +2026,10 @@ func (s *SMTPServerSession) handle() {
 				s.Log("plugin terminating session")
 				s.ExitAsap()
 			}
+			// RFC 2920: replies to grouped commands are sent as a unit
+			if !isPipelinable(verb) || s.reader.Buffered() == 0 {
+				s.flush()
+			}
 		}
 		//s.resetTimeout()
 		s.lastClientCmd = []byte{}
@@ -0,0 +1,39 @@
+package core
+
+import (
+	"bufio"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_readLineCRLF(t *testing.T) {
+	// a bare LF followed by a dot doesn't end DATA (SMTP smuggling)
+	r := bufio.NewReader(strings.NewReader("foo\n.\r\nMAIL FROM:<a@example.com>\r\n.\r\n"))
+	line, err := readLineCRLF(r, 1000)
+	assert.NoError(t, err)
+	assert.Equal(t, "foo\n.\r\n", string(line))
+	assert.True(t, hasBareNewline(line))
+	line, err = readLineCRLF(r, 1000)
+	assert.NoError(t, err)
+	assert.Equal(t, "MAIL FROM:<a@example.com>\r\n", string(line))
+	assert.False(t, hasBareNewline(line))
+	line, err = readLineCRLF(r, 1000)
+	assert.NoError(t, err)
+	assert.Equal(t, ".\r\n", string(line))
+	_, err = readLineCRLF(r, 1000)
+	assert.Equal(t, io.EOF, err)
+
+	// max includes the CRLF
+	r = bufio.NewReader(strings.NewReader("abc\r\n"))
+	_, err = readLineCRLF(r, 5)
+	assert.NoError(t, err)
+	r = bufio.NewReader(strings.NewReader("ab\ncd\r\n"))
+	_, err = readLineCRLF(r, 6)
+	assert.Error(t, err)
+
+	assert.True(t, hasBareNewline([]byte("foo\r.\r\n")))
+	assert.False(t, hasBareNewline([]byte("\r\n")))
+}
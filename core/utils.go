@@ -2,8 +2,8 @@ package core
 
 import (
 	"bytes"
+	"context"
 	"io/ioutil"
-	"net"
 	"path"
 	"strings"
 	"time"
@@ -77,10 +77,10 @@ func Unix2dos(ch *[]byte) (err error) {
 
 // isFQN checks if domain is FQN (MX or A record)
 func isFQN(host string) (bool, error) {
-	_, err := net.LookupMX(host)
+	_, err := DNS.LookupMX(context.Background(), host)
 	if err != nil {
 		// Try A
-		_, err = net.LookupHost(host)
+		_, err = DNS.LookupIPAddr(context.Background(), host)
 		if err != nil {
 			return false, err
 		}
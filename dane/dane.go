@@ -0,0 +1,136 @@
+// Package dane implements DANE (RFC 6698, RFC 7672) verification of
+// SMTP server certificates.
+package dane
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/x509"
+	"errors"
+	"fmt"
+)
+
+// Certificate usages
+const (
+	UsagePKIXTA = 0
+	UsagePKIXEE = 1
+	UsageDANETA = 2
+	UsageDANEEE = 3
+)
+
+// Selectors
+const (
+	SelectorCert = 0
+	SelectorSPKI = 1
+)
+
+// Matching types
+const (
+	MatchingFull   = 0
+	MatchingSHA256 = 1
+	MatchingSHA512 = 2
+)
+
+var (
+	// ErrNoUsableRecords is returned when there is no DANE-EE or DANE-TA
+	// record (PKIX usages are not used for SMTP, RFC 7672 3.1.3)
+	ErrNoUsableRecords = errors.New("no usable TLSA records")
+)
+
+// TLSA represents a TLSA record
+type TLSA struct {
+	Usage        uint8
+	Selector     uint8
+	MatchingType uint8
+	Data         []byte
+}
+
+// String returns the presentation format of the record
+func (t TLSA) String() string {
+	return fmt.Sprintf("%d %d %d %x", t.Usage, t.Selector, t.MatchingType, t.Data)
+}
+
+// matches returns true if cert matches record t
+func (t TLSA) matches(cert *x509.Certificate) bool {
+	var data []byte
+	switch t.Selector {
+	case SelectorCert:
+		data = cert.Raw
+	case SelectorSPKI:
+		data = cert.RawSubjectPublicKeyInfo
+	default:
+		return false
+	}
+	switch t.MatchingType {
+	case MatchingFull:
+	case MatchingSHA256:
+		h := sha256.Sum256(data)
+		data = h[:]
+	case MatchingSHA512:
+		h := sha512.Sum512(data)
+		data = h[:]
+	default:
+		return false
+	}
+	return bytes.Equal(data, t.Data)
+}
+
+// Usable returns the DANE-EE and DANE-TA records of records
+func Usable(records []TLSA) (usable []TLSA) {
+	for _, r := range records {
+		if r.Usage == UsageDANEEE || r.Usage == UsageDANETA {
+			usable = append(usable, r)
+		}
+	}
+	return
+}
+
+// Verify checks the certificate chain presented by the server against
+// records.
+// DANE-EE records match the server certificate, names and validity dates
+// are not checked (RFC 7672 3.1.1). DANE-TA records match a certificate
+// of the chain which must be the trust anchor of the server certificate
+// for serverName (RFC 7672 3.1.2).
+func Verify(certs []*x509.Certificate, records []TLSA, serverName string) error {
+	records = Usable(records)
+	if len(records) == 0 {
+		return ErrNoUsableRecords
+	}
+	if len(certs) == 0 {
+		return errors.New("no server certificate")
+	}
+	var lastErr error
+	for _, r := range records {
+		if r.Usage == UsageDANEEE {
+			if r.matches(certs[0]) {
+				return nil
+			}
+			continue
+		}
+		// DANE-TA
+		for _, ta := range certs[1:] {
+			if !r.matches(ta) {
+				continue
+			}
+			opts := x509.VerifyOptions{
+				DNSName:       serverName,
+				Roots:         x509.NewCertPool(),
+				Intermediates: x509.NewCertPool(),
+			}
+			opts.Roots.AddCert(ta)
+			for _, cert := range certs[1:] {
+				opts.Intermediates.AddCert(cert)
+			}
+			if _, err := certs[0].Verify(opts); err != nil {
+				lastErr = err
+				continue
+			}
+			return nil
+		}
+	}
+	if lastErr != nil {
+		return lastErr
+	}
+	return errors.New("server certificate doesn't match TLSA records")
+}
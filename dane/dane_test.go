@@ -0,0 +1,94 @@
+package dane
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/binary"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// newCert returns a certificate signed by parent (self signed if nil)
+func newCert(t *testing.T, cn string, isCA bool, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	tpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: cn},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  isCA,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	if !isCA {
+		tpl.DNSNames = []string{cn}
+	}
+	if parent == nil {
+		parent, parentKey = tpl, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tpl, parent, &key.PublicKey, parentKey)
+	assert.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	assert.NoError(t, err)
+	return cert, key
+}
+
+func Test_VerifyDANEEE(t *testing.T) {
+	leaf, _ := newCert(t, "mx.example.com", false, nil, nil)
+	h := sha256.Sum256(leaf.RawSubjectPublicKeyInfo)
+	records := []TLSA{{UsageDANEEE, SelectorSPKI, MatchingSHA256, h[:]}}
+	// names are not checked
+	assert.NoError(t, Verify([]*x509.Certificate{leaf}, records, "other.example.com"))
+
+	other, _ := newCert(t, "mx.example.com", false, nil, nil)
+	assert.Error(t, Verify([]*x509.Certificate{other}, records, "mx.example.com"))
+
+	// PKIX usages are not usable
+	records[0].Usage = UsagePKIXEE
+	assert.Equal(t, ErrNoUsableRecords, Verify([]*x509.Certificate{leaf}, records, "mx.example.com"))
+}
+
+func Test_VerifyDANETA(t *testing.T) {
+	ca, caKey := newCert(t, "Example CA", true, nil, nil)
+	leaf, _ := newCert(t, "mx.example.com", false, ca, caKey)
+	records := []TLSA{{UsageDANETA, SelectorCert, MatchingFull, ca.Raw}}
+	assert.NoError(t, Verify([]*x509.Certificate{leaf, ca}, records, "mx.example.com"))
+	// name is checked
+	assert.Error(t, Verify([]*x509.Certificate{leaf, ca}, records, "mx.example.org"))
+	// trust anchor not in chain
+	assert.Error(t, Verify([]*x509.Certificate{leaf}, records, "mx.example.com"))
+}
+
+func Test_parseTLSAResponse(t *testing.T) {
+	query, err := newQuery(42, "_25._tcp.mx.example.com", typeTLSA)
+	assert.NoError(t, err)
+	// response: query header with QR, RD, RA, AD flags, 1 answer, no additional
+	resp := append([]byte{}, query[:len(query)-11]...)
+	binary.BigEndian.PutUint16(resp[2:], 0x81a0)
+	binary.BigEndian.PutUint16(resp[6:], 1)
+	binary.BigEndian.PutUint16(resp[10:], 0)
+	// name pointer to question, type TLSA, class IN, TTL, rdlength, rdata
+	resp = append(resp, 0xc0, 12, 0, typeTLSA, 0, classIN, 0, 0, 1, 0, 0, 5, 3, 1, 1, 0xab, 0xcd)
+
+	records, secure, err := parseTLSAResponse(42, resp)
+	assert.NoError(t, err)
+	assert.True(t, secure)
+	assert.Equal(t, []TLSA{{3, 1, 1, []byte{0xab, 0xcd}}}, records)
+
+	_, _, err = parseTLSAResponse(43, resp)
+	assert.Error(t, err)
+
+	// SERVFAIL
+	binary.BigEndian.PutUint16(resp[2:], 0x8182)
+	_, _, err = parseTLSAResponse(42, resp)
+	assert.Error(t, err)
+}
@@ -0,0 +1,200 @@
+package dane
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"strings"
+	"time"
+)
+
+const (
+	typeOPT  = 41
+	typeTLSA = 52
+	classIN  = 1
+
+	rcodeNoError  = 0
+	rcodeNXDomain = 3
+)
+
+// Resolver looks up TLSA records
+// secure is true if the answer has been validated by DNSSEC.
+type Resolver interface {
+	LookupTLSA(name string) (records []TLSA, secure bool, err error)
+}
+
+// DNSResolver queries a DNSSEC validating resolver and trusts its AD bit,
+// so it must be on a trusted network path (eg a local resolver)
+type DNSResolver struct {
+	Server  string // host:port
+	Timeout time.Duration
+}
+
+// NewResolver returns a resolver querying server
+func NewResolver(server string, timeout time.Duration) *DNSResolver {
+	if _, _, err := net.SplitHostPort(server); err != nil {
+		server = net.JoinHostPort(server, "53")
+	}
+	return &DNSResolver{Server: server, Timeout: timeout}
+}
+
+// LookupTLSA returns the TLSA records of name (eg _25._tcp.mx.example.com)
+// A non-existent name is not an error.
+func (r *DNSResolver) LookupTLSA(name string) (records []TLSA, secure bool, err error) {
+	id := uint16(rand.Intn(65536))
+	query, err := newQuery(id, name, typeTLSA)
+	if err != nil {
+		return nil, false, err
+	}
+	resp, err := r.exchange("udp", query)
+	if err != nil {
+		return nil, false, err
+	}
+	// truncated: retry over TCP
+	if len(resp) > 3 && resp[2]&0x02 != 0 {
+		if resp, err = r.exchange("tcp", query); err != nil {
+			return nil, false, err
+		}
+	}
+	return parseTLSAResponse(id, resp)
+}
+
+// exchange sends query to the resolver and returns its response
+func (r *DNSResolver) exchange(network string, query []byte) ([]byte, error) {
+	conn, err := net.DialTimeout(network, r.Server, r.Timeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if err = conn.SetDeadline(time.Now().Add(r.Timeout)); err != nil {
+		return nil, err
+	}
+	if network == "udp" {
+		if _, err = conn.Write(query); err != nil {
+			return nil, err
+		}
+		resp := make([]byte, 4096)
+		n, err := conn.Read(resp)
+		if err != nil {
+			return nil, err
+		}
+		return resp[:n], nil
+	}
+	msg := make([]byte, 2, 2+len(query))
+	binary.BigEndian.PutUint16(msg, uint16(len(query)))
+	if _, err = conn.Write(append(msg, query...)); err != nil {
+		return nil, err
+	}
+	if _, err = io.ReadFull(conn, msg[:2]); err != nil {
+		return nil, err
+	}
+	resp := make([]byte, binary.BigEndian.Uint16(msg[:2]))
+	if _, err = io.ReadFull(conn, resp); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// newQuery returns a recursive query for name with the AD bit set and
+// an EDNS0 OPT record with the DO bit set
+func newQuery(id uint16, name string, qtype uint16) ([]byte, error) {
+	q := make([]byte, 12)
+	binary.BigEndian.PutUint16(q[0:], id)
+	binary.BigEndian.PutUint16(q[2:], 0x0120) // RD, AD
+	binary.BigEndian.PutUint16(q[4:], 1)      // QDCOUNT
+	binary.BigEndian.PutUint16(q[10:], 1)     // ARCOUNT
+
+	for _, label := range strings.Split(strings.TrimSuffix(name, "."), ".") {
+		if len(label) == 0 || len(label) > 63 {
+			return nil, errors.New("invalid DNS name " + name)
+		}
+		q = append(q, byte(len(label)))
+		q = append(q, label...)
+	}
+	q = append(q, 0, byte(qtype>>8), byte(qtype), 0, classIN)
+
+	// OPT: root name, type, UDP payload size, extended rcode & version, DO flag, rdlength
+	q = append(q, 0, 0, typeOPT, 0x10, 0x00, 0, 0, 0x80, 0x00, 0, 0)
+	return q, nil
+}
+
+// parseTLSAResponse returns the TLSA records of a response
+func parseTLSAResponse(id uint16, resp []byte) (records []TLSA, secure bool, err error) {
+	if len(resp) < 12 {
+		return nil, false, errors.New("DNS response too short")
+	}
+	if binary.BigEndian.Uint16(resp[0:]) != id {
+		return nil, false, errors.New("DNS response ID mismatch")
+	}
+	flags := binary.BigEndian.Uint16(resp[2:])
+	secure = flags&0x0020 != 0
+	switch rcode := flags & 0x000f; rcode {
+	case rcodeNoError:
+	case rcodeNXDomain:
+		return nil, secure, nil
+	default:
+		return nil, false, fmt.Errorf("DNS query failed with rcode %d", rcode)
+	}
+	qdCount := int(binary.BigEndian.Uint16(resp[4:]))
+	anCount := int(binary.BigEndian.Uint16(resp[6:]))
+
+	off := 12
+	for i := 0; i < qdCount; i++ {
+		if off, err = skipName(resp, off); err != nil {
+			return nil, false, err
+		}
+		off += 4
+	}
+	for i := 0; i < anCount; i++ {
+		if off, err = skipName(resp, off); err != nil {
+			return nil, false, err
+		}
+		if off+10 > len(resp) {
+			return nil, false, errors.New("DNS response truncated")
+		}
+		rtype := binary.BigEndian.Uint16(resp[off:])
+		rdLength := int(binary.BigEndian.Uint16(resp[off+8:]))
+		off += 10
+		if off+rdLength > len(resp) {
+			return nil, false, errors.New("DNS response truncated")
+		}
+		rdata := resp[off : off+rdLength]
+		off += rdLength
+		// CNAME are followed by the resolver
+		if rtype != typeTLSA {
+			continue
+		}
+		if len(rdata) < 3 {
+			return nil, false, errors.New("invalid TLSA record")
+		}
+		records = append(records, TLSA{
+			Usage:        rdata[0],
+			Selector:     rdata[1],
+			MatchingType: rdata[2],
+			Data:         append([]byte{}, rdata[3:]...),
+		})
+	}
+	return records, secure, nil
+}
+
+// skipName returns the offset following the name at off
+func skipName(msg []byte, off int) (int, error) {
+	for {
+		if off >= len(msg) {
+			return 0, errors.New("DNS response truncated")
+		}
+		l := int(msg[off])
+		switch {
+		case l == 0:
+			return off + 1, nil
+		// compression pointer
+		case l&0xc0 == 0xc0:
+			return off + 2, nil
+		default:
+			off += l + 1
+		}
+	}
+}
@@ -7,10 +7,8 @@ Hi. This is the cocosmail deliverd program at {{.Me}}
 I'm afraid I wasn't able to deliver your message to the
 following addresses. This is a permanent error; I've given up.
 Sorry it didn't work out.
-
-<{{.OriRcptTo}}>:
+{{range .Recipients}}
+<{{.Rcpt}}>:
 {{.ErrMsg}}
-
---- Below this line is a copy of the message.
-
-{{.BouncedMail}}
\ No newline at end of file
+{{end}}
+--- Attached is a copy of the message or of its headers.
@@ -0,0 +1,14 @@
+Date: {{.Date}}
+From: MAILER-DAEMON@{{.Me}}
+To: {{.RcptTo}}
+Subject: delayed delivery warning
+
+Hi. This is the cocosmail deliverd program at {{.Me}}
+Your message has not yet been delivered to the following
+addresses. This is a temporary error; I will keep trying
+and you don't have to resend your message.
+{{range .Recipients}}
+<{{.Rcpt}}>:
+{{.ErrMsg}}
+{{end}}
+--- Attached is a copy of the message or of its headers.
@@ -0,0 +1,14 @@
+Date: {{.Date}}
+From: MAILER-DAEMON@{{.Me}}
+To: {{.RcptTo}}
+Subject: delivery notification
+
+Hi. This is the cocosmail deliverd program at {{.Me}}
+Your message was successfully delivered to the
+following addresses, as you requested.
+{{if .EnvId}}
+Envelope-Id: {{.EnvId}}
+{{end}}{{range .Recipients}}
+<{{.Rcpt}}>: {{.Action}}
+{{end}}
+--- Attached is a copy of the message or of its headers.
@@ -0,0 +1,281 @@
+// Package dmarc implements the evaluation of the DMARC policy (RFC 7489)
+// of the author domain of incoming mails.
+package dmarc
+
+import (
+	"errors"
+	"math/rand"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// Policies
+const (
+	PolicyNone       = "none"
+	PolicyQuarantine = "quarantine"
+	PolicyReject     = "reject"
+)
+
+// Results of the evaluation
+const (
+	ResultNone      = "none" // no policy
+	ResultPass      = "pass"
+	ResultFail      = "fail"
+	ResultTempError = "temperror"
+	ResultPermError = "permerror"
+)
+
+var (
+	// ErrNoRecord is returned when a domain doesn't publish a DMARC record
+	ErrNoRecord = errors.New("no DMARC record")
+)
+
+// Record represents a DMARC record
+type Record struct {
+	Policy          string   // p
+	SubdomainPolicy string   // sp, Policy if not set
+	Percent         int      // pct
+	ADKIM           string   // r or s
+	ASPF            string   // r or s
+	RUA             []string // aggregate report URIs
+	RUF             []string // failure report URIs
+	RI              int      // aggregate report interval in seconds
+}
+
+// ParseRecord parses a DMARC record (RFC 7489 6.3)
+func ParseRecord(txt string) (*Record, error) {
+	r := &Record{
+		Percent: 100,
+		ADKIM:   "r",
+		ASPF:    "r",
+		RI:      86400,
+	}
+	tags := strings.Split(txt, ";")
+	if strings.TrimSpace(tags[0]) != "v=DMARC1" {
+		return nil, ErrNoRecord
+	}
+	for _, tag := range tags[1:] {
+		tag = strings.TrimSpace(tag)
+		if tag == "" {
+			continue
+		}
+		kv := strings.SplitN(tag, "=", 2)
+		if len(kv) != 2 {
+			return nil, errors.New("bad DMARC tag " + tag)
+		}
+		name, value := strings.ToLower(strings.TrimSpace(kv[0])), strings.TrimSpace(kv[1])
+		switch name {
+		case "p", "sp":
+			value = strings.ToLower(value)
+			if value != PolicyNone && value != PolicyQuarantine && value != PolicyReject {
+				return nil, errors.New("bad DMARC policy " + value)
+			}
+			if name == "p" {
+				r.Policy = value
+			} else {
+				r.SubdomainPolicy = value
+			}
+		case "pct":
+			pct, err := strconv.Atoi(value)
+			if err != nil || pct < 0 || pct > 100 {
+				return nil, errors.New("bad DMARC pct " + value)
+			}
+			r.Percent = pct
+		case "adkim", "aspf":
+			value = strings.ToLower(value)
+			if value != "r" && value != "s" {
+				return nil, errors.New("bad DMARC alignment mode " + value)
+			}
+			if name == "adkim" {
+				r.ADKIM = value
+			} else {
+				r.ASPF = value
+			}
+		case "rua", "ruf":
+			var uris []string
+			for _, uri := range strings.Split(value, ",") {
+				if uri = strings.TrimSpace(uri); uri != "" {
+					uris = append(uris, uri)
+				}
+			}
+			if name == "rua" {
+				r.RUA = uris
+			} else {
+				r.RUF = uris
+			}
+		case "ri":
+			ri, err := strconv.Atoi(value)
+			if err != nil || ri <= 0 {
+				return nil, errors.New("bad DMARC ri " + value)
+			}
+			r.RI = ri
+		}
+		// unknown tags (fo, rf...) are ignored
+	}
+	if r.Policy == "" {
+		// RFC 7489 6.6.3: rua without p is a p=none record
+		if len(r.RUA) == 0 {
+			return nil, errors.New("DMARC record without policy")
+		}
+		r.Policy = PolicyNone
+	}
+	if r.SubdomainPolicy == "" {
+		r.SubdomainPolicy = r.Policy
+	}
+	return r, nil
+}
+
+// Lookup returns the DMARC record of domain, or of its organizational
+// domain if domain has none (RFC 7489 6.6.3)
+// ErrNoRecord is returned if there is no record.
+func Lookup(lookupTXT func(name string) ([]string, error), domain string, psl *List) (r *Record, policyDomain string, err error) {
+	domain = strings.ToLower(strings.Trim(domain, "."))
+	r, err = lookupRecord(lookupTXT, domain)
+	if err != ErrNoRecord {
+		return r, domain, err
+	}
+	orgDomain := psl.OrganizationalDomain(domain)
+	if orgDomain == domain {
+		return nil, domain, ErrNoRecord
+	}
+	r, err = lookupRecord(lookupTXT, orgDomain)
+	return r, orgDomain, err
+}
+
+// lookupRecord returns the DMARC record of _dmarc.domain
+func lookupRecord(lookupTXT func(name string) ([]string, error), domain string) (*Record, error) {
+	txts, err := lookupTXT("_dmarc." + domain)
+	if err != nil {
+		if dnsErr, ok := err.(*net.DNSError); ok && dnsErr.IsNotFound {
+			return nil, ErrNoRecord
+		}
+		return nil, err
+	}
+	var records []string
+	for _, txt := range txts {
+		if strings.HasPrefix(strings.TrimSpace(txt), "v=DMARC1") {
+			records = append(records, txt)
+		}
+	}
+	// more than one record: no policy
+	if len(records) != 1 {
+		return nil, ErrNoRecord
+	}
+	return ParseRecord(records[0])
+}
+
+// DKIMResult is the result of the verification of a DKIM signature
+type DKIMResult struct {
+	Domain string // d=
+	Result string // pass, fail...
+}
+
+// Input is the authentication results of a message
+type Input struct {
+	FromDomain string // domain of header From (RFC5322.From)
+	SPFDomain  string // domain of MAIL FROM, or HELO for null sender
+	SPFResult  string // pass, fail...
+	DKIM       []DKIMResult
+}
+
+// Result is the result of the DMARC evaluation of a message
+type Result struct {
+	Result       string // none, pass, fail, temperror or permerror
+	PolicyDomain string // domain of the record
+	Record       *Record
+	Policy       string // p or sp of the record, as published
+	Disposition  string // policy applied after pct: none, quarantine or reject
+	DKIMAligned  bool   // an aligned DKIM signature passed
+	SPFAligned   bool   // SPF passed for an aligned domain
+	Reason       string
+}
+
+// Evaluator evaluates DMARC policies
+type Evaluator struct {
+	LookupTXT func(name string) ([]string, error)
+	PSL       *List
+	// random returns a number in [0, 100) to sample messages (pct)
+	random func() int
+}
+
+// NewEvaluator returns an evaluator using lookupTXT for DNS lookups and
+// the public suffix list psl, the bundled one if nil
+func NewEvaluator(lookupTXT func(name string) ([]string, error), psl *List) *Evaluator {
+	if psl == nil {
+		psl = DefaultList()
+	}
+	return &Evaluator{
+		LookupTXT: lookupTXT,
+		PSL:       psl,
+		random:    func() int { return rand.Intn(100) },
+	}
+}
+
+// Evaluate evaluates the DMARC policy of the author domain of a message
+func (e *Evaluator) Evaluate(in Input) *Result {
+	fromDomain := strings.ToLower(strings.Trim(in.FromDomain, "."))
+	res := &Result{
+		Result:      ResultNone,
+		Disposition: PolicyNone,
+	}
+	r, policyDomain, err := Lookup(e.LookupTXT, fromDomain, e.PSL)
+	res.PolicyDomain = policyDomain
+	switch {
+	case err == ErrNoRecord:
+		return res
+	case err != nil:
+		if _, ok := err.(*net.DNSError); ok {
+			res.Result = ResultTempError
+		} else {
+			res.Result = ResultPermError
+		}
+		res.Reason = err.Error()
+		return res
+	}
+	res.Record = r
+	res.Policy = r.Policy
+	if policyDomain != fromDomain {
+		res.Policy = r.SubdomainPolicy
+	}
+
+	// identifier alignment (RFC 7489 3.1)
+	for _, d := range in.DKIM {
+		if d.Result == "pass" && e.aligned(fromDomain, d.Domain, r.ADKIM) {
+			res.DKIMAligned = true
+			break
+		}
+	}
+	res.SPFAligned = in.SPFResult == "pass" && e.aligned(fromDomain, in.SPFDomain, r.ASPF)
+	if res.DKIMAligned || res.SPFAligned {
+		res.Result = ResultPass
+		return res
+	}
+	res.Result = ResultFail
+
+	// pct: messages out of the sample get the next policy (RFC 7489 6.6.4)
+	res.Disposition = res.Policy
+	if r.Percent < 100 && e.random() >= r.Percent {
+		res.Reason = "sampled out"
+		switch res.Disposition {
+		case PolicyReject:
+			res.Disposition = PolicyQuarantine
+		case PolicyQuarantine:
+			res.Disposition = PolicyNone
+		}
+	}
+	return res
+}
+
+// aligned returns true if domain is aligned with fromDomain in mode
+// (r: relaxed, s: strict)
+func (e *Evaluator) aligned(fromDomain, domain, mode string) bool {
+	domain = strings.ToLower(strings.Trim(domain, "."))
+	if domain == "" {
+		return false
+	}
+	if domain == fromDomain {
+		return true
+	}
+	return mode != "s" && e.PSL.OrganizationalDomain(domain) == e.PSL.OrganizationalDomain(fromDomain)
+}
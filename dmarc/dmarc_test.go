@@ -0,0 +1,108 @@
+package dmarc
+
+import (
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const testPSL = `
+// test list
+com
+uk
+co.uk
+*.ck
+!www.ck
+`
+
+func testLookupTXT(records map[string][]string) func(string) ([]string, error) {
+	return func(name string) ([]string, error) {
+		if txts, ok := records[name]; ok {
+			return txts, nil
+		}
+		return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+	}
+}
+
+func Test_OrganizationalDomain(t *testing.T) {
+	l, err := ParseList(strings.NewReader(testPSL))
+	assert.NoError(t, err)
+	assert.Equal(t, "example.com", l.OrganizationalDomain("mail.Example.com."))
+	assert.Equal(t, "example.co.uk", l.OrganizationalDomain("a.b.example.co.uk"))
+	assert.Equal(t, "b.a.ck", l.OrganizationalDomain("c.b.a.ck"))
+	assert.Equal(t, "www.ck", l.OrganizationalDomain("a.www.ck"))
+	assert.Equal(t, "example.org", l.OrganizationalDomain("mail.example.org"))
+	assert.Equal(t, "com", l.OrganizationalDomain("com"))
+
+	// bundled list
+	assert.Equal(t, "example.co.uk", DefaultList().OrganizationalDomain("mail.example.co.uk"))
+}
+
+func Test_ParseRecord(t *testing.T) {
+	r, err := ParseRecord("v=DMARC1; p=reject; sp=none; pct=50; adkim=s; rua=mailto:dmarc@example.com, mailto:dmarc@example.org")
+	assert.NoError(t, err)
+	assert.Equal(t, PolicyReject, r.Policy)
+	assert.Equal(t, PolicyNone, r.SubdomainPolicy)
+	assert.Equal(t, 50, r.Percent)
+	assert.Equal(t, "s", r.ADKIM)
+	assert.Equal(t, "r", r.ASPF)
+	assert.Equal(t, []string{"mailto:dmarc@example.com", "mailto:dmarc@example.org"}, r.RUA)
+
+	r, err = ParseRecord("v=DMARC1; p=quarantine")
+	assert.NoError(t, err)
+	assert.Equal(t, PolicyQuarantine, r.SubdomainPolicy)
+	assert.Equal(t, 100, r.Percent)
+
+	_, err = ParseRecord("v=spf1 -all")
+	assert.Equal(t, ErrNoRecord, err)
+	_, err = ParseRecord("v=DMARC1; p=block")
+	assert.Error(t, err)
+	_, err = ParseRecord("v=DMARC1; pct=10")
+	assert.Error(t, err)
+}
+
+func Test_Evaluate(t *testing.T) {
+	l, err := ParseList(strings.NewReader(testPSL))
+	assert.NoError(t, err)
+	e := NewEvaluator(testLookupTXT(map[string][]string{
+		"_dmarc.example.com":     {"v=DMARC1; p=reject; sp=quarantine"},
+		"_dmarc.strict.co.uk":    {"v=DMARC1; p=reject; aspf=s; pct=50"},
+		"_dmarc.multiple.com":    {"v=DMARC1; p=reject", "v=DMARC1; p=none"},
+		"_dmarc.bad.example.com": {"v=DMARC1; p=block"},
+	}), l)
+
+	// relaxed DKIM alignment
+	res := e.Evaluate(Input{FromDomain: "example.com", SPFDomain: "bounces.other.com", SPFResult: "pass",
+		DKIM: []DKIMResult{{Domain: "mail.example.com", Result: "pass"}}})
+	assert.Equal(t, ResultPass, res.Result)
+	assert.True(t, res.DKIMAligned)
+	assert.False(t, res.SPFAligned)
+
+	// subdomain policy from organizational domain
+	res = e.Evaluate(Input{FromDomain: "news.example.com", SPFDomain: "other.com", SPFResult: "pass"})
+	assert.Equal(t, ResultFail, res.Result)
+	assert.Equal(t, "example.com", res.PolicyDomain)
+	assert.Equal(t, PolicyQuarantine, res.Disposition)
+
+	// strict SPF alignment and pct
+	e.random = func() int { return 10 }
+	res = e.Evaluate(Input{FromDomain: "strict.co.uk", SPFDomain: "bounces.strict.co.uk", SPFResult: "pass"})
+	assert.Equal(t, ResultFail, res.Result)
+	assert.Equal(t, PolicyReject, res.Disposition)
+	e.random = func() int { return 60 }
+	res = e.Evaluate(Input{FromDomain: "strict.co.uk", SPFDomain: "bounces.strict.co.uk", SPFResult: "pass"})
+	assert.Equal(t, PolicyQuarantine, res.Disposition)
+	res = e.Evaluate(Input{FromDomain: "strict.co.uk", SPFDomain: "strict.co.uk", SPFResult: "pass"})
+	assert.Equal(t, ResultPass, res.Result)
+
+	// no policy
+	res = e.Evaluate(Input{FromDomain: "multiple.com"})
+	assert.Equal(t, ResultNone, res.Result)
+	res = e.Evaluate(Input{FromDomain: "example.org"})
+	assert.Equal(t, ResultNone, res.Result)
+
+	res = e.Evaluate(Input{FromDomain: "bad.example.com"})
+	assert.Equal(t, ResultPermError, res.Result)
+}
@@ -0,0 +1,99 @@
+package dmarc
+
+import (
+	"bufio"
+	_ "embed"
+	"io"
+	"strings"
+	"sync"
+)
+
+// publicSuffixList is the bundled public suffix list
+// https://publicsuffix.org/list/public_suffix_list.dat
+//
+//go:embed public_suffix_list.dat
+var publicSuffixList string
+
+var (
+	defaultList     *List
+	defaultListOnce sync.Once
+)
+
+// List is a public suffix list, used to find organizational domains
+type List struct {
+	rules      map[string]bool // example: com, co.uk
+	wildcards  map[string]bool // *.ck -> ck
+	exceptions map[string]bool // !www.ck -> www.ck
+}
+
+// DefaultList returns the bundled public suffix list
+func DefaultList() *List {
+	defaultListOnce.Do(func() {
+		defaultList, _ = ParseList(strings.NewReader(publicSuffixList))
+	})
+	return defaultList
+}
+
+// ParseList parses a public suffix list
+func ParseList(r io.Reader) (*List, error) {
+	l := &List{
+		rules:      make(map[string]bool),
+		wildcards:  make(map[string]bool),
+		exceptions: make(map[string]bool),
+	}
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "//") {
+			continue
+		}
+		rule := strings.ToLower(strings.Fields(line)[0])
+		switch {
+		case strings.HasPrefix(rule, "!"):
+			l.exceptions[rule[1:]] = true
+		case strings.HasPrefix(rule, "*."):
+			l.wildcards[rule[2:]] = true
+		default:
+			l.rules[rule] = true
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// PublicSuffix returns the public suffix of domain
+// If no rule matches, the public suffix is the last label.
+func (l *List) PublicSuffix(domain string) string {
+	domain = strings.ToLower(strings.Trim(domain, "."))
+	labels := strings.Split(domain, ".")
+	for i := range labels {
+		suffix := strings.Join(labels[i:], ".")
+		if l.exceptions[suffix] {
+			return strings.Join(labels[i+1:], ".")
+		}
+		if l.rules[suffix] {
+			return suffix
+		}
+		if i+1 < len(labels) && l.wildcards[strings.Join(labels[i+1:], ".")] {
+			return suffix
+		}
+	}
+	return labels[len(labels)-1]
+}
+
+// OrganizationalDomain returns the organizational domain of domain: its
+// public suffix and one more label (RFC 7489 3.2)
+func (l *List) OrganizationalDomain(domain string) string {
+	domain = strings.ToLower(strings.Trim(domain, "."))
+	suffix := l.PublicSuffix(domain)
+	if domain == suffix {
+		return domain
+	}
+	rest := strings.TrimSuffix(domain, "."+suffix)
+	if p := strings.LastIndex(rest, "."); p != -1 {
+		rest = rest[p+1:]
+	}
+	return rest + "." + suffix
+}
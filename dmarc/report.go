@@ -0,0 +1,166 @@
+package dmarc
+
+import (
+	"encoding/xml"
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// Feedback is an aggregate report (RFC 7489 appendix C)
+type Feedback struct {
+	XMLName         xml.Name        `xml:"feedback"`
+	Version         string          `xml:"version"`
+	ReportMetadata  ReportMetadata  `xml:"report_metadata"`
+	PolicyPublished PolicyPublished `xml:"policy_published"`
+	Records         []ReportRecord  `xml:"record"`
+}
+
+// ReportMetadata identifies the reporter and the report
+type ReportMetadata struct {
+	OrgName   string    `xml:"org_name"`
+	Email     string    `xml:"email"`
+	ReportID  string    `xml:"report_id"`
+	DateRange DateRange `xml:"date_range"`
+}
+
+// DateRange is the period of a report, in seconds since epoch (UTC)
+type DateRange struct {
+	Begin int64 `xml:"begin"`
+	End   int64 `xml:"end"`
+}
+
+// PolicyPublished is the DMARC record found for the policy domain
+type PolicyPublished struct {
+	Domain string `xml:"domain"`
+	ADKIM  string `xml:"adkim,omitempty"`
+	ASPF   string `xml:"aspf,omitempty"`
+	P      string `xml:"p"`
+	SP     string `xml:"sp,omitempty"`
+	Pct    int    `xml:"pct"`
+}
+
+// ReportRecord counts the messages of a source IP with the same evaluation
+type ReportRecord struct {
+	Row         ReportRow         `xml:"row"`
+	Identifiers ReportIdentifiers `xml:"identifiers"`
+	AuthResults ReportAuthResults `xml:"auth_results"`
+}
+
+// ReportRow is the source IP, the count and the evaluation of a record
+type ReportRow struct {
+	SourceIP        string          `xml:"source_ip"`
+	Count           int64           `xml:"count"`
+	PolicyEvaluated PolicyEvaluated `xml:"policy_evaluated"`
+}
+
+// PolicyEvaluated is the disposition applied and the aligned results
+type PolicyEvaluated struct {
+	Disposition string `xml:"disposition"`
+	DKIM        string `xml:"dkim"` // pass or fail
+	SPF         string `xml:"spf"`  // pass or fail
+}
+
+// ReportIdentifiers are the domains of the messages of a record
+type ReportIdentifiers struct {
+	EnvelopeTo   string `xml:"envelope_to,omitempty"`
+	EnvelopeFrom string `xml:"envelope_from,omitempty"`
+	HeaderFrom   string `xml:"header_from"`
+}
+
+// ReportAuthResults are the raw DKIM and SPF results, before alignment
+type ReportAuthResults struct {
+	DKIM []DKIMAuthResult `xml:"dkim,omitempty"`
+	SPF  []SPFAuthResult  `xml:"spf"`
+}
+
+// DKIMAuthResult is the result of a DKIM signature
+type DKIMAuthResult struct {
+	Domain   string `xml:"domain"`
+	Selector string `xml:"selector,omitempty"`
+	Result   string `xml:"result"`
+}
+
+// SPFAuthResult is the SPF result of a domain
+type SPFAuthResult struct {
+	Domain string `xml:"domain"`
+	Scope  string `xml:"scope,omitempty"` // mfrom or helo
+	Result string `xml:"result"`
+}
+
+// Marshal returns the XML document of the report
+func (f *Feedback) Marshal() ([]byte, error) {
+	if f.Version == "" {
+		f.Version = "1.0"
+	}
+	out, err := xml.MarshalIndent(f, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(xml.Header), append(out, '\n')...), nil
+}
+
+// ParseReportURI returns the address of a mailto: report URI and its
+// maximum report size in bytes, 0 if unlimited (RFC 7489 6.2)
+// Other URI schemes are not supported.
+func ParseReportURI(uri string) (address string, maxSize int64, err error) {
+	uri = strings.TrimSpace(uri)
+	if !strings.HasPrefix(strings.ToLower(uri), "mailto:") {
+		return "", 0, errors.New("unsupported report URI " + uri)
+	}
+	address = uri[7:]
+	if p := strings.LastIndex(address, "!"); p != -1 {
+		size := strings.ToLower(address[p+1:])
+		address = address[:p]
+		unit := int64(1)
+		if size != "" {
+			switch size[len(size)-1] {
+			case 'k':
+				unit = 1 << 10
+			case 'm':
+				unit = 1 << 20
+			case 'g':
+				unit = 1 << 30
+			case 't':
+				unit = 1 << 40
+			}
+			if unit != 1 {
+				size = size[:len(size)-1]
+			}
+		}
+		n, err := strconv.ParseInt(size, 10, 64)
+		if err != nil || n < 0 {
+			return "", 0, errors.New("bad report size limit in " + uri)
+		}
+		maxSize = n * unit
+	}
+	if p := strings.LastIndex(address, "@"); p < 1 || p == len(address)-1 {
+		return "", 0, errors.New("bad report address in " + uri)
+	}
+	return address, maxSize, nil
+}
+
+// ExternalDestinationAllowed returns true if reports of domain can be sent
+// to address: its domain has the same organizational domain, or it
+// publishes a domain._report._dmarc record (RFC 7489 7.1)
+func ExternalDestinationAllowed(lookupTXT func(name string) ([]string, error), psl *List, domain, address string) (bool, error) {
+	domain = strings.ToLower(strings.Trim(domain, "."))
+	destination := strings.ToLower(strings.Trim(address[strings.LastIndex(address, "@")+1:], "."))
+	if psl.OrganizationalDomain(domain) == psl.OrganizationalDomain(destination) {
+		return true, nil
+	}
+	txts, err := lookupTXT(domain + "._report._dmarc." + destination)
+	if err != nil {
+		if dnsErr, ok := err.(*net.DNSError); ok && dnsErr.IsNotFound {
+			return false, nil
+		}
+		return false, err
+	}
+	for _, txt := range txts {
+		if strings.HasPrefix(strings.TrimSpace(txt), "v=DMARC1") {
+			return true, nil
+		}
+	}
+	return false, nil
+}
@@ -0,0 +1,87 @@
+package dmarc
+
+import (
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_ParseReportURI(t *testing.T) {
+	address, maxSize, err := ParseReportURI("mailto:dmarc@example.com")
+	assert.NoError(t, err)
+	assert.Equal(t, "dmarc@example.com", address)
+	assert.Equal(t, int64(0), maxSize)
+
+	address, maxSize, err = ParseReportURI(" MAILTO:dmarc@example.com!10m")
+	assert.NoError(t, err)
+	assert.Equal(t, "dmarc@example.com", address)
+	assert.Equal(t, int64(10<<20), maxSize)
+
+	_, maxSize, err = ParseReportURI("mailto:dmarc@example.com!5000")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(5000), maxSize)
+
+	_, _, err = ParseReportURI("https://example.com/dmarc")
+	assert.Error(t, err)
+	_, _, err = ParseReportURI("mailto:dmarc@example.com!10x")
+	assert.Error(t, err)
+	_, _, err = ParseReportURI("mailto:example.com")
+	assert.Error(t, err)
+}
+
+func Test_ExternalDestinationAllowed(t *testing.T) {
+	l, err := ParseList(strings.NewReader(testPSL))
+	assert.NoError(t, err)
+	lookup := testLookupTXT(map[string][]string{
+		"example.com._report._dmarc.reports.net": {"v=DMARC1"},
+	})
+
+	allowed, err := ExternalDestinationAllowed(lookup, l, "mail.example.com", "dmarc@reports.example.com")
+	assert.NoError(t, err)
+	assert.True(t, allowed)
+
+	allowed, err = ExternalDestinationAllowed(lookup, l, "example.com", "dmarc@Reports.net")
+	assert.NoError(t, err)
+	assert.True(t, allowed)
+
+	allowed, err = ExternalDestinationAllowed(lookup, l, "example.co.uk", "dmarc@reports.net")
+	assert.NoError(t, err)
+	assert.False(t, allowed)
+
+	_, err = ExternalDestinationAllowed(func(name string) ([]string, error) {
+		return nil, &net.DNSError{Err: "timeout", Name: name, IsTimeout: true}
+	}, l, "example.com", "dmarc@reports.net")
+	assert.Error(t, err)
+}
+
+func Test_FeedbackMarshal(t *testing.T) {
+	f := Feedback{
+		ReportMetadata: ReportMetadata{
+			OrgName:   "mx.example.org",
+			Email:     "postmaster@example.org",
+			ReportID:  "2021-03-01_example.com@mx.example.org",
+			DateRange: DateRange{Begin: 1614556800, End: 1614643199},
+		},
+		PolicyPublished: PolicyPublished{Domain: "example.com", ADKIM: "r", ASPF: "r", P: "reject", SP: "reject", Pct: 100},
+		Records: []ReportRecord{{
+			Row: ReportRow{
+				SourceIP:        "192.0.2.1",
+				Count:           2,
+				PolicyEvaluated: PolicyEvaluated{Disposition: "reject", DKIM: "fail", SPF: "fail"},
+			},
+			Identifiers: ReportIdentifiers{HeaderFrom: "example.com", EnvelopeFrom: "example.com"},
+			AuthResults: ReportAuthResults{SPF: []SPFAuthResult{{Domain: "example.com", Scope: "mfrom", Result: "fail"}}},
+		}},
+	}
+	out, err := f.Marshal()
+	assert.NoError(t, err)
+	xml := string(out)
+	assert.True(t, strings.HasPrefix(xml, "<?xml"))
+	assert.True(t, strings.Contains(xml, "<version>1.0</version>"))
+	assert.True(t, strings.Contains(xml, "<begin>1614556800</begin>"))
+	assert.True(t, strings.Contains(xml, "<source_ip>192.0.2.1</source_ip>"))
+	assert.True(t, strings.Contains(xml, "<scope>mfrom</scope>"))
+	assert.False(t, strings.Contains(xml, "<dkim>\n"))
+}
@@ -0,0 +1,76 @@
+package message
+
+import (
+	"bytes"
+	"mime"
+	"mime/quotedprintable"
+	"strings"
+)
+
+// Is7Bit returns true if b contains only 7-bit ASCII characters
+func Is7Bit(b []byte) bool {
+	for _, c := range b {
+		if c > 127 {
+			return false
+		}
+	}
+	return true
+}
+
+// RawDowngrade8Bit converts the 8bit body of a message to quoted-printable
+// for relaying to a server that doesn't support 8BITMIME (RFC 6152 3).
+// Only single part messages are supported.
+func RawDowngrade8Bit(raw *[]byte) error {
+	p := bytes.Index(*raw, []byte{13, 10, 13, 10})
+	if p == -1 {
+		return nil
+	}
+	headers := (*raw)[:p+2]
+	body := (*raw)[p+4:]
+	if Is7Bit(body) {
+		return nil
+	}
+
+	m, err := New(raw)
+	if err != nil {
+		return err
+	}
+	mediaType, _, _ := mime.ParseMediaType(m.GetHeader("content-type"))
+	if strings.HasPrefix(mediaType, "multipart/") || strings.HasPrefix(mediaType, "message/") {
+		return ErrDowngradeMultipart
+	}
+
+	// remove Content-Transfer-Encoding (and its folded lines)
+	newRaw := []byte{}
+	skip := false
+	for _, line := range bytes.SplitAfter(headers, []byte{13, 10}) {
+		if len(line) == 0 {
+			continue
+		}
+		if line[0] == 32 || line[0] == 9 {
+			if !skip {
+				newRaw = append(newRaw, line...)
+			}
+			continue
+		}
+		skip = bytes.HasPrefix(bytes.ToLower(line), []byte("content-transfer-encoding:"))
+		if !skip {
+			newRaw = append(newRaw, line...)
+		}
+	}
+	if !m.HaveHeader("mime-version") {
+		newRaw = append(newRaw, []byte("MIME-Version: 1.0\r\n")...)
+	}
+	newRaw = append(newRaw, []byte("Content-Transfer-Encoding: quoted-printable\r\n\r\n")...)
+
+	buf := bytes.NewBuffer(newRaw)
+	w := quotedprintable.NewWriter(buf)
+	if _, err = w.Write(body); err != nil {
+		return err
+	}
+	if err = w.Close(); err != nil {
+		return err
+	}
+	*raw = buf.Bytes()
+	return nil
+}
@@ -0,0 +1,18 @@
+package message
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_RawDowngrade8Bit(t *testing.T) {
+	raw := []byte("Subject: test\r\nContent-Type: text/plain; charset=utf-8\r\nContent-Transfer-Encoding: 8bit\r\n\r\nh\xc3\xa9llo\r\n")
+	err := RawDowngrade8Bit(&raw)
+	assert.NoError(t, err)
+	assert.True(t, Is7Bit(raw))
+	assert.Equal(t, "Subject: test\r\nContent-Type: text/plain; charset=utf-8\r\nMIME-Version: 1.0\r\nContent-Transfer-Encoding: quoted-printable\r\n\r\nh=C3=A9llo\r\n", string(raw))
+
+	raw = []byte("Content-Type: multipart/mixed; boundary=x\r\n\r\n--x\r\n\r\nh\xc3\xa9llo\r\n--x--\r\n")
+	assert.Equal(t, ErrDowngradeMultipart, RawDowngrade8Bit(&raw))
+}
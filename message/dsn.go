@@ -0,0 +1,96 @@
+package message
+
+import (
+	"fmt"
+	"strings"
+)
+
+// RcptDSN represents the DSN parameters of a RCPT TO command (RFC 3461 4)
+type RcptDSN struct {
+	Notify string // NEVER or comma separated list of SUCCESS, FAILURE, DELAY
+	ORcpt  string // original recipient: addr-type;xtext
+}
+
+// IsXtext returns true if s is a valid xtext (RFC 3461 4)
+// hexchar digits must be uppercase.
+func IsXtext(s string) bool {
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c < 33 || c > 126 {
+			return false
+		}
+		if c == '+' {
+			if _, ok := xtextHexchar(s[i+1:]); !ok {
+				return false
+			}
+			i += 2
+		} else if c == '=' {
+			return false
+		}
+	}
+	return true
+}
+
+// xtextHexchar decodes the two uppercase hex digits at the start of s
+func xtextHexchar(s string) (byte, bool) {
+	if len(s) < 2 {
+		return 0, false
+	}
+	var c byte
+	for i := 0; i < 2; i++ {
+		switch d := s[i]; {
+		case d >= '0' && d <= '9':
+			c = c<<4 | (d - '0')
+		case d >= 'A' && d <= 'F':
+			c = c<<4 | (d - 'A' + 10)
+		default:
+			return 0, false
+		}
+	}
+	return c, true
+}
+
+// XtextDecode decodes a xtext encoded string
+// Invalid hexchars are kept as is.
+func XtextDecode(s string) string {
+	out := []byte{}
+	for i := 0; i < len(s); i++ {
+		if s[i] == '+' {
+			if c, ok := xtextHexchar(s[i+1:]); ok {
+				out = append(out, c)
+				i += 2
+				continue
+			}
+		}
+		out = append(out, s[i])
+	}
+	return string(out)
+}
+
+// XtextEncode encodes s as xtext
+func XtextEncode(s string) string {
+	out := ""
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c < 33 || c > 126 || c == '+' || c == '=' {
+			out += fmt.Sprintf("+%02X", c)
+			continue
+		}
+		out += string(c)
+	}
+	return out
+}
+
+// NotifyHas returns true if the NOTIFY parameter notify contains keyword
+// An empty NOTIFY defaults to FAILURE,DELAY (RFC 3461 4.1)
+func NotifyHas(notify, keyword string) bool {
+	if notify == "" {
+		notify = "FAILURE,DELAY"
+	}
+	for _, k := range strings.Split(notify, ",") {
+		if strings.EqualFold(k, keyword) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,71 @@
+package message
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_IsXtext(t *testing.T) {
+	tests := []struct {
+		s     string
+		valid bool
+	}{
+		{"", true},
+		{"rfc822;john@example.com", true},
+		{"rfc822;john+2Bdoe@example.com", true},
+		{"+3D+2B", true},
+		{"john doe", false},
+		{"a=b", false},
+		{"john+2bdoe", false},
+		{"john+2", false},
+		{"john+", false},
+		{"john+G1", false},
+		{"john++41", false},
+		{"h\xc3\xa9", false},
+	}
+	for _, test := range tests {
+		assert.Equal(t, test.valid, IsXtext(test.s), test.s)
+	}
+}
+
+func Test_XtextDecode(t *testing.T) {
+	tests := []struct {
+		s, decoded string
+	}{
+		{"rfc822;john@example.com", "rfc822;john@example.com"},
+		{"john+2Bdoe+3D", "john+doe="},
+		{"+20", " "},
+		{"john+2bdoe", "john+2bdoe"},
+		{"john+G1", "john+G1"},
+		{"john+4", "john+4"},
+		{"john+", "john+"},
+	}
+	for _, test := range tests {
+		assert.Equal(t, test.decoded, XtextDecode(test.s), test.s)
+	}
+}
+
+func Test_XtextEncode(t *testing.T) {
+	tests := []struct {
+		s, encoded string
+	}{
+		{"john@example.com", "john@example.com"},
+		{"john+doe=", "john+2Bdoe+3D"},
+		{"john doe", "john+20doe"},
+		{"h\xc3\xa9", "h+C3+A9"},
+		{"\n", "+0A"},
+	}
+	for _, test := range tests {
+		assert.Equal(t, test.encoded, XtextEncode(test.s), test.s)
+	}
+}
+
+func Test_NotifyHas(t *testing.T) {
+	assert.True(t, NotifyHas("", "FAILURE"))
+	assert.True(t, NotifyHas("", "delay"))
+	assert.False(t, NotifyHas("", "SUCCESS"))
+	assert.True(t, NotifyHas("SUCCESS,FAILURE", "failure"))
+	assert.False(t, NotifyHas("NEVER", "FAILURE"))
+	assert.True(t, NotifyHas("NEVER", "NEVER"))
+}
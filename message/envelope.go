@@ -4,6 +4,13 @@ package message
 type Envelope struct {
 	MailFrom string
 	RcptTo   []string
+	// MAIL FROM parameters
+	Body     string // 7BIT or 8BITMIME (RFC 6152), empty if not specified
+	SMTPUTF8 bool   // RFC 6531
+	Ret      string // DSN RET: FULL or HDRS (RFC 3461)
+	EnvId    string // DSN ENVID (xtext)
+	// DSN parameters of RCPT TO, by recipient
+	DSN map[string]RcptDSN
 }
 
 func (e Envelope) String() string {
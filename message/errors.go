@@ -7,4 +7,7 @@ import (
 var (
 	// ErrNonAsciiCharDetected when an email body does not contain only 7 bits ascii char
 	ErrNonAsciiCharDetected = errors.New("email must contains only 7-bit ASCII characters")
+
+	// ErrDowngradeMultipart when an 8bit multipart message has to be converted to 7bit
+	ErrDowngradeMultipart = errors.New("8bit multipart messages can't be downgraded to 7bit")
 )
@@ -40,3 +40,57 @@ func RawGetMessageId(raw *[]byte) []byte {
 	}
 	return []byte{}
 }
+
+// RawSplitHeaders splits a raw message into its header fields, each with
+// its folded lines and its CRLF, and its body, empty line included
+func RawSplitHeaders(raw []byte) (fields [][]byte, body []byte) {
+	header := raw
+	if end := bytes.Index(raw, []byte{13, 10, 13, 10}); end != -1 {
+		header = raw[:end+2]
+		body = raw[end+2:]
+	}
+	for len(header) != 0 {
+		n := bytes.Index(header, []byte{13, 10})
+		if n == -1 {
+			n = len(header)
+		} else {
+			n += 2
+		}
+		line := header[:n]
+		header = header[n:]
+		if len(fields) != 0 && (line[0] == ' ' || line[0] == '\t') {
+			fields[len(fields)-1] = append(fields[len(fields)-1], line...)
+			continue
+		}
+		fields = append(fields, append([]byte{}, line...))
+	}
+	return
+}
+
+// RawJoinHeaders returns the raw message made of header fields and body
+func RawJoinHeaders(fields [][]byte, body []byte) []byte {
+	raw := []byte{}
+	for _, field := range fields {
+		raw = append(raw, field...)
+	}
+	return append(raw, body...)
+}
+
+// RawHeaderName returns the lower cased name of a header field
+func RawHeaderName(field []byte) string {
+	p := bytes.IndexByte(field, ':')
+	if p == -1 {
+		return ""
+	}
+	return strings.ToLower(string(bytes.TrimSpace(field[:p])))
+}
+
+// RawHeaderValue returns the unfolded value of a header field
+func RawHeaderValue(field []byte) string {
+	p := bytes.IndexByte(field, ':')
+	if p == -1 {
+		return ""
+	}
+	value := strings.Replace(string(field[p+1:]), "\r\n", "", -1)
+	return strings.TrimSpace(value)
+}
@@ -0,0 +1,23 @@
+package message
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_RawSplitHeaders(t *testing.T) {
+	raw := []byte("Received: from a\r\n\tby b\r\nSubject: test\r\nDKIM-Signature: v=1; d=example.com;\r\n s=sel; b=abc\r\n\r\nbody\r\n")
+	fields, body := RawSplitHeaders(raw)
+	assert.Len(t, fields, 3)
+	assert.Equal(t, "received", RawHeaderName(fields[0]))
+	assert.Equal(t, "from a\tby b", RawHeaderValue(fields[0]))
+	assert.Equal(t, "dkim-signature", RawHeaderName(fields[2]))
+	assert.Equal(t, "v=1; d=example.com; s=sel; b=abc", RawHeaderValue(fields[2]))
+	assert.Equal(t, "\r\nbody\r\n", string(body))
+	assert.Equal(t, raw, RawJoinHeaders(fields, body))
+
+	fields, body = RawSplitHeaders([]byte("Subject: no body"))
+	assert.Len(t, fields, 1)
+	assert.Empty(t, body)
+}
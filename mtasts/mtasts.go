@@ -0,0 +1,283 @@
+// Package mtasts implements SMTP MTA Strict Transport Security (RFC 8461)
+// policy discovery for outgoing mails.
+package mtasts
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Policy modes
+const (
+	ModeEnforce = "enforce"
+	ModeTesting = "testing"
+	ModeNone    = "none"
+)
+
+const (
+	// max size of a policy file
+	maxPolicySize = 64 * 1024
+	// max_age upper limit (RFC 8461 3.2)
+	maxMaxAge = 31557600
+)
+
+var (
+	// ErrNoPolicy is returned when a domain doesn't publish a MTA-STS policy
+	ErrNoPolicy = errors.New("no MTA-STS policy")
+)
+
+// Policy represents a MTA-STS policy
+type Policy struct {
+	Id        string // id of the _mta-sts TXT record
+	Mode      string
+	MX        []string
+	MaxAge    int // seconds
+	FetchedAt time.Time
+}
+
+// Expired returns true if the max_age of the policy is over
+func (p *Policy) Expired() bool {
+	return time.Since(p.FetchedAt) > time.Duration(p.MaxAge)*time.Second
+}
+
+// MatchMX returns true if MX host is allowed by the policy
+// A pattern *.example.com matches a single label (RFC 8461 4.1)
+func (p *Policy) MatchMX(host string) bool {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	for _, pattern := range p.MX {
+		pattern = strings.ToLower(strings.TrimSuffix(pattern, "."))
+		if strings.HasPrefix(pattern, "*.") {
+			dot := strings.Index(host, ".")
+			if dot > 0 && host[dot+1:] == pattern[2:] {
+				return true
+			}
+			continue
+		}
+		if host == pattern {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseTXT returns the policy id from _mta-sts TXT records
+// ErrNoPolicy is returned if there is no STSv1 record.
+func ParseTXT(records []string) (id string, err error) {
+	found := 0
+	for _, record := range records {
+		fields := strings.Split(record, ";")
+		if strings.TrimSpace(fields[0]) != "v=STSv1" {
+			continue
+		}
+		found++
+		for _, field := range fields[1:] {
+			kv := strings.SplitN(strings.TrimSpace(field), "=", 2)
+			if len(kv) == 2 && kv[0] == "id" {
+				id = kv[1]
+			}
+		}
+	}
+	switch {
+	case found == 0:
+		return "", ErrNoPolicy
+	// RFC 8461 3.1: multiple records -> no policy
+	case found > 1:
+		return "", errors.New("multiple STSv1 TXT records")
+	case id == "" || len(id) > 32:
+		return "", errors.New("invalid STSv1 TXT record id")
+	}
+	return id, nil
+}
+
+// ParsePolicy parses a policy file
+func ParsePolicy(body []byte) (*Policy, error) {
+	p := &Policy{MaxAge: -1}
+	version := ""
+	scanner := bufio.NewScanner(bytes.NewReader(body))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		kv := strings.SplitN(line, ":", 2)
+		if len(kv) != 2 {
+			return nil, errors.New("invalid policy line " + line)
+		}
+		key, value := strings.TrimSpace(kv[0]), strings.TrimSpace(kv[1])
+		switch key {
+		case "version":
+			version = value
+		case "mode":
+			p.Mode = value
+		case "mx":
+			p.MX = append(p.MX, value)
+		case "max_age":
+			maxAge, err := strconv.Atoi(value)
+			if err != nil || maxAge < 0 {
+				return nil, errors.New("invalid policy max_age " + value)
+			}
+			if maxAge > maxMaxAge {
+				maxAge = maxMaxAge
+			}
+			p.MaxAge = maxAge
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if version != "STSv1" {
+		return nil, errors.New("invalid policy version " + version)
+	}
+	if p.MaxAge == -1 {
+		return nil, errors.New("missing policy max_age")
+	}
+	switch p.Mode {
+	case ModeEnforce, ModeTesting:
+		if len(p.MX) == 0 {
+			return nil, errors.New("missing policy mx")
+		}
+	case ModeNone:
+	default:
+		return nil, errors.New("invalid policy mode " + p.Mode)
+	}
+	return p, nil
+}
+
+// Cache stores policies between deliveries
+type Cache interface {
+	Get(domain string) (*Policy, error) // nil, nil if not found
+	Put(domain string, p *Policy) error
+}
+
+// Fetcher discovers MTA-STS policies
+// LookupTXT and FetchPolicy can be replaced (eg for testing).
+type Fetcher struct {
+	// LookupTXT returns TXT records of name
+	LookupTXT func(name string) ([]string, error)
+	// FetchPolicy returns the body of the policy file of domain
+	FetchPolicy func(domain string) ([]byte, error)
+	Cache       Cache
+}
+
+// NewFetcher returns a Fetcher using the system resolver and HTTPS
+func NewFetcher(cache Cache, timeout time.Duration) *Fetcher {
+	return &Fetcher{
+		LookupTXT:   net.LookupTXT,
+		FetchPolicy: httpsFetchPolicy(timeout),
+		Cache:       cache,
+	}
+}
+
+// Get returns the policy of domain (RFC 8461 5.1)
+// If the domain has no policy, it returns nil, nil.
+// If discovery fails, the cached policy is returned if it's not expired.
+func (f *Fetcher) Get(domain string) (*Policy, error) {
+	domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+	var cached *Policy
+	if f.Cache != nil {
+		var err error
+		if cached, err = f.Cache.Get(domain); err != nil {
+			cached = nil
+		}
+		if cached != nil && cached.Expired() {
+			cached = nil
+		}
+	}
+
+	records, err := f.LookupTXT("_mta-sts." + domain)
+	if err != nil {
+		if dnsErr, ok := err.(*net.DNSError); ok && dnsErr.IsNotFound {
+			err = ErrNoPolicy
+		}
+		return cached, discoveryErr(cached, err)
+	}
+	id, err := ParseTXT(records)
+	if err != nil {
+		return cached, discoveryErr(cached, err)
+	}
+
+	// policy didn't change
+	if cached != nil && cached.Id == id {
+		return cached, nil
+	}
+
+	body, err := f.FetchPolicy(domain)
+	if err != nil {
+		return cached, discoveryErr(cached, err)
+	}
+	p, err := ParsePolicy(body)
+	if err != nil {
+		return cached, discoveryErr(cached, err)
+	}
+	p.Id = id
+	p.FetchedAt = time.Now()
+	if f.Cache != nil {
+		if err = f.Cache.Put(domain, p); err != nil {
+			return p, err
+		}
+	}
+	return p, nil
+}
+
+// discoveryErr returns nil if the cached policy is used or if the domain
+// has no policy
+func discoveryErr(cached *Policy, err error) error {
+	if cached != nil || err == ErrNoPolicy {
+		return nil
+	}
+	return err
+}
+
+// httpsFetchPolicy returns a function which fetches policy files over
+// HTTPS with a valid certificate and without redirect (RFC 8461 3.3)
+func httpsFetchPolicy(timeout time.Duration) func(domain string) ([]byte, error) {
+	client := &http.Client{
+		Timeout: timeout,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return errors.New("redirects are not allowed")
+		},
+	}
+	return func(domain string) ([]byte, error) {
+		resp, err := client.Get("https://mta-sts." + domain + "/.well-known/mta-sts.txt")
+		if err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("HTTP status %d fetching policy", resp.StatusCode)
+		}
+		if mediaType, _, err := mime.ParseMediaType(resp.Header.Get("Content-Type")); err != nil || mediaType != "text/plain" {
+			return nil, errors.New("invalid policy content type " + resp.Header.Get("Content-Type"))
+		}
+		body, err := ioutil.ReadAll(&limitedReader{r: resp.Body, n: maxPolicySize})
+		if err != nil {
+			return nil, err
+		}
+		return body, nil
+	}
+}
+
+// limitedReader fails if more than n bytes are read
+type limitedReader struct {
+	r io.Reader
+	n int
+}
+
+func (l *limitedReader) Read(p []byte) (int, error) {
+	n, err := l.r.Read(p)
+	l.n -= n
+	if l.n < 0 {
+		return n, errors.New("policy file is too large")
+	}
+	return n, err
+}
@@ -0,0 +1,131 @@
+package mtasts
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const testPolicy = "version: STSv1\r\nmode: enforce\r\nmx: mail.example.com\r\nmx: *.example.net\r\nmax_age: 86400\r\n"
+
+type memCache map[string]*Policy
+
+func (c memCache) Get(domain string) (*Policy, error) {
+	return c[domain], nil
+}
+
+func (c memCache) Put(domain string, p *Policy) error {
+	c[domain] = p
+	return nil
+}
+
+// testFetcher returns an offline fetcher
+func testFetcher(txt []string, txtErr error, policy string, fetches *int) *Fetcher {
+	return &Fetcher{
+		LookupTXT: func(name string) ([]string, error) {
+			return txt, txtErr
+		},
+		FetchPolicy: func(domain string) ([]byte, error) {
+			*fetches++
+			if policy == "" {
+				return nil, errors.New("connection refused")
+			}
+			return []byte(policy), nil
+		},
+		Cache: memCache{},
+	}
+}
+
+func Test_ParsePolicy(t *testing.T) {
+	p, err := ParsePolicy([]byte(testPolicy))
+	assert.NoError(t, err)
+	assert.Equal(t, ModeEnforce, p.Mode)
+	assert.Equal(t, []string{"mail.example.com", "*.example.net"}, p.MX)
+	assert.Equal(t, 86400, p.MaxAge)
+
+	_, err = ParsePolicy([]byte("version: STSv1\nmode: enforce\nmax_age: 10\n"))
+	assert.Error(t, err)
+	_, err = ParsePolicy([]byte("version: STSv2\nmode: none\nmax_age: 10\n"))
+	assert.Error(t, err)
+}
+
+func Test_MatchMX(t *testing.T) {
+	p, _ := ParsePolicy([]byte(testPolicy))
+	assert.True(t, p.MatchMX("mail.example.com."))
+	assert.True(t, p.MatchMX("MX1.example.net"))
+	assert.False(t, p.MatchMX("a.b.example.net"))
+	assert.False(t, p.MatchMX("example.net"))
+	assert.False(t, p.MatchMX("mx.example.org"))
+}
+
+func Test_ParseTXT(t *testing.T) {
+	id, err := ParseTXT([]string{"v=STSv1; id=20190429T010101;"})
+	assert.NoError(t, err)
+	assert.Equal(t, "20190429T010101", id)
+	_, err = ParseTXT([]string{"v=spf1 -all"})
+	assert.Equal(t, ErrNoPolicy, err)
+	_, err = ParseTXT([]string{"v=STSv1; id=1", "v=STSv1; id=2"})
+	assert.Error(t, err)
+	// first field must be exactly v=STSv1
+	_, err = ParseTXT([]string{"v=STSv10; id=1"})
+	assert.Equal(t, ErrNoPolicy, err)
+	id, err = ParseTXT([]string{"v=STSv10; id=1", "v=STSv1;id=2"})
+	assert.NoError(t, err)
+	assert.Equal(t, "2", id)
+}
+
+func Test_FetcherGet(t *testing.T) {
+	fetches := 0
+	f := testFetcher([]string{"v=STSv1; id=1"}, nil, testPolicy, &fetches)
+	p, err := f.Get("example.com")
+	assert.NoError(t, err)
+	assert.Equal(t, ModeEnforce, p.Mode)
+	assert.Equal(t, 1, fetches)
+
+	// same id: cached
+	p, err = f.Get("example.com")
+	assert.NoError(t, err)
+	assert.NotNil(t, p)
+	assert.Equal(t, 1, fetches)
+
+	// new id: fetch
+	f.LookupTXT = func(name string) ([]string, error) {
+		return []string{"v=STSv1; id=2"}, nil
+	}
+	p, err = f.Get("example.com")
+	assert.NoError(t, err)
+	assert.Equal(t, "2", p.Id)
+	assert.Equal(t, 2, fetches)
+
+	// DNS failure: cached policy is used
+	f.LookupTXT = func(name string) ([]string, error) {
+		return nil, errors.New("SERVFAIL")
+	}
+	p, err = f.Get("example.com")
+	assert.NoError(t, err)
+	assert.Equal(t, "2", p.Id)
+
+	// expired
+	p.FetchedAt = time.Now().Add(-100000 * time.Second)
+	p, err = f.Get("example.com")
+	assert.Error(t, err)
+	assert.Nil(t, p)
+}
+
+func Test_FetcherNoPolicy(t *testing.T) {
+	fetches := 0
+	f := testFetcher(nil, &net.DNSError{Err: "no such host", Name: "_mta-sts.example.org", IsNotFound: true}, "", &fetches)
+	p, err := f.Get("example.org")
+	assert.NoError(t, err)
+	assert.Nil(t, p)
+	assert.Equal(t, 0, fetches)
+
+	// policy can't be fetched
+	f = testFetcher([]string{"v=STSv1; id=1"}, nil, "", &fetches)
+	p, err = f.Get("example.org")
+	assert.Error(t, err)
+	assert.Nil(t, p)
+}
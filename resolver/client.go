@@ -0,0 +1,386 @@
+package resolver
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	classIN = 1
+
+	rcodeNoError  = 0
+	rcodeNXDomain = 3
+)
+
+// Client queries recursive DNS servers
+// Servers are tried in order until one answers.
+type Client struct {
+	Servers []string // host:port
+	Timeout time.Duration
+}
+
+// NewClient returns a client querying servers
+func NewClient(servers []string, timeout time.Duration) *Client {
+	c := &Client{Timeout: timeout}
+	for _, server := range servers {
+		server = strings.TrimSpace(server)
+		if server == "" {
+			continue
+		}
+		if _, _, err := net.SplitHostPort(server); err != nil {
+			server = net.JoinHostPort(strings.Trim(server, "[]"), "53")
+		}
+		c.Servers = append(c.Servers, server)
+	}
+	return c
+}
+
+// Query implements Querier
+func (c *Client) Query(ctx context.Context, name string, qtype uint16) (records []Record, notFound bool, negTTL uint32, err error) {
+	id := uint16(rand.Intn(65536))
+	query, err := newQuery(id, name, qtype)
+	if err != nil {
+		return nil, false, 0, err
+	}
+	for _, server := range c.Servers {
+		var resp []byte
+		resp, err = c.exchange(ctx, server, "udp", query)
+		// truncated: retry over TCP
+		if err == nil && len(resp) > 3 && resp[2]&0x02 != 0 {
+			resp, err = c.exchange(ctx, server, "tcp", query)
+		}
+		if err != nil {
+			continue
+		}
+		records, notFound, negTTL, err = parseResponse(id, name, qtype, resp)
+		if err != nil {
+			continue
+		}
+		return
+	}
+	if err == nil {
+		err = errors.New("no DNS server configured")
+	}
+	dnsErr := &net.DNSError{Err: err.Error(), Name: name, IsTemporary: true}
+	if netErr, ok := err.(net.Error); ok {
+		dnsErr.IsTimeout = netErr.Timeout()
+	}
+	return nil, false, 0, dnsErr
+}
+
+// exchange sends query to server and returns its response
+func (c *Client) exchange(ctx context.Context, server, network string, query []byte) ([]byte, error) {
+	dialer := net.Dialer{Timeout: c.Timeout}
+	conn, err := dialer.DialContext(ctx, network, server)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	deadline := time.Now().Add(c.Timeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	if err = conn.SetDeadline(deadline); err != nil {
+		return nil, err
+	}
+	if network == "udp" {
+		if _, err = conn.Write(query); err != nil {
+			return nil, err
+		}
+		resp := make([]byte, 4096)
+		n, err := conn.Read(resp)
+		if err != nil {
+			return nil, err
+		}
+		return resp[:n], nil
+	}
+	msg := make([]byte, 2, 2+len(query))
+	binary.BigEndian.PutUint16(msg, uint16(len(query)))
+	if _, err = conn.Write(append(msg, query...)); err != nil {
+		return nil, err
+	}
+	if _, err = io.ReadFull(conn, msg[:2]); err != nil {
+		return nil, err
+	}
+	resp := make([]byte, binary.BigEndian.Uint16(msg[:2]))
+	if _, err = io.ReadFull(conn, resp); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// newQuery returns a recursive query for name with an EDNS0 OPT record
+// advertising a 4096 bytes UDP payload
+func newQuery(id uint16, name string, qtype uint16) ([]byte, error) {
+	q := make([]byte, 12)
+	binary.BigEndian.PutUint16(q[0:], id)
+	binary.BigEndian.PutUint16(q[2:], 0x0100) // RD
+	binary.BigEndian.PutUint16(q[4:], 1)      // QDCOUNT
+	binary.BigEndian.PutUint16(q[10:], 1)     // ARCOUNT
+
+	for _, label := range strings.Split(strings.TrimSuffix(name, "."), ".") {
+		if len(label) == 0 || len(label) > 63 {
+			return nil, errors.New("invalid DNS name " + name)
+		}
+		q = append(q, byte(len(label)))
+		q = append(q, label...)
+	}
+	q = append(q, 0, byte(qtype>>8), byte(qtype), 0, classIN)
+
+	// OPT: root name, type, UDP payload size, extended rcode & version, flags, rdlength
+	q = append(q, 0, 0, 41, 0x10, 0x00, 0, 0, 0, 0, 0, 0)
+	return q, nil
+}
+
+// parseResponse returns the records of type qtype of a response to the
+// query id for name
+// The response must repeat the question of the query, else it is refused.
+// Negative answers are cached for the TTL of the SOA record of the
+// authority section (RFC 2308 5).
+func parseResponse(id uint16, name string, qtype uint16, resp []byte) (records []Record, notFound bool, negTTL uint32, err error) {
+	if len(resp) < 12 {
+		return nil, false, 0, errors.New("DNS response too short")
+	}
+	if binary.BigEndian.Uint16(resp[0:]) != id {
+		return nil, false, 0, errors.New("DNS response ID mismatch")
+	}
+	flags := binary.BigEndian.Uint16(resp[2:])
+	switch rcode := flags & 0x000f; rcode {
+	case rcodeNoError:
+	case rcodeNXDomain:
+		notFound = true
+	default:
+		return nil, false, 0, fmt.Errorf("DNS query failed with rcode %d", rcode)
+	}
+	if binary.BigEndian.Uint16(resp[4:]) != 1 {
+		return nil, false, 0, errors.New("DNS response question count mismatch")
+	}
+	anCount := int(binary.BigEndian.Uint16(resp[6:]))
+	nsCount := int(binary.BigEndian.Uint16(resp[8:]))
+
+	// question
+	qName, off, err := readName(resp, 12)
+	if err != nil {
+		return nil, false, 0, err
+	}
+	if off+4 > len(resp) {
+		return nil, false, 0, errors.New("DNS response truncated")
+	}
+	if qName != strings.ToLower(strings.TrimSuffix(name, "."))+"." || binary.BigEndian.Uint16(resp[off:]) != qtype || binary.BigEndian.Uint16(resp[off+2:]) != classIN {
+		return nil, false, 0, errors.New("DNS response question mismatch")
+	}
+	off += 4
+	for i := 0; i < anCount+nsCount; i++ {
+		var record Record
+		if record, off, err = readRecord(resp, off); err != nil {
+			return nil, false, 0, err
+		}
+		switch {
+		// authority section
+		case i >= anCount:
+			if record.Type == TypeSOA {
+				negTTL = record.TTL
+				if fields := strings.Fields(record.Value); len(fields) == 1 {
+					if minimum, err := strconv.ParseUint(fields[0], 10, 32); err == nil && uint32(minimum) < negTTL {
+						negTTL = uint32(minimum)
+					}
+				}
+			}
+		// CNAME are followed by the resolver
+		case record.Type == qtype && !notFound:
+			records = append(records, record)
+		}
+	}
+	if len(records) == 0 {
+		notFound = true
+	}
+	return records, notFound, negTTL, nil
+}
+
+// readRecord reads the resource record at off and returns the offset
+// following it
+// The value of a SOA record is its minimum field.
+func readRecord(msg []byte, off int) (record Record, next int, err error) {
+	if record.Name, off, err = readName(msg, off); err != nil {
+		return
+	}
+	if off+10 > len(msg) {
+		return record, 0, errors.New("DNS response truncated")
+	}
+	record.Type = binary.BigEndian.Uint16(msg[off:])
+	record.TTL = binary.BigEndian.Uint32(msg[off+4:])
+	rdLength := int(binary.BigEndian.Uint16(msg[off+8:]))
+	off += 10
+	next = off + rdLength
+	if next > len(msg) {
+		return record, 0, errors.New("DNS response truncated")
+	}
+	rdata := msg[off:next]
+	switch record.Type {
+	case TypeA, TypeAAAA:
+		if len(rdata) != net.IPv4len && len(rdata) != net.IPv6len {
+			return record, 0, errors.New("invalid address record")
+		}
+		record.Value = net.IP(rdata).String()
+	case TypeMX:
+		if len(rdata) < 3 {
+			return record, 0, errors.New("invalid MX record")
+		}
+		var host string
+		if host, _, err = readName(msg, off+2); err != nil {
+			return record, 0, err
+		}
+		record.Value = fmt.Sprintf("%d %s", binary.BigEndian.Uint16(rdata), host)
+	case TypeTXT:
+		var txt []byte
+		for i := 0; i < len(rdata); {
+			l := int(rdata[i])
+			if i+1+l > len(rdata) {
+				return record, 0, errors.New("invalid TXT record")
+			}
+			txt = append(txt, rdata[i+1:i+1+l]...)
+			i += 1 + l
+		}
+		record.Value = string(txt)
+	case TypePTR, TypeCNAME:
+		if record.Value, _, err = readName(msg, off); err != nil {
+			return record, 0, err
+		}
+	case TypeSOA:
+		// mname, rname, serial, refresh, retry, expire, minimum
+		p := off
+		for i := 0; i < 2; i++ {
+			if _, p, err = readName(msg, p); err != nil {
+				return record, 0, err
+			}
+		}
+		if p+20 > next {
+			return record, 0, errors.New("invalid SOA record")
+		}
+		record.Value = strconv.FormatUint(uint64(binary.BigEndian.Uint32(msg[p+16:])), 10)
+	}
+	return record, next, nil
+}
+
+// readName reads the (possibly compressed) name at off and returns it
+// with a trailing dot and the offset following it
+func readName(msg []byte, off int) (name string, next int, err error) {
+	var labels []string
+	next = -1
+	for jumps := 0; ; {
+		if off >= len(msg) {
+			return "", 0, errors.New("DNS response truncated")
+		}
+		l := int(msg[off])
+		switch {
+		case l == 0:
+			if next == -1 {
+				next = off + 1
+			}
+			return strings.ToLower(strings.Join(labels, ".")) + ".", next, nil
+		// compression pointer
+		case l&0xc0 == 0xc0:
+			if off+1 >= len(msg) {
+				return "", 0, errors.New("DNS response truncated")
+			}
+			if next == -1 {
+				next = off + 2
+			}
+			if jumps++; jumps > 64 {
+				return "", 0, errors.New("DNS compression loop")
+			}
+			off = int(binary.BigEndian.Uint16(msg[off:]) & 0x3fff)
+		default:
+			if off+1+l > len(msg) {
+				return "", 0, errors.New("DNS response truncated")
+			}
+			labels = append(labels, string(msg[off+1:off+1+l]))
+			off += 1 + l
+		}
+	}
+}
+
+// System queries the system resolver, which doesn't provide TTLs:
+// answers are cached for TTL.
+type System struct {
+	Resolver *net.Resolver
+	Timeout  time.Duration
+	TTL      uint32
+}
+
+// Query implements Querier
+func (s *System) Query(ctx context.Context, name string, qtype uint16) (records []Record, notFound bool, negTTL uint32, err error) {
+	if s.Timeout != 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.Timeout)
+		defer cancel()
+	}
+	var values []string
+	switch qtype {
+	case TypeA, TypeAAAA:
+		network := "ip4"
+		if qtype == TypeAAAA {
+			network = "ip6"
+		}
+		var ips []net.IP
+		if ips, err = s.Resolver.LookupIP(ctx, network, name); err == nil {
+			for _, ip := range ips {
+				values = append(values, ip.String())
+			}
+		}
+	case TypeMX:
+		var mxs []*net.MX
+		if mxs, err = s.Resolver.LookupMX(ctx, name); err == nil {
+			for _, mx := range mxs {
+				values = append(values, fmt.Sprintf("%d %s", mx.Pref, mx.Host))
+			}
+		}
+	case TypeTXT:
+		values, err = s.Resolver.LookupTXT(ctx, name)
+	case TypePTR:
+		values, err = s.Resolver.LookupAddr(ctx, ptrAddr(name))
+	default:
+		return nil, false, 0, fmt.Errorf("unsupported record type %d", qtype)
+	}
+	if err != nil {
+		if isNotFound(err) {
+			return nil, true, s.TTL, nil
+		}
+		return nil, false, 0, err
+	}
+	if len(values) == 0 {
+		return nil, true, s.TTL, nil
+	}
+	for _, value := range values {
+		records = append(records, Record{Name: name, Type: qtype, TTL: s.TTL, Value: value})
+	}
+	return records, false, 0, nil
+}
+
+// ptrAddr returns the address of a reverse name
+func ptrAddr(name string) string {
+	labels := strings.Split(strings.TrimSuffix(name, "."), ".")
+	switch {
+	case strings.HasSuffix(name, ".in-addr.arpa.") && len(labels) == 6:
+		return labels[3] + "." + labels[2] + "." + labels[1] + "." + labels[0]
+	case strings.HasSuffix(name, ".ip6.arpa.") && len(labels) == 34:
+		ip := make(net.IP, net.IPv6len)
+		for i := 0; i < 32; i++ {
+			n, err := strconv.ParseUint(labels[i], 16, 8)
+			if err != nil {
+				return name
+			}
+			ip[15-i/2] |= byte(n) << (4 * uint(i%2))
+		}
+		return ip.String()
+	}
+	return name
+}
@@ -0,0 +1,303 @@
+// Package resolver provides a caching DNS resolver which queries
+// configurable upstream servers (or the system resolver) and which can be
+// overridden by a static zone file.
+package resolver
+
+import (
+	"context"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Resolver is the interface of DNS lookups used by cocosmail
+// *net.Resolver implements it.
+type Resolver interface {
+	LookupTXT(ctx context.Context, name string) ([]string, error)
+	LookupMX(ctx context.Context, name string) ([]*net.MX, error)
+	LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error)
+	LookupAddr(ctx context.Context, addr string) ([]string, error)
+}
+
+// Record types
+const (
+	TypeA     uint16 = 1
+	TypeCNAME uint16 = 5
+	TypeSOA   uint16 = 6
+	TypePTR   uint16 = 12
+	TypeMX    uint16 = 15
+	TypeTXT   uint16 = 16
+	TypeAAAA  uint16 = 28
+)
+
+// Record represents a resource record
+// Value is the IP for A and AAAA, "preference host" for MX, the text for
+// TXT and the target name for PTR and CNAME.
+type Record struct {
+	Name  string
+	Type  uint16
+	TTL   uint32
+	Value string
+}
+
+// Querier queries records of type qtype for name
+// If name doesn't exist or has no records of this type, notFound is true
+// and negTTL is the time the answer can be cached.
+type Querier interface {
+	Query(ctx context.Context, name string, qtype uint16) (records []Record, notFound bool, negTTL uint32, err error)
+}
+
+// maxCacheEntries is the size of the cache above which expired entries
+// are purged
+const maxCacheEntries = 10000
+
+type cacheKey struct {
+	name  string
+	qtype uint16
+}
+
+type cacheEntry struct {
+	records  []Record
+	notFound bool
+	expires  time.Time
+}
+
+// CachingResolver resolves names from Zone, then from Upstream, and keeps
+// answers of Upstream in cache for their TTL (capped at MaxTTL).
+// If Upstream is nil, names which are not in Zone don't exist.
+// If MaxTTL is 0 answers are not cached.
+type CachingResolver struct {
+	Zone     *Zone
+	Upstream Querier
+	MaxTTL   time.Duration
+
+	sync.Mutex
+	cache map[cacheKey]cacheEntry
+	// now returns the current time (for testing)
+	now func() time.Time
+}
+
+// New returns a caching resolver
+func New(zone *Zone, upstream Querier, maxTTL time.Duration) *CachingResolver {
+	return &CachingResolver{
+		Zone:     zone,
+		Upstream: upstream,
+		MaxTTL:   maxTTL,
+		cache:    make(map[cacheKey]cacheEntry),
+		now:      time.Now,
+	}
+}
+
+// Flush empties the cache
+func (r *CachingResolver) Flush() {
+	r.Lock()
+	r.cache = make(map[cacheKey]cacheEntry)
+	r.Unlock()
+}
+
+// lookup returns the records of type qtype for name
+func (r *CachingResolver) lookup(ctx context.Context, name string, qtype uint16) ([]Record, error) {
+	name = Fqdn(name)
+	if r.Zone != nil {
+		if records, found := r.Zone.Lookup(name, qtype); found {
+			if len(records) == 0 {
+				return nil, notFoundError(name)
+			}
+			return records, nil
+		}
+	}
+	if r.Upstream == nil {
+		return nil, notFoundError(name)
+	}
+
+	key := cacheKey{name, qtype}
+	r.Lock()
+	entry, ok := r.cache[key]
+	r.Unlock()
+	if ok && r.now().Before(entry.expires) {
+		if entry.notFound {
+			return nil, notFoundError(name)
+		}
+		return entry.records, nil
+	}
+
+	records, notFound, negTTL, err := r.Upstream.Query(ctx, name, qtype)
+	if err != nil {
+		if dnsErr, ok := err.(*net.DNSError); ok {
+			return nil, dnsErr
+		}
+		return nil, &net.DNSError{Err: err.Error(), Name: name, IsTemporary: true}
+	}
+	ttl := negTTL
+	if !notFound {
+		for i, record := range records {
+			if i == 0 || record.TTL < ttl {
+				ttl = record.TTL
+			}
+		}
+	}
+	r.store(key, cacheEntry{records: records, notFound: notFound}, time.Duration(ttl)*time.Second)
+	if notFound {
+		return nil, notFoundError(name)
+	}
+	return records, nil
+}
+
+// store caches entry for ttl
+func (r *CachingResolver) store(key cacheKey, entry cacheEntry, ttl time.Duration) {
+	if ttl > r.MaxTTL {
+		ttl = r.MaxTTL
+	}
+	if ttl <= 0 {
+		return
+	}
+	now := r.now()
+	entry.expires = now.Add(ttl)
+	r.Lock()
+	defer r.Unlock()
+	if len(r.cache) >= maxCacheEntries {
+		for k, e := range r.cache {
+			if !now.Before(e.expires) {
+				delete(r.cache, k)
+			}
+		}
+		if len(r.cache) >= maxCacheEntries {
+			r.cache = make(map[cacheKey]cacheEntry)
+		}
+	}
+	r.cache[key] = entry
+}
+
+// LookupTXT returns the TXT records of name
+func (r *CachingResolver) LookupTXT(ctx context.Context, name string) ([]string, error) {
+	records, err := r.lookup(ctx, name, TypeTXT)
+	if err != nil {
+		return nil, err
+	}
+	txts := make([]string, 0, len(records))
+	for _, record := range records {
+		txts = append(txts, record.Value)
+	}
+	return txts, nil
+}
+
+// LookupMX returns the MX records of name sorted by preference
+func (r *CachingResolver) LookupMX(ctx context.Context, name string) ([]*net.MX, error) {
+	records, err := r.lookup(ctx, name, TypeMX)
+	if err != nil {
+		return nil, err
+	}
+	mxs := make([]*net.MX, 0, len(records))
+	for _, record := range records {
+		if mx := parseMX(record.Value); mx != nil {
+			mxs = append(mxs, mx)
+		}
+	}
+	sort.SliceStable(mxs, func(i, j int) bool { return mxs[i].Pref < mxs[j].Pref })
+	return mxs, nil
+}
+
+// LookupIPAddr returns the IPv4 and IPv6 addresses of host
+func (r *CachingResolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		return []net.IPAddr{{IP: ip}}, nil
+	}
+	var addrs []net.IPAddr
+	var lastErr error
+	for _, qtype := range []uint16{TypeA, TypeAAAA} {
+		records, err := r.lookup(ctx, host, qtype)
+		if err != nil {
+			if lastErr == nil || !isNotFound(err) {
+				lastErr = err
+			}
+			continue
+		}
+		for _, record := range records {
+			if ip := net.ParseIP(record.Value); ip != nil {
+				addrs = append(addrs, net.IPAddr{IP: ip})
+			}
+		}
+	}
+	if len(addrs) == 0 {
+		if lastErr == nil {
+			lastErr = notFoundError(Fqdn(host))
+		}
+		return nil, lastErr
+	}
+	return addrs, nil
+}
+
+// LookupAddr returns the names of addr (PTR records)
+func (r *CachingResolver) LookupAddr(ctx context.Context, addr string) ([]string, error) {
+	name, err := ReverseName(addr)
+	if err != nil {
+		return nil, err
+	}
+	records, err := r.lookup(ctx, name, TypePTR)
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(records))
+	for _, record := range records {
+		names = append(names, record.Value)
+	}
+	return names, nil
+}
+
+// Fqdn returns name in lower case with a trailing dot
+func Fqdn(name string) string {
+	name = strings.ToLower(name)
+	if !strings.HasSuffix(name, ".") {
+		name += "."
+	}
+	return name
+}
+
+// ReverseName returns the in-addr.arpa or ip6.arpa name of addr
+func ReverseName(addr string) (string, error) {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return "", &net.DNSError{Err: "unrecognized address", Name: addr}
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return net.IPv4(ip4[3], ip4[2], ip4[1], ip4[0]).String() + ".in-addr.arpa.", nil
+	}
+	const hexDigit = "0123456789abcdef"
+	b := make([]byte, 0, 72)
+	for i := len(ip) - 1; i >= 0; i-- {
+		b = append(b, hexDigit[ip[i]&0xf], '.', hexDigit[ip[i]>>4], '.')
+	}
+	return string(b) + "ip6.arpa.", nil
+}
+
+// parseMX parses the value of a MX record
+func parseMX(value string) *net.MX {
+	fields := strings.Fields(value)
+	if len(fields) != 2 {
+		return nil
+	}
+	pref := 0
+	for _, c := range fields[0] {
+		if c < '0' || c > '9' {
+			return nil
+		}
+		pref = pref*10 + int(c-'0')
+		if pref > 65535 {
+			return nil
+		}
+	}
+	return &net.MX{Host: fields[1], Pref: uint16(pref)}
+}
+
+// notFoundError returns the error of a non-existent name or record
+func notFoundError(name string) error {
+	return &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+}
+
+// isNotFound returns true if err is a notFoundError
+func isNotFound(err error) bool {
+	dnsErr, ok := err.(*net.DNSError)
+	return ok && dnsErr.IsNotFound
+}
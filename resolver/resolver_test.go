@@ -0,0 +1,194 @@
+package resolver
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const testZone = `
+# test zone
+example.com          MX    10 mx.example.com
+example.com          TXT   "v=spf1 " "mx -all"
+mx.example.com  300  A     192.0.2.1
+mx.example.com       AAAA  2001:db8::1
+192.0.2.1            PTR   mx.example.com
+www.example.com      CNAME mx.example.com
+nullmx.example.com   MX    0 .
+`
+
+// fakeQuerier counts queries and answers from records
+type fakeQuerier struct {
+	records map[string][]Record
+	queries int
+	err     error
+}
+
+func (q *fakeQuerier) Query(ctx context.Context, name string, qtype uint16) ([]Record, bool, uint32, error) {
+	q.queries++
+	if q.err != nil {
+		return nil, false, 0, q.err
+	}
+	var records []Record
+	for _, r := range q.records[name] {
+		if r.Type == qtype {
+			records = append(records, r)
+		}
+	}
+	return records, len(records) == 0, 30, nil
+}
+
+func Test_ParseZone(t *testing.T) {
+	z, err := ParseZone(strings.NewReader(testZone))
+	assert.NoError(t, err)
+	r := New(z, nil, time.Hour)
+	ctx := context.Background()
+
+	mxs, err := r.LookupMX(ctx, "Example.com")
+	assert.NoError(t, err)
+	assert.Equal(t, []*net.MX{{Host: "mx.example.com.", Pref: 10}}, mxs)
+
+	txts, err := r.LookupTXT(ctx, "example.com")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"v=spf1 mx -all"}, txts)
+
+	addrs, err := r.LookupIPAddr(ctx, "www.example.com")
+	assert.NoError(t, err)
+	assert.Len(t, addrs, 2)
+
+	names, err := r.LookupAddr(ctx, "192.0.2.1")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"mx.example.com."}, names)
+
+	mxs, err = r.LookupMX(ctx, "nullmx.example.com")
+	assert.NoError(t, err)
+	assert.Equal(t, ".", mxs[0].Host)
+
+	// name of the zone without record of this type
+	_, err = r.LookupTXT(ctx, "mx.example.com")
+	assert.True(t, isNotFound(err))
+	// no upstream
+	_, err = r.LookupMX(ctx, "example.org")
+	assert.True(t, isNotFound(err))
+
+	_, err = ParseZone(strings.NewReader("example.com MX mx.example.com"))
+	assert.Error(t, err)
+	_, err = ParseZone(strings.NewReader("example.com SRV 0 0 25 mx.example.com"))
+	assert.Error(t, err)
+}
+
+func Test_CachingResolver(t *testing.T) {
+	upstream := &fakeQuerier{records: map[string][]Record{
+		"example.org.": {{Name: "example.org.", Type: TypeMX, TTL: 60, Value: "20 mx2.example.org."}, {Name: "example.org.", Type: TypeMX, TTL: 120, Value: "10 mx1.example.org."}},
+	}}
+	z, err := ParseZone(strings.NewReader(testZone))
+	assert.NoError(t, err)
+	r := New(z, upstream, time.Hour)
+	now := time.Now()
+	r.now = func() time.Time { return now }
+	ctx := context.Background()
+
+	mxs, err := r.LookupMX(ctx, "example.org")
+	assert.NoError(t, err)
+	assert.Equal(t, "mx1.example.org.", mxs[0].Host)
+	_, err = r.LookupMX(ctx, "example.org.")
+	assert.NoError(t, err)
+	assert.Equal(t, 1, upstream.queries)
+
+	// zone overrides upstream
+	_, err = r.LookupMX(ctx, "example.com")
+	assert.NoError(t, err)
+	assert.Equal(t, 1, upstream.queries)
+
+	// negative answers are cached
+	_, err = r.LookupTXT(ctx, "example.org")
+	assert.True(t, isNotFound(err))
+	_, err = r.LookupTXT(ctx, "example.org")
+	assert.True(t, isNotFound(err))
+	assert.Equal(t, 2, upstream.queries)
+
+	// lowest TTL
+	now = now.Add(61 * time.Second)
+	_, err = r.LookupMX(ctx, "example.org")
+	assert.NoError(t, err)
+	assert.Equal(t, 3, upstream.queries)
+
+	// errors are temporary and not cached
+	r.Flush()
+	upstream.err = errors.New("i/o timeout")
+	_, err = r.LookupMX(ctx, "example.org")
+	dnsErr, ok := err.(*net.DNSError)
+	assert.True(t, ok)
+	assert.True(t, dnsErr.IsTemporary)
+	upstream.err = nil
+	_, err = r.LookupMX(ctx, "example.org")
+	assert.NoError(t, err)
+	assert.Equal(t, 5, upstream.queries)
+}
+
+func Test_parseResponse(t *testing.T) {
+	query, err := newQuery(42, "example.org", TypeMX)
+	assert.NoError(t, err)
+	// response: query header with QR, RD, RA flags, 1 answer, no additional
+	resp := append([]byte{}, query[:len(query)-11]...)
+	binary.BigEndian.PutUint16(resp[2:], 0x8180)
+	binary.BigEndian.PutUint16(resp[6:], 1)
+	binary.BigEndian.PutUint16(resp[10:], 0)
+	// name pointer to question, type MX, class IN, TTL 300, rdlength, pref 10, mx.<pointer>
+	resp = append(resp, 0xc0, 12, 0, byte(TypeMX), 0, classIN, 0, 0, 1, 0x2c, 0, 7, 0, 10, 2, 'm', 'x', 0xc0, 12)
+
+	records, notFound, _, err := parseResponse(42, "example.org", TypeMX, resp)
+	assert.NoError(t, err)
+	assert.False(t, notFound)
+	assert.Equal(t, []Record{{Name: "example.org.", Type: TypeMX, TTL: 300, Value: "10 mx.example.org."}}, records)
+
+	// question is not case sensitive
+	_, _, _, err = parseResponse(42, "Example.ORG.", TypeMX, resp)
+	assert.NoError(t, err)
+
+	_, _, _, err = parseResponse(43, "example.org", TypeMX, resp)
+	assert.Error(t, err)
+
+	// question mismatch
+	_, _, _, err = parseResponse(42, "example.com", TypeMX, resp)
+	assert.Error(t, err)
+	_, _, _, err = parseResponse(42, "example.org", TypeTXT, resp)
+	assert.Error(t, err)
+	bad := append([]byte{}, resp...)
+	binary.BigEndian.PutUint16(bad[4:], 2)
+	_, _, _, err = parseResponse(42, "example.org", TypeMX, bad)
+	assert.Error(t, err)
+	bad = append([]byte{}, resp...)
+	bad[len(query)-12] = 3 // class CH
+	_, _, _, err = parseResponse(42, "example.org", TypeMX, bad)
+	assert.Error(t, err)
+
+	// NXDOMAIN
+	binary.BigEndian.PutUint16(resp[2:], 0x8183)
+	_, notFound, _, err = parseResponse(42, "example.org", TypeMX, resp)
+	assert.NoError(t, err)
+	assert.True(t, notFound)
+
+	// SERVFAIL
+	binary.BigEndian.PutUint16(resp[2:], 0x8182)
+	_, _, _, err = parseResponse(42, "example.org", TypeMX, resp)
+	assert.Error(t, err)
+}
+
+func Test_ReverseName(t *testing.T) {
+	name, err := ReverseName("192.0.2.1")
+	assert.NoError(t, err)
+	assert.Equal(t, "1.2.0.192.in-addr.arpa.", name)
+	name, err = ReverseName("2001:db8::1")
+	assert.NoError(t, err)
+	assert.Equal(t, "1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.ip6.arpa.", name)
+	assert.Equal(t, "2001:db8::1", ptrAddr(name))
+	_, err = ReverseName("mx.example.com")
+	assert.Error(t, err)
+}
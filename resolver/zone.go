@@ -0,0 +1,185 @@
+package resolver
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Zone holds static records which override the upstream servers
+// A name of the zone only has the records of the zone.
+type Zone struct {
+	records map[string][]Record
+}
+
+// LoadZone loads a zone file
+func LoadZone(path string) (*Zone, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ParseZone(f)
+}
+
+// ParseZone parses a zone file
+// Each line is a record: name [ttl] type value
+//
+//	example.com       MX   10 mx.example.com
+//	mx.example.com    A    192.0.2.1
+//	mx.example.com    AAAA 2001:db8::1
+//	example.com       TXT  "v=spf1 mx -all"
+//	192.0.2.1         PTR  mx.example.com
+//	www.example.com   CNAME example.com
+//
+// Names are absolute, the name of a PTR record can be an IP.
+// Comments start with # or ;
+func ParseZone(r io.Reader) (*Zone, error) {
+	z := &Zone{records: make(map[string][]Record)}
+	scanner := bufio.NewScanner(r)
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' || line[0] == ';' {
+			continue
+		}
+		record, err := parseZoneLine(line)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %s", lineNumber, err)
+		}
+		z.records[record.Name] = append(z.records[record.Name], record)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return z, nil
+}
+
+// parseZoneLine parses a record of a zone file
+func parseZoneLine(line string) (record Record, err error) {
+	fields := strings.Fields(line)
+	if len(fields) < 3 {
+		return record, fmt.Errorf("bad record %q", line)
+	}
+	record.Name = Fqdn(fields[0])
+	record.TTL = 3600
+	rest := fields[1:]
+	if ttl, err := strconv.ParseUint(rest[0], 10, 32); err == nil {
+		record.TTL = uint32(ttl)
+		rest = rest[1:]
+		if len(rest) < 2 {
+			return record, fmt.Errorf("bad record %q", line)
+		}
+	}
+	value := strings.Join(rest[1:], " ")
+	switch strings.ToUpper(rest[0]) {
+	case "A", "AAAA":
+		ip := net.ParseIP(value)
+		if ip == nil {
+			return record, fmt.Errorf("bad IP %q", value)
+		}
+		record.Type = TypeA
+		if ip.To4() == nil {
+			record.Type = TypeAAAA
+		}
+		record.Value = ip.String()
+	case "MX":
+		if len(rest) != 3 || parseMX(value) == nil {
+			return record, fmt.Errorf("bad MX %q", value)
+		}
+		record.Type = TypeMX
+		record.Value = rest[1] + " " + Fqdn(rest[2])
+		if rest[2] == "." {
+			record.Value = rest[1] + " ."
+		}
+	case "TXT":
+		record.Type = TypeTXT
+		record.Value = unquoteTXT(afterFields(line, len(fields)-len(rest)+1))
+	case "PTR":
+		if len(rest) != 2 {
+			return record, fmt.Errorf("bad PTR %q", value)
+		}
+		if ip := net.ParseIP(fields[0]); ip != nil {
+			record.Name, _ = ReverseName(fields[0])
+		}
+		record.Type = TypePTR
+		record.Value = Fqdn(rest[1])
+	case "CNAME":
+		if len(rest) != 2 {
+			return record, fmt.Errorf("bad CNAME %q", value)
+		}
+		record.Type = TypeCNAME
+		record.Value = Fqdn(rest[1])
+	default:
+		return record, fmt.Errorf("unsupported record type %s", rest[0])
+	}
+	return record, nil
+}
+
+// afterFields returns line without its first n fields
+func afterFields(line string, n int) string {
+	for i := 0; i < n; i++ {
+		line = strings.TrimLeft(line, " \t")
+		if p := strings.IndexAny(line, " \t"); p != -1 {
+			line = line[p:]
+		} else {
+			line = ""
+		}
+	}
+	return strings.TrimSpace(line)
+}
+
+// unquoteTXT returns the text of a TXT value made of one or more quoted
+// strings, or the value itself if it is not quoted
+func unquoteTXT(value string) string {
+	if !strings.HasPrefix(value, "\"") {
+		return value
+	}
+	var txt strings.Builder
+	inQuotes := false
+	for i := 0; i < len(value); i++ {
+		c := value[i]
+		switch {
+		case c == '"':
+			inQuotes = !inQuotes
+		case c == '\\' && inQuotes && i+1 < len(value):
+			i++
+			txt.WriteByte(value[i])
+		case inQuotes:
+			txt.WriteByte(c)
+		}
+	}
+	return txt.String()
+}
+
+// Lookup returns the records of type qtype for name, following CNAME
+// records of the zone
+// found is false if name is not in the zone.
+func (z *Zone) Lookup(name string, qtype uint16) (records []Record, found bool) {
+	name = Fqdn(name)
+	for i := 0; i < 8; i++ {
+		all, ok := z.records[name]
+		if !ok {
+			return records, found
+		}
+		found = true
+		cname := ""
+		for _, record := range all {
+			if record.Type == qtype {
+				records = append(records, record)
+			} else if record.Type == TypeCNAME {
+				cname = record.Value
+			}
+		}
+		if len(records) != 0 || cname == "" || qtype == TypeCNAME {
+			return records, found
+		}
+		name = cname
+	}
+	return records, found
+}
@@ -0,0 +1,59 @@
+package rest
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/stunndard/cocosmail/api"
+)
+
+// greylistEntry is the JSON representation of a greylisted triplet
+type greylistEntry struct {
+	Network   string    `json:"network"`
+	MailFrom  string    `json:"mailFrom"`
+	RcptTo    string    `json:"rcptTo"`
+	Passed    bool      `json:"passed"`
+	FirstSeen time.Time `json:"firstSeen"`
+	LastSeen  time.Time `json:"lastSeen"`
+	PassedAt  time.Time `json:"passedAt"`
+	Attempts  int       `json:"attempts"`
+}
+
+// greylistGetAll returns greylisted triplets
+func greylistGetAll(w http.ResponseWriter, r *http.Request) {
+	if !authorized(w, r) {
+		return
+	}
+	entries, err := api.GreylistGetAll()
+	if err != nil {
+		httpWriteErrorJson(w, 500, "unable to get greylist", err.Error())
+		return
+	}
+	out := []greylistEntry{}
+	for _, e := range entries {
+		out = append(out, greylistEntry{
+			Network:   e.Network,
+			MailFrom:  e.MailFrom,
+			RcptTo:    e.RcptTo,
+			Passed:    e.Passed(),
+			FirstSeen: e.FirstSeen,
+			LastSeen:  e.LastSeen,
+			PassedAt:  e.PassedAt,
+			Attempts:  e.Attempts,
+		})
+	}
+	js, err := json.Marshal(out)
+	if err != nil {
+		httpWriteErrorJson(w, 500, "JSON encondig failed", err.Error())
+		return
+	}
+	httpWriteJson(w, js)
+}
+
+// addGreylistHandlers add greylisting handlers to router
+func addGreylistHandlers(router *httprouter.Router) {
+	// get greylisted triplets
+	router.GET("/greylist", wrapHandler(greylistGetAll))
+}
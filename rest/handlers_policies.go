@@ -0,0 +1,89 @@
+package rest
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/jinzhu/gorm"
+	"github.com/julienschmidt/httprouter"
+	"github.com/nbio/httpcontext"
+	"github.com/stunndard/cocosmail/api"
+)
+
+// policiesGetAll returns all delivery policies
+func policiesGetAll(w http.ResponseWriter, r *http.Request) {
+	if !authorized(w, r) {
+		return
+	}
+	policies, err := api.DeliveryPolicyGetAll()
+	if err != nil {
+		httpWriteErrorJson(w, 500, "unable to get delivery policies", err.Error())
+		return
+	}
+	js, err := json.Marshal(policies)
+	if err != nil {
+		httpWriteErrorJson(w, 500, "JSON encondig failed", err.Error())
+		return
+	}
+	httpWriteJson(w, js)
+}
+
+// policiesAdd adds a delivery policy
+func policiesAdd(w http.ResponseWriter, r *http.Request) {
+	if !authorized(w, r) {
+		return
+	}
+	p := struct {
+		MaxConns         int  `json:"maxConns"`
+		MaxMsgsPerMinute int  `json:"maxMsgsPerMinute"`
+		Backoff421       int  `json:"backoff421"`
+		RequireDANE      bool `json:"requireDANE"`
+	}{}
+
+	// nil body
+	if r.Body == nil {
+		httpWriteErrorJson(w, 422, "empty body", "")
+		return
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&p); err != nil {
+		httpWriteErrorJson(w, 500, "unable to get JSON body", err.Error())
+		return
+	}
+
+	pattern := httpcontext.Get(r, "params").(httprouter.Params).ByName("pattern")
+	if err := api.DeliveryPolicyAdd(pattern, p.MaxConns, p.MaxMsgsPerMinute, p.Backoff421, p.RequireDANE); err != nil {
+		httpWriteErrorJson(w, 422, "unable to create new delivery policy", err.Error())
+		return
+	}
+	logInfo(r, "delivery policy added "+pattern)
+	w.WriteHeader(201)
+}
+
+// policiesDel deletes a delivery policy
+func policiesDel(w http.ResponseWriter, r *http.Request) {
+	if !authorized(w, r) {
+		return
+	}
+	pattern := httpcontext.Get(r, "params").(httprouter.Params).ByName("pattern")
+	err := api.DeliveryPolicyDel(pattern)
+	if err == gorm.ErrRecordNotFound {
+		httpWriteErrorJson(w, 404, "no such delivery policy "+pattern, "")
+		return
+	}
+	if err != nil {
+		httpWriteErrorJson(w, 500, "unable to del delivery policy "+pattern, err.Error())
+		return
+	}
+	logInfo(r, "delivery policy deleted "+pattern)
+}
+
+// addPoliciesHandlers add delivery policies handlers to router
+func addPoliciesHandlers(router *httprouter.Router) {
+	// get all policies
+	router.GET("/policies", wrapHandler(policiesGetAll))
+	// add a policy
+	router.POST("/policies/:pattern", wrapHandler(policiesAdd))
+	// del a policy
+	router.DELETE("/policies/:pattern", wrapHandler(policiesDel))
+}
@@ -0,0 +1,95 @@
+package rest
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/julienschmidt/httprouter"
+	"github.com/nbio/httpcontext"
+	"github.com/stunndard/cocosmail/api"
+)
+
+// remoteHost is the JSON representation of a remote host
+type remoteHost struct {
+	IP                  string    `json:"ip"`
+	Host                string    `json:"host"`
+	State               string    `json:"state"`
+	ConsecutiveFailures int       `json:"consecutiveFailures"`
+	LastFailureType     string    `json:"lastFailureType"`
+	LastError           string    `json:"lastError"`
+	LastFailureAt       time.Time `json:"lastFailureAt"`
+	OpenUntil           time.Time `json:"openUntil"`
+}
+
+// remoteHostsGetAll returns remote hosts with connection failures
+func remoteHostsGetAll(w http.ResponseWriter, r *http.Request) {
+	if !authorized(w, r) {
+		return
+	}
+	hosts, err := api.RemoteHostGetAll()
+	if err != nil {
+		httpWriteErrorJson(w, 500, "unable to get remote hosts", err.Error())
+		return
+	}
+	out := []remoteHost{}
+	for _, h := range hosts {
+		out = append(out, remoteHost{
+			IP:                  h.IP,
+			Host:                h.Host,
+			State:               h.State(),
+			ConsecutiveFailures: h.ConsecutiveFailures,
+			LastFailureType:     h.LastFailureType,
+			LastError:           h.LastError,
+			LastFailureAt:       h.LastFailureAt,
+			OpenUntil:           h.OpenUntil,
+		})
+	}
+	js, err := json.Marshal(out)
+	if err != nil {
+		httpWriteErrorJson(w, 500, "JSON encondig failed", err.Error())
+		return
+	}
+	httpWriteJson(w, js)
+}
+
+// remoteHostsReset resets connection failures of a remote host
+func remoteHostsReset(w http.ResponseWriter, r *http.Request) {
+	if !authorized(w, r) {
+		return
+	}
+	ip := httpcontext.Get(r, "params").(httprouter.Params).ByName("ip")
+	err := api.RemoteHostReset(ip)
+	if err == gorm.ErrRecordNotFound {
+		httpWriteErrorJson(w, 404, "no such remote host "+ip, "")
+		return
+	}
+	if err != nil {
+		httpWriteErrorJson(w, 500, "unable to reset remote host "+ip, err.Error())
+		return
+	}
+	logInfo(r, "remote host reset "+ip)
+}
+
+// remoteHostsResetAll resets connection failures of all remote hosts
+func remoteHostsResetAll(w http.ResponseWriter, r *http.Request) {
+	if !authorized(w, r) {
+		return
+	}
+	if err := api.RemoteHostResetAll(); err != nil {
+		httpWriteErrorJson(w, 500, "unable to reset remote hosts", err.Error())
+		return
+	}
+	logInfo(r, "all remote hosts reset")
+}
+
+// addRemoteHostsHandlers add remote hosts handlers to router
+func addRemoteHostsHandlers(router *httprouter.Router) {
+	// get remote hosts with failures
+	router.GET("/remotehosts", wrapHandler(remoteHostsGetAll))
+	// reset all remote hosts
+	router.DELETE("/remotehosts", wrapHandler(remoteHostsResetAll))
+	// reset a remote host
+	router.DELETE("/remotehosts/:ip", wrapHandler(remoteHostsReset))
+}
@@ -0,0 +1,135 @@
+package rest
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/nbio/httpcontext"
+	"github.com/stunndard/cocosmail/api"
+)
+
+// route is the JSON representation of a route (SMTP auth password is not
+// returned)
+type route struct {
+	Id            int64  `json:"id"`
+	Host          string `json:"host"`
+	LocalIp       string `json:"localIp,omitempty"`
+	RemoteHost    string `json:"remoteHost"`
+	RemotePort    int64  `json:"remotePort"`
+	Priority      int64  `json:"priority"`
+	SmtpAuthLogin string `json:"smtpAuthLogin,omitempty"`
+	MailFrom      string `json:"mailFrom,omitempty"`
+	User          string `json:"user,omitempty"`
+	TlsPolicy     string `json:"tlsPolicy,omitempty"`
+	TlsClientCert string `json:"tlsClientCert,omitempty"`
+	TlsClientKey  string `json:"tlsClientKey,omitempty"`
+	TlsCaBundle   string `json:"tlsCaBundle,omitempty"`
+}
+
+// routesGetAll returns all routes
+func routesGetAll(w http.ResponseWriter, r *http.Request) {
+	if !authorized(w, r) {
+		return
+	}
+	routes, err := api.RoutesGet()
+	if err != nil {
+		httpWriteErrorJson(w, 500, "unable to get routes", err.Error())
+		return
+	}
+	out := []route{}
+	for _, rt := range routes {
+		out = append(out, route{
+			Id:            rt.Id,
+			Host:          rt.Host,
+			LocalIp:       rt.LocalIp.String,
+			RemoteHost:    rt.RemoteHost,
+			RemotePort:    rt.RemotePort.Int64,
+			Priority:      rt.Priority.Int64,
+			SmtpAuthLogin: rt.SmtpAuthLogin.String,
+			MailFrom:      rt.MailFrom.String,
+			User:          rt.User.String,
+			TlsPolicy:     rt.TlsPolicy.String,
+			TlsClientCert: rt.TlsClientCert.String,
+			TlsClientKey:  rt.TlsClientKey.String,
+			TlsCaBundle:   rt.TlsCaBundle.String,
+		})
+	}
+	js, err := json.Marshal(out)
+	if err != nil {
+		httpWriteErrorJson(w, 500, "JSON encondig failed", err.Error())
+		return
+	}
+	httpWriteJson(w, js)
+}
+
+// routesAdd adds a route
+func routesAdd(w http.ResponseWriter, r *http.Request) {
+	if !authorized(w, r) {
+		return
+	}
+	p := struct {
+		Host           string `json:"host"`
+		LocalIp        string `json:"localIp"`
+		RemoteHost     string `json:"remoteHost"`
+		RemotePort     int    `json:"remotePort"`
+		Priority       int    `json:"priority"`
+		SmtpAuthLogin  string `json:"smtpAuthLogin"`
+		SmtpAuthPasswd string `json:"smtpAuthPasswd"`
+		MailFrom       string `json:"mailFrom"`
+		User           string `json:"user"`
+		TlsPolicy      string `json:"tlsPolicy"`
+		TlsClientCert  string `json:"tlsClientCert"`
+		TlsClientKey   string `json:"tlsClientKey"`
+		TlsCaBundle    string `json:"tlsCaBundle"`
+	}{}
+
+	// nil body
+	if r.Body == nil {
+		httpWriteErrorJson(w, 422, "empty body", "")
+		return
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&p); err != nil {
+		httpWriteErrorJson(w, 500, "unable to get JSON body", err.Error())
+		return
+	}
+
+	if p.Host == "" {
+		p.Host = "*"
+	}
+	if err := api.RoutesAdd(p.Host, p.LocalIp, p.RemoteHost, p.RemotePort, p.Priority, p.User, p.MailFrom, p.SmtpAuthLogin, p.SmtpAuthPasswd, p.TlsPolicy, p.TlsClientCert, p.TlsClientKey, p.TlsCaBundle); err != nil {
+		httpWriteErrorJson(w, 422, "unable to create new route", err.Error())
+		return
+	}
+	logInfo(r, "route added for "+p.Host+" via "+p.RemoteHost)
+	w.WriteHeader(201)
+}
+
+// routesDel deletes a route
+func routesDel(w http.ResponseWriter, r *http.Request) {
+	if !authorized(w, r) {
+		return
+	}
+	id, err := strconv.ParseInt(httpcontext.Get(r, "params").(httprouter.Params).ByName("id"), 10, 64)
+	if err != nil {
+		httpWriteErrorJson(w, 422, "bad route ID", err.Error())
+		return
+	}
+	if err = api.RoutesDel(id); err != nil {
+		httpWriteErrorJson(w, 500, "unable to del route", err.Error())
+		return
+	}
+	logInfo(r, "route deleted "+strconv.FormatInt(id, 10))
+}
+
+// addRoutesHandlers add routes handlers to router
+func addRoutesHandlers(router *httprouter.Router) {
+	// get all routes
+	router.GET("/routes", wrapHandler(routesGetAll))
+	// add a route
+	router.POST("/routes", wrapHandler(routesAdd))
+	// del a route
+	router.DELETE("/routes/:id", wrapHandler(routesDel))
+}
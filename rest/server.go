@@ -31,6 +31,14 @@ func LaunchServer() {
 	addUsersHandlers(router)
 	// Queue
 	addQueueHandlers(router)
+	// Routes
+	addRoutesHandlers(router)
+	// Delivery policies
+	addPoliciesHandlers(router)
+	// Remote hosts health
+	addRemoteHostsHandlers(router)
+	// Greylisting
+	addGreylistHandlers(router)
 
 	// Microservice data handler
 	router.Handler("GET", "/msdata/:id", http.StripPrefix("/msdata/", http.FileServer(http.Dir(core.Cfg.GetTempDir()))))